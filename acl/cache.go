@@ -0,0 +1,373 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package acl
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reasons given for access decisions
+const (
+	ReasonAllowed    = "allowed"
+	ReasonNotAllowed = "not allowed"
+	ReasonNoSnapshot = "no access list"
+	ReasonExpired    = "access list expired"
+)
+
+// Represents the cache file: the last full snapshot, and the deltas applied
+// since, all exactly as signed by the server
+type cacheFile struct {
+	Snapshot json.RawMessage   `json:"snapshot"`
+	Deltas   []json.RawMessage `json:"deltas,omitempty"`
+}
+
+// equal reports whether two cache files hold exactly the same signed data
+func (f cacheFile) equal(other cacheFile) bool {
+	if !bytes.Equal(f.Snapshot, other.Snapshot) || len(f.Deltas) != len(other.Deltas) {
+		return false
+	}
+
+	for i := range f.Deltas {
+		if !bytes.Equal(f.Deltas[i], other.Deltas[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Keeps the newest valid access list for a realm, persisted to disk so a
+// door keeps working while the server is unreachable
+type Cache struct {
+	path      string
+	realm     string
+	publicKey *ecdsa.PublicKey
+
+	mu       sync.RWMutex
+	file     cacheFile
+	snapshot *Snapshot
+	allowed  map[uuid.UUID]bool
+	// The newest version ever used, kept beside the cache file so a door
+	// which restarts is not rolled back to an older access list
+	floor uint64
+}
+
+// Opens the cache stored at path, loading the access list saved there if any
+func OpenCache(path, realm string, publicKey *ecdsa.PublicKey) (*Cache, error) {
+	c := &Cache{
+		path:      path,
+		realm:     realm,
+		publicKey: publicKey,
+	}
+
+	if err := c.loadFloor(); err != nil {
+		return c, err
+	}
+
+	if err := c.Reload(); err != nil && !os.IsNotExist(err) {
+		return c, err
+	}
+
+	return c, nil
+}
+
+// floorPath returns the path of the file recording the newest version used
+func (c *Cache) floorPath() string {
+	return c.path + ".version"
+}
+
+// loadFloor reads the newest version used before the door last stopped
+func (c *Cache) loadFloor() error {
+	data, err := ioutil.ReadFile(c.floorPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	floor, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid access list version in %s", c.floorPath())
+	}
+
+	c.floor = floor
+	return nil
+}
+
+// Reloads the access list saved on disk, such as after it was replaced by
+// another process. Access lists older than any used before are rejected, as
+// are different ones with the same version unless they rebase it, but
+// expired ones are kept so the reason for denying access can be reported.
+func (c *Cache) Reload() error {
+	data, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+
+	var file cacheFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+
+	if file.Snapshot == nil {
+		// Saved before deltas were supported, as a bare snapshot
+		file = cacheFile{Snapshot: data}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	update := &Update{
+		Snapshot: file.Snapshot,
+		Deltas:   file.Deltas,
+	}
+
+	// The saved snapshot may predate the current version, with deltas
+	// leading up to it, so only the result is checked against the floor
+	next, nextFile, err := c.build(nil, update)
+	if err != nil {
+		return err
+	}
+
+	if c.snapshot != nil && next.Version == c.snapshot.Version && nextFile.equal(c.file) {
+		// Nothing new
+		return nil
+	}
+
+	if next.Version < c.floor {
+		return ErrStale
+	}
+
+	if c.snapshot != nil && next.Version <= c.snapshot.Version && !(next.Version == c.snapshot.Version && next.rebases(c.snapshot)) {
+		return ErrStale
+	}
+
+	c.set(next, nextFile)
+	return nil
+}
+
+// Verifies a distributed snapshot and, unless it is older than the current
+// access list or expired, saves it and starts using it
+func (c *Cache) Apply(data []byte) (*Snapshot, error) {
+	return c.ApplyUpdate(&Update{Snapshot: data})
+}
+
+// Verifies and applies an update from the server. Either the whole update is
+// saved and used, or none of it is.
+func (c *Cache) ApplyUpdate(update *Update) (*Snapshot, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	next, nextFile, err := c.build(c.snapshot, update)
+	if err != nil {
+		return nil, err
+	}
+
+	if next == c.snapshot {
+		// Nothing new
+		return next, nil
+	}
+
+	if next.Version < c.floor {
+		return nil, ErrStale
+	}
+
+	if next.Expired(time.Now()) {
+		return nil, ErrExpired
+	}
+
+	if err := c.save(nextFile, next.Version); err != nil {
+		return nil, err
+	}
+
+	c.set(next, nextFile)
+	return next, nil
+}
+
+// build verifies an update and returns the access list and cache file which
+// result from applying it on top of current; callers must hold c.mu
+func (c *Cache) build(current *Snapshot, update *Update) (*Snapshot, cacheFile, error) {
+	next, file := current, c.file
+
+	if update.Snapshot != nil {
+		snapshot, err := Open(update.Snapshot, c.publicKey)
+		if err != nil {
+			return nil, file, err
+		}
+
+		if snapshot.Realm != c.realm {
+			return nil, file, ErrWrongRealm
+		}
+
+		switch {
+		case current == nil || snapshot.Version > current.Version:
+			next = snapshot
+			file = cacheFile{Snapshot: update.Snapshot}
+		case snapshot.Version == current.Version && bytes.Equal(update.Snapshot, file.Snapshot):
+			// The snapshot already in use, sent again
+		case snapshot.Version == current.Version && snapshot.rebases(current):
+			// The current version as a full snapshot, such as when asking
+			// for one instead of more deltas; it replaces them
+			next = snapshot
+			file = cacheFile{Snapshot: update.Snapshot}
+		default:
+			// Anything else claiming the current version is not what was
+			// signed for it, even if the signature checks out
+			return nil, file, ErrStale
+		}
+	}
+
+	for _, data := range update.Deltas {
+		if next == nil {
+			return nil, file, ErrOutOfOrder
+		}
+
+		delta, err := OpenDelta(data, c.publicKey)
+		if err != nil {
+			return nil, file, err
+		}
+
+		if delta.Realm != c.realm {
+			return nil, file, ErrWrongRealm
+		}
+
+		if next, err = next.apply(delta); err != nil {
+			return nil, file, err
+		}
+
+		// Copy so a failed update leaves the current deltas untouched
+		file.Deltas = append(file.Deltas[:len(file.Deltas):len(file.Deltas)], data)
+	}
+
+	return next, file, nil
+}
+
+// save atomically replaces the cache file, then records the new version as
+// the floor; callers must hold c.mu
+func (c *Cache) save(file cacheFile, version uint64) error {
+	data, err := json.Marshal(&file)
+	if err != nil {
+		return err
+	}
+
+	if err := c.replace(c.path, data); err != nil {
+		return err
+	}
+
+	// Written last, so a crash in between leaves the floor behind the cache
+	// file rather than ahead of it
+	return c.replace(c.floorPath(), []byte(strconv.FormatUint(version, 10)+"\n"))
+}
+
+// replace atomically replaces the file at path with data
+func (c *Cache) replace(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".acl")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// set switches to a verified access list; callers must hold c.mu
+func (c *Cache) set(snapshot *Snapshot, file cacheFile) {
+	allowed := make(map[uuid.UUID]bool, len(snapshot.Allowed))
+	for _, id := range snapshot.Allowed {
+		allowed[id] = true
+	}
+
+	c.snapshot = snapshot
+	c.file = file
+	c.allowed = allowed
+
+	if snapshot.Version > c.floor {
+		c.floor = snapshot.Version
+	}
+}
+
+// Decides whether an association ID may enter, and why. Access is denied
+// when there is no access list or it has expired.
+func (c *Cache) Check(associationID uuid.UUID) (bool, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	switch {
+	case c.snapshot == nil:
+		return false, ReasonNoSnapshot
+	case c.snapshot.Expired(time.Now()):
+		return false, ReasonExpired
+	case c.allowed[associationID]:
+		return true, ReasonAllowed
+	default:
+		return false, ReasonNotAllowed
+	}
+}
+
+// Returns the current access list, or nil if there is none
+func (c *Cache) Snapshot() *Snapshot {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.snapshot
+}
+
+// Returns the version of the current access list, or 0 if there is none
+func (c *Cache) Version() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.snapshot == nil {
+		return 0
+	}
+
+	return c.snapshot.Version
+}
+
+// Returns the number of deltas applied since the last full snapshot
+func (c *Cache) Deltas() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return len(c.file.Deltas)
+}
@@ -0,0 +1,465 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package acl
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"github.com/ComputerScienceHouse/gatekeeper/sig"
+	"github.com/google/uuid"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testRealm = "test"
+
+var (
+	memberA = uuid.MustParse("3c5a3a1e-4c5e-4b46-9a4e-6b1f5d0a0001")
+	memberB = uuid.MustParse("3c5a3a1e-4c5e-4b46-9a4e-6b1f5d0a0002")
+)
+
+func testKey(t *testing.T) *ecdsa.PrivateKey {
+	privateKey, _, err := sig.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return privateKey
+}
+
+func testSnapshot(version uint64, expiresAt time.Time, allowed ...uuid.UUID) *Snapshot {
+	return &Snapshot{
+		Realm:     testRealm,
+		Version:   version,
+		IssuedAt:  time.Now(),
+		ExpiresAt: expiresAt,
+		Allowed:   allowed,
+	}
+}
+
+func signSnapshot(t *testing.T, snapshot *Snapshot, privateKey *ecdsa.PrivateKey) []byte {
+	t.Helper()
+
+	data, err := Sign(snapshot, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func signDelta(t *testing.T, from, to *Snapshot, privateKey *ecdsa.PrivateKey) []byte {
+	t.Helper()
+
+	delta := Diff(from, to)
+	delta.IssuedAt = to.IssuedAt
+	delta.ExpiresAt = to.ExpiresAt
+
+	data, err := SignDelta(delta, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+// tempCache opens an empty cache in a temporary directory, returning the
+// cache file's path and a cleanup func
+func tempCache(t *testing.T, privateKey *ecdsa.PrivateKey) (*Cache, string, func()) {
+	dir, err := ioutil.TempDir("", "gkdoor-acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "acl.json")
+	c, err := OpenCache(path, testRealm, &privateKey.PublicKey)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return c, path, func() {
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func checkAccess(t *testing.T, c *Cache, id uuid.UUID, allowed bool, reason string) {
+	t.Helper()
+
+	if ok, why := c.Check(id); ok != allowed || why != reason {
+		t.Errorf("%s: got (%t, %s), want (%t, %s)", id, ok, why, allowed, reason)
+	}
+}
+
+func TestCacheApply(t *testing.T) {
+	privateKey := testKey(t)
+	c, path, cleanup := tempCache(t, privateKey)
+	defer cleanup()
+
+	checkAccess(t, c, memberA, false, ReasonNoSnapshot)
+
+	expires := time.Now().Add(time.Hour)
+	v1 := testSnapshot(1, expires, memberA)
+	if _, err := c.Apply(signSnapshot(t, v1, privateKey)); err != nil {
+		t.Fatal(err)
+	}
+
+	checkAccess(t, c, memberA, true, ReasonAllowed)
+	checkAccess(t, c, memberB, false, ReasonNotAllowed)
+
+	v2 := testSnapshot(2, expires, memberB)
+	if _, err := c.ApplyUpdate(&Update{Deltas: []json.RawMessage{signDelta(t, v1, v2, privateKey)}}); err != nil {
+		t.Fatal(err)
+	}
+
+	checkAccess(t, c, memberA, false, ReasonNotAllowed)
+	checkAccess(t, c, memberB, true, ReasonAllowed)
+
+	// The snapshot and delta survive a restart
+	reopened, err := OpenCache(path, testRealm, &privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version, deltas := reopened.Version(), reopened.Deltas(); version != 2 || deltas != 1 {
+		t.Errorf("reopened at version %d with %d deltas, want version 2 with 1", version, deltas)
+	}
+
+	checkAccess(t, reopened, memberB, true, ReasonAllowed)
+}
+
+func TestCacheRejectsForged(t *testing.T) {
+	privateKey := testKey(t)
+	c, _, cleanup := tempCache(t, privateKey)
+	defer cleanup()
+
+	expires := time.Now().Add(time.Hour)
+	v1 := testSnapshot(1, expires, memberA)
+	signed := signSnapshot(t, v1, privateKey)
+	if _, err := c.Apply(signed); err != nil {
+		t.Fatal(err)
+	}
+
+	// Signed with someone else's key
+	v2 := testSnapshot(2, expires, memberA, memberB)
+	if _, err := c.Apply(signSnapshot(t, v2, testKey(t))); err != ErrBadSignature {
+		t.Errorf("snapshot signed by another key: got %v, want %v", err, ErrBadSignature)
+	}
+
+	// Edited after signing
+	var payload signedPayload
+	if err := json.Unmarshal(signSnapshot(t, v2, privateKey), &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	payload.Payload, _ = json.Marshal(testSnapshot(2, expires, memberB))
+	edited, _ := json.Marshal(&payload)
+	if _, err := c.Apply(edited); err != ErrBadSignature {
+		t.Errorf("edited snapshot: got %v, want %v", err, ErrBadSignature)
+	}
+
+	// Without a signature
+	payload.R, payload.S = nil, nil
+	unsigned, _ := json.Marshal(&payload)
+	if _, err := c.Apply(unsigned); err != ErrBadSignature {
+		t.Errorf("unsigned snapshot: got %v, want %v", err, ErrBadSignature)
+	}
+
+	// A delta signed with someone else's key, after a valid one; none of
+	// the update may be applied
+	v3 := testSnapshot(3, expires, memberB)
+	update := &Update{Deltas: []json.RawMessage{
+		signDelta(t, v1, v2, privateKey),
+		signDelta(t, v2, v3, testKey(t)),
+	}}
+
+	if _, err := c.ApplyUpdate(update); err != ErrBadSignature {
+		t.Errorf("forged delta: got %v, want %v", err, ErrBadSignature)
+	}
+
+	// Another realm's snapshot, signed with the same key
+	other := testSnapshot(2, expires, memberB)
+	other.Realm = "other"
+	if _, err := c.Apply(signSnapshot(t, other, privateKey)); err != ErrWrongRealm {
+		t.Errorf("snapshot for another realm: got %v, want %v", err, ErrWrongRealm)
+	}
+
+	if version := c.Version(); version != 1 {
+		t.Errorf("forged updates moved the cache to version %d", version)
+	}
+
+	checkAccess(t, c, memberA, true, ReasonAllowed)
+	checkAccess(t, c, memberB, false, ReasonNotAllowed)
+}
+
+func TestCacheRejectsStale(t *testing.T) {
+	privateKey := testKey(t)
+	c, _, cleanup := tempCache(t, privateKey)
+	defer cleanup()
+
+	expires := time.Now().Add(time.Hour)
+	v1 := testSnapshot(1, expires, memberA)
+	v2 := testSnapshot(2, expires, memberB)
+
+	signed := signSnapshot(t, v2, privateKey)
+	if _, err := c.Apply(signed); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Apply(signSnapshot(t, v1, privateKey)); err != ErrStale {
+		t.Errorf("older snapshot: got %v, want %v", err, ErrStale)
+	}
+
+	// The same version again is only accepted if it is exactly what was
+	// signed before, or allows the same members
+	if _, err := c.Apply(signed); err != nil {
+		t.Errorf("same snapshot again: %s", err)
+	}
+
+	if _, err := c.Apply(signSnapshot(t, testSnapshot(2, expires, memberA), privateKey)); err != ErrStale {
+		t.Errorf("different snapshot with the same version: got %v, want %v", err, ErrStale)
+	}
+
+	// Deltas must start from the current version
+	v3 := testSnapshot(3, expires, memberA)
+	if _, err := c.ApplyUpdate(&Update{Deltas: []json.RawMessage{signDelta(t, v1, v3, privateKey)}}); err != ErrOutOfOrder {
+		t.Errorf("delta from an older version: got %v, want %v", err, ErrOutOfOrder)
+	}
+
+	checkAccess(t, c, memberA, false, ReasonNotAllowed)
+	checkAccess(t, c, memberB, true, ReasonAllowed)
+}
+
+func TestCacheRejectsExpired(t *testing.T) {
+	privateKey := testKey(t)
+	c, path, cleanup := tempCache(t, privateKey)
+	defer cleanup()
+
+	expired := testSnapshot(1, time.Now().Add(-time.Minute), memberA)
+	if _, err := c.Apply(signSnapshot(t, expired, privateKey)); err != ErrExpired {
+		t.Errorf("expired snapshot: got %v, want %v", err, ErrExpired)
+	}
+
+	if _, err := c.Apply(signSnapshot(t, testSnapshot(1, time.Time{}, memberA), privateKey)); err != ErrNoExpiry {
+		t.Errorf("snapshot without an expiry: got %v, want %v", err, ErrNoExpiry)
+	}
+
+	v1 := testSnapshot(1, time.Now().Add(time.Hour), memberA)
+	if _, err := c.Apply(signSnapshot(t, v1, privateKey)); err != nil {
+		t.Fatal(err)
+	}
+
+	forever := testSnapshot(2, time.Time{}, memberA)
+	if _, err := c.ApplyUpdate(&Update{Deltas: []json.RawMessage{signDelta(t, v1, forever, privateKey)}}); err != ErrNoExpiry {
+		t.Errorf("delta without an expiry: got %v, want %v", err, ErrNoExpiry)
+	}
+
+	// An access list which expired while saved is loaded, but denies
+	// everyone with the reason
+	data, _ := json.Marshal(&cacheFile{Snapshot: signSnapshot(t, testSnapshot(2, time.Now().Add(-time.Minute), memberA), privateKey)})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkAccess(t, c, memberA, false, ReasonExpired)
+}
+
+func TestCacheVersionFloor(t *testing.T) {
+	privateKey := testKey(t)
+	c, path, cleanup := tempCache(t, privateKey)
+	defer cleanup()
+
+	expires := time.Now().Add(time.Hour)
+	v1 := testSnapshot(1, expires, memberA)
+	v2 := testSnapshot(2, expires, memberB)
+
+	if _, err := c.Apply(signSnapshot(t, v1, privateKey)); err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.ApplyUpdate(&Update{Deltas: []json.RawMessage{signDelta(t, v1, v2, privateKey)}}); err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Put back the older, validly signed access list
+	if err := ioutil.WriteFile(path, old, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Reload(); err != ErrStale {
+		t.Errorf("reloading an older access list: got %v, want %v", err, ErrStale)
+	}
+
+	checkAccess(t, c, memberB, true, ReasonAllowed)
+
+	// Nor is it used after a restart
+	reopened, err := OpenCache(path, testRealm, &privateKey.PublicKey)
+	if err != ErrStale {
+		t.Errorf("reopening an older access list: got %v, want %v", err, ErrStale)
+	}
+
+	checkAccess(t, reopened, memberA, false, ReasonNoSnapshot)
+
+	// But the newest one is
+	if err := ioutil.WriteFile(path, current, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if reopened, err = OpenCache(path, testRealm, &privateKey.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+
+	checkAccess(t, reopened, memberB, true, ReasonAllowed)
+}
+
+func TestOpenChecksKind(t *testing.T) {
+	privateKey := testKey(t)
+	expires := time.Now().Add(time.Hour)
+	v1 := testSnapshot(1, expires, memberA)
+	v2 := testSnapshot(2, expires, memberA, memberB)
+
+	snapshot := signSnapshot(t, v2, privateKey)
+	delta := signDelta(t, v1, v2, privateKey)
+
+	if _, err := Open(snapshot, &privateKey.PublicKey); err != nil {
+		t.Errorf("snapshot: %s", err)
+	}
+
+	if _, err := OpenDelta(delta, &privateKey.PublicKey); err != nil {
+		t.Errorf("delta: %s", err)
+	}
+
+	if _, err := Open(delta, &privateKey.PublicKey); err != ErrWrongKind {
+		t.Errorf("delta opened as a snapshot: got %v, want %v", err, ErrWrongKind)
+	}
+
+	if _, err := OpenDelta(snapshot, &privateKey.PublicKey); err != ErrWrongKind {
+		t.Errorf("snapshot opened as a delta: got %v, want %v", err, ErrWrongKind)
+	}
+
+	// Signed without a kind
+	bare, err := sign(v2, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(bare, &privateKey.PublicKey); err != ErrWrongKind {
+		t.Errorf("snapshot without a kind: got %v, want %v", err, ErrWrongKind)
+	}
+
+	// A delta sent in place of the snapshot of an update
+	c, _, cleanup := tempCache(t, privateKey)
+	defer cleanup()
+
+	if _, err := c.ApplyUpdate(&Update{Snapshot: delta}); err != ErrWrongKind {
+		t.Errorf("delta applied as a snapshot: got %v, want %v", err, ErrWrongKind)
+	}
+}
+
+func TestCacheRebasesDeltas(t *testing.T) {
+	privateKey := testKey(t)
+	c, path, cleanup := tempCache(t, privateKey)
+	defer cleanup()
+
+	expires := time.Now().Add(time.Hour)
+	current := testSnapshot(1, expires, memberA)
+	if _, err := c.Apply(signSnapshot(t, current, privateKey)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 100 deltas, adding and removing member B in turn
+	for version := uint64(2); version <= 101; version++ {
+		next := testSnapshot(version, expires, memberA)
+		if version%2 == 0 {
+			next.Allowed = append(next.Allowed, memberB)
+		}
+
+		if _, err := c.ApplyUpdate(&Update{Deltas: []json.RawMessage{signDelta(t, current, next, privateKey)}}); err != nil {
+			t.Fatal(err)
+		}
+
+		current = next
+	}
+
+	if deltas := c.Deltas(); deltas != 100 {
+		t.Fatalf("%d deltas applied, want 100", deltas)
+	}
+
+	// A full snapshot of the same version replaces the deltas
+	full := signSnapshot(t, testSnapshot(101, expires, memberA), privateKey)
+	if _, err := c.ApplyUpdate(&Update{Snapshot: full}); err != nil {
+		t.Fatalf("full snapshot of the current version: %s", err)
+	}
+
+	if version, deltas := c.Version(), c.Deltas(); version != 101 || deltas != 0 {
+		t.Errorf("cache at version %d with %d deltas, want version 101 with none", version, deltas)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var saved cacheFile
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+
+	if !saved.equal(cacheFile{Snapshot: full}) {
+		t.Error("saved cache file is not the full snapshot alone")
+	}
+
+	// But not one which expires earlier, or allows others
+	earlier := testSnapshot(101, expires.Add(-time.Minute), memberA)
+	if _, err := c.Apply(signSnapshot(t, earlier, privateKey)); err != ErrStale {
+		t.Errorf("same version expiring earlier: got %v, want %v", err, ErrStale)
+	}
+
+	if _, err := c.Apply(signSnapshot(t, testSnapshot(101, expires, memberA, memberB), privateKey)); err != ErrStale {
+		t.Errorf("same version allowing others: got %v, want %v", err, ErrStale)
+	}
+
+	reopened, err := OpenCache(path, testRealm, &privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version := reopened.Version(); version != 101 {
+		t.Errorf("reopened cache at version %d, want 101", version)
+	}
+
+	checkAccess(t, reopened, memberA, true, ReasonAllowed)
+	checkAccess(t, reopened, memberB, false, ReasonNotAllowed)
+}
@@ -0,0 +1,139 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package acl
+
+import (
+	"crypto/ecdsa"
+	"github.com/google/uuid"
+	"sort"
+	"time"
+)
+
+// Represents the changes to a realm's access list between two versions
+type Delta struct {
+	Realm     string      `json:"realm"`
+	From      uint64      `json:"from"`
+	Version   uint64      `json:"version"`
+	IssuedAt  time.Time   `json:"issuedAt"`
+	ExpiresAt time.Time   `json:"expiresAt"`
+	Added     []uuid.UUID `json:"added,omitempty"`
+	Removed   []uuid.UUID `json:"removed,omitempty"`
+}
+
+// The contents of a signed delta
+type deltaPayload struct {
+	Kind string `json:"kind"`
+	*Delta
+}
+
+// Signs a delta with the realm's private key, returning it ready to
+// distribute
+func SignDelta(delta *Delta, privateKey *ecdsa.PrivateKey) ([]byte, error) {
+	return sign(&deltaPayload{Kind: kindDelta, Delta: delta}, privateKey)
+}
+
+// Verifies a distributed delta against the realm's public key and returns
+// its contents. Like snapshots, deltas must expire.
+func OpenDelta(data []byte, publicKey *ecdsa.PublicKey) (*Delta, error) {
+	payload := deltaPayload{Delta: new(Delta)}
+	if err := open(data, publicKey, &payload); err != nil {
+		return nil, err
+	}
+
+	delta := payload.Delta
+	if payload.Kind != kindDelta {
+		return nil, ErrWrongKind
+	}
+
+	if delta.ExpiresAt.IsZero() {
+		return nil, ErrNoExpiry
+	}
+
+	return delta, nil
+}
+
+// Diffs two versions of an access list. The delta is unsigned, and has no
+// issue or expiry time.
+func Diff(from, to *Snapshot) *Delta {
+	delta := &Delta{
+		Realm:   to.Realm,
+		From:    from.Version,
+		Version: to.Version,
+	}
+
+	previous := make(map[uuid.UUID]bool, len(from.Allowed))
+	for _, id := range from.Allowed {
+		previous[id] = true
+	}
+
+	for _, id := range to.Allowed {
+		if previous[id] {
+			delete(previous, id)
+		} else {
+			delta.Added = append(delta.Added, id)
+		}
+	}
+
+	for id := range previous {
+		delta.Removed = append(delta.Removed, id)
+	}
+
+	sortIDs(delta.Removed)
+	return delta
+}
+
+// apply returns the snapshot produced by applying a delta on top of s
+func (s *Snapshot) apply(delta *Delta) (*Snapshot, error) {
+	if delta.From != s.Version || delta.Version <= delta.From {
+		return nil, ErrOutOfOrder
+	}
+
+	allowed := make(map[uuid.UUID]bool, len(s.Allowed)+len(delta.Added))
+	for _, id := range s.Allowed {
+		allowed[id] = true
+	}
+
+	for _, id := range delta.Removed {
+		delete(allowed, id)
+	}
+
+	for _, id := range delta.Added {
+		allowed[id] = true
+	}
+
+	next := &Snapshot{
+		Realm:     s.Realm,
+		Version:   delta.Version,
+		IssuedAt:  delta.IssuedAt,
+		ExpiresAt: delta.ExpiresAt,
+		Allowed:   make([]uuid.UUID, 0, len(allowed)),
+	}
+
+	for id := range allowed {
+		next.Allowed = append(next.Allowed, id)
+	}
+
+	sortIDs(next.Allowed)
+	return next, nil
+}
+
+func sortIDs(ids []uuid.UUID) {
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].String() < ids[j].String()
+	})
+}
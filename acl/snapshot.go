@@ -0,0 +1,156 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package acl
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"github.com/ComputerScienceHouse/gatekeeper/sig"
+	"github.com/google/uuid"
+	"math/big"
+	"time"
+)
+
+var (
+	ErrBadSignature = errors.New("snapshot signature is invalid")
+	ErrWrongRealm   = errors.New("snapshot is for a different realm")
+	ErrStale        = errors.New("snapshot is older than the current one")
+	ErrExpired      = errors.New("snapshot has expired")
+	ErrNoExpiry     = errors.New("snapshot has no expiry")
+	ErrOutOfOrder   = errors.New("delta does not follow the current version")
+	ErrWrongKind    = errors.New("signed payload is not of the expected kind")
+)
+
+// Kinds of signed payload. The kind is signed with the contents, so a delta
+// can never be accepted as a snapshot, nor a snapshot as a delta.
+const (
+	kindSnapshot = "snapshot"
+	kindDelta    = "delta"
+)
+
+// Represents the association IDs allowed into a realm at a point in time
+type Snapshot struct {
+	Realm     string      `json:"realm"`
+	Version   uint64      `json:"version"`
+	IssuedAt  time.Time   `json:"issuedAt"`
+	ExpiresAt time.Time   `json:"expiresAt"`
+	Allowed   []uuid.UUID `json:"allowed"`
+}
+
+// The contents of a signed snapshot
+type snapshotPayload struct {
+	Kind string `json:"kind"`
+	*Snapshot
+}
+
+// Represents a snapshot or delta as distributed to doors. The signature
+// covers the exact payload bytes, so it never depends on how the contents
+// are encoded.
+type signedPayload struct {
+	Payload []byte   `json:"payload"`
+	R       *big.Int `json:"r"`
+	S       *big.Int `json:"s"`
+}
+
+func sign(v interface{}, privateKey *ecdsa.PrivateKey) ([]byte, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	r, s, err := sig.Sign(privateKey, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&signedPayload{
+		Payload: payload,
+		R:       r,
+		S:       s,
+	})
+}
+
+func open(data []byte, publicKey *ecdsa.PublicKey, v interface{}) error {
+	var signed signedPayload
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return err
+	}
+
+	if signed.R == nil || signed.S == nil || !sig.Verify(publicKey, signed.Payload, signed.R, signed.S) {
+		return ErrBadSignature
+	}
+
+	return json.Unmarshal(signed.Payload, v)
+}
+
+// Signs a snapshot with the realm's private key, returning it ready to
+// distribute
+func Sign(snapshot *Snapshot, privateKey *ecdsa.PrivateKey) ([]byte, error) {
+	return sign(&snapshotPayload{Kind: kindSnapshot, Snapshot: snapshot}, privateKey)
+}
+
+// Verifies a distributed snapshot against the realm's public key and
+// returns its contents. Snapshots must expire, so a door cut off from the
+// server cannot keep trusting one forever.
+func Open(data []byte, publicKey *ecdsa.PublicKey) (*Snapshot, error) {
+	payload := snapshotPayload{Snapshot: new(Snapshot)}
+	if err := open(data, publicKey, &payload); err != nil {
+		return nil, err
+	}
+
+	snapshot := payload.Snapshot
+	if payload.Kind != kindSnapshot {
+		return nil, ErrWrongKind
+	}
+
+	if snapshot.ExpiresAt.IsZero() {
+		return nil, ErrNoExpiry
+	}
+
+	return snapshot, nil
+}
+
+// Reports whether the snapshot has expired at the given time
+func (s *Snapshot) Expired(now time.Time) bool {
+	return now.After(s.ExpiresAt)
+}
+
+// rebases reports whether s can replace current, a snapshot of the same
+// version which may have been built from deltas: it must allow exactly the
+// same association IDs, and expire no earlier
+func (s *Snapshot) rebases(current *Snapshot) bool {
+	if s.ExpiresAt.Before(current.ExpiresAt) {
+		return false
+	}
+
+	allowed := make(map[uuid.UUID]bool, len(current.Allowed))
+	for _, id := range current.Allowed {
+		allowed[id] = true
+	}
+
+	for _, id := range s.Allowed {
+		if !allowed[id] {
+			return false
+		}
+
+		delete(allowed, id)
+	}
+
+	return len(allowed) == 0
+}
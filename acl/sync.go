@@ -0,0 +1,112 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package acl
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+/*
+  Doors keep their access lists current by polling the server:
+
+    GET /acl/<realm>?door=<name>&since=<version>&healthy=<bool>&...
+    If-None-Match: <ETag of the last response>
+
+  The query reports the door's current version and health, so every poll
+  doubles as a heartbeat. The server answers 304 Not Modified when the door
+  is up to date, or 200 with an Update: either the deltas leading from the
+  door's version to the current one, or a full snapshot when those are not
+  available (e.g. since=0). Both carry the server's ETag.
+*/
+
+// Represents the server's answer to a sync request
+type Update struct {
+	// A full snapshot, replacing the door's access list
+	Snapshot json.RawMessage `json:"snapshot,omitempty"`
+	// Deltas applied in order, after the snapshot if there is one
+	Deltas []json.RawMessage `json:"deltas,omitempty"`
+}
+
+// Represents a door's state, reported with each sync request
+type Report struct {
+	Door    string `json:"door"`
+	Version uint64 `json:"version"`
+	Healthy bool   `json:"healthy"`
+	Reader  string `json:"reader,omitempty"`
+	Lock    string `json:"lock,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Encodes the report as sync request query parameters
+func (r *Report) Query() url.Values {
+	query := url.Values{}
+	query.Set("door", r.Door)
+	query.Set("since", strconv.FormatUint(r.Version, 10))
+	query.Set("healthy", strconv.FormatBool(r.Healthy))
+
+	if r.Reader != "" {
+		query.Set("reader", r.Reader)
+	}
+
+	if r.Lock != "" {
+		query.Set("lock", r.Lock)
+	}
+
+	if r.Error != "" {
+		query.Set("error", r.Error)
+	}
+
+	return query
+}
+
+// Decodes a report from sync request query parameters
+func ParseReport(query url.Values) (*Report, error) {
+	report := &Report{
+		Door:   query.Get("door"),
+		Reader: query.Get("reader"),
+		Lock:   query.Get("lock"),
+		Error:  query.Get("error"),
+	}
+
+	if report.Door == "" {
+		return nil, fmt.Errorf("door is required")
+	}
+
+	var err error
+	if since := query.Get("since"); since != "" {
+		if report.Version, err = strconv.ParseUint(since, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid since version '%s'", since)
+		}
+	}
+
+	if healthy := query.Get("healthy"); healthy != "" {
+		if report.Healthy, err = strconv.ParseBool(healthy); err != nil {
+			return nil, fmt.Errorf("invalid healthy flag '%s'", healthy)
+		}
+	}
+
+	return report, nil
+}
+
+// Returns the ETag a server gives the given version of a realm's access list
+func ETag(version uint64) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
@@ -0,0 +1,282 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Represents an append-only audit log file, holding one JSON record per line
+type Log struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+	last *Record
+	// The first break in the chain found when the log was opened
+	broken error
+}
+
+// Selects records from the log
+type Filter struct {
+	// Only records after this sequence number
+	AfterSeq uint64
+	// Only records at or after this time
+	Since    time.Time
+	Decision string
+	UID      string
+	// At most this many records, or all if 0
+	Limit int
+}
+
+func (f *Filter) matches(record *Record) bool {
+	return record.Seq > f.AfterSeq &&
+		!record.Time.Before(f.Since) &&
+		(f.Decision == "" || record.Decision == f.Decision) &&
+		(f.UID == "" || record.UID == f.UID)
+}
+
+// Opens the audit log at path for appending, creating it if needed. A
+// record left half-written by a crash is discarded. The chain is verified as
+// the log is read, and the first break is reported by Broken. Records which
+// cannot be read are skipped, so a damaged log still accepts new records,
+// chained to the last readable one.
+func Open(path string) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		path: path,
+		file: file,
+	}
+
+	end, err := scan(file, func(err error) {
+		if l.broken == nil {
+			l.broken = err
+		}
+	}, func(record *Record) bool {
+		if l.broken == nil {
+			l.broken = verifyNext(l.last, record)
+		}
+
+		l.last = record
+		return true
+	})
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	if err := file.Truncate(end); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	if _, err := file.Seek(end, io.SeekStart); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// scan calls fn for each complete record in r until it returns false, and
+// returns the offset just past the last complete record. Unreadable records
+// are passed to unreadable and skipped, or end the scan if it is nil.
+func scan(r io.Reader, unreadable func(err error), fn func(record *Record) bool) (int64, error) {
+	reader := bufio.NewReader(r)
+	var (
+		offset  int64
+		lastSeq uint64
+	)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// Anything left is a record still being written
+			return offset, nil
+		} else if err != nil {
+			return offset, err
+		}
+
+		offset += int64(len(line))
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		record := new(Record)
+		if err := json.Unmarshal(line, record); err != nil {
+			chainErr := &ChainError{Seq: lastSeq + 1, Reason: "unreadable record: " + err.Error()}
+			if unreadable == nil {
+				return offset, chainErr
+			}
+
+			unreadable(chainErr)
+			continue
+		}
+
+		lastSeq = record.Seq
+
+		if !fn(record) {
+			return offset, nil
+		}
+	}
+}
+
+// Appends a record for an access decision, filling in its time if unset and
+// its place in the chain. The record is on disk when Append returns.
+func (l *Log) Append(record Record) (*Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	record.Time = record.Time.UTC()
+
+	if err := record.link(l.last); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(&record)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return nil, err
+	}
+
+	if err := l.file.Sync(); err != nil {
+		return nil, err
+	}
+
+	l.last = &record
+	return &record, nil
+}
+
+// Returns the records matching filter, oldest first
+func (l *Log) Query(filter Filter) ([]Record, error) {
+	return Query(l.path, filter)
+}
+
+// Returns the records in the audit log at path matching filter, oldest
+// first. The log may be appended to by another process while it is read.
+// Unreadable records are skipped; use Verify to check the chain.
+func Query(path string, filter Filter) ([]Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []Record
+	_, err = scan(file, func(error) {}, func(record *Record) bool {
+		if filter.matches(record) {
+			records = append(records, *record)
+		}
+
+		return filter.Limit == 0 || len(records) < filter.Limit
+	})
+
+	return records, err
+}
+
+// Verifies the whole log, returning the number of records checked. As with
+// Verify, a rewritten chain is only detectable by the server.
+func (l *Log) Verify() (uint64, error) {
+	return Verify(l.path)
+}
+
+// Verifies the whole audit log at path, returning the number of records
+// checked. A *ChainError means the file has been corrupted or edited.
+//
+// The chain is hashed without a key, so this only catches records edited or
+// removed in place. Anyone able to write the file can also rewrite the chain
+// from their edit onwards, which verifies here; tampering with records is
+// only detectable against the copies the server already holds, as
+// uploading from a rewritten chain no longer matches them.
+func Verify(path string) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var (
+		prev     *Record
+		count    uint64
+		chainErr error
+	)
+
+	_, err = scan(file, nil, func(record *Record) bool {
+		if chainErr = verifyNext(prev, record); chainErr != nil {
+			return false
+		}
+
+		prev = record
+		count++
+		return true
+	})
+
+	if err != nil {
+		return count, err
+	}
+
+	return count, chainErr
+}
+
+// verifyNext checks that record follows prev in the log, where prev is nil
+// for the first record
+func verifyNext(prev, record *Record) error {
+	if prev == nil && (record.Seq != 1 || record.Prev != "") {
+		return &ChainError{Seq: record.Seq, Reason: "log does not start at the first record"}
+	}
+
+	return VerifyChain(prev, []Record{*record})
+}
+
+// Returns the first break in the chain found when the log was opened, or
+// nil if it was intact. Records appended since carry on from the last
+// readable record, but the log as a whole no longer verifies.
+func (l *Log) Broken() error {
+	return l.broken
+}
+
+// Returns the newest record, or nil if the log is empty
+func (l *Log) Last() *Record {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.last
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.file.Close()
+}
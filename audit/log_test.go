@@ -0,0 +1,302 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package audit
+
+import (
+	"bytes"
+	"github.com/google/uuid"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tempLog opens an empty audit log in a temporary directory, returning its
+// path and a cleanup func
+func tempLog(t *testing.T) (*Log, string, func()) {
+	dir, err := ioutil.TempDir("", "gkdoor-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "audit.log")
+	l, err := Open(path)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return l, path, func() {
+		_ = l.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// appendRecords appends count decisions, alternating grants and denials
+func appendRecords(t *testing.T, l *Log, count int) []Record {
+	t.Helper()
+
+	var records []Record
+	for i := 0; i < count; i++ {
+		id := uuid.New()
+		record := Record{
+			Door:          "front",
+			Realm:         "test",
+			UID:           "04112233445566",
+			AssociationID: &id,
+			Decision:      Grant,
+			Reason:        "allowed",
+		}
+
+		if i%2 == 1 {
+			record.Decision, record.Reason = Deny, "not allowed"
+		}
+
+		appended, err := l.Append(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		records = append(records, *appended)
+	}
+
+	return records
+}
+
+// editLines rewrites the log file at path, one line at a time
+func editLines(t *testing.T, path string, edit func(i int, line []byte) []byte) {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	for i := range lines {
+		lines[i] = edit(i, lines[i])
+	}
+
+	if err := ioutil.WriteFile(path, bytes.Join(lines, nil), 0640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkChainError(t *testing.T, err error, seq uint64) {
+	t.Helper()
+
+	chainErr, ok := err.(*ChainError)
+	if !ok {
+		t.Errorf("got %v, want a chain error at record %d", err, seq)
+	} else if chainErr.Seq != seq {
+		t.Errorf("chain broken at record %d, want %d: %s", chainErr.Seq, seq, chainErr)
+	}
+}
+
+func TestLogChain(t *testing.T) {
+	l, path, cleanup := tempLog(t)
+	defer cleanup()
+
+	records := appendRecords(t, l, 5)
+	for i, record := range records {
+		if record.Seq != uint64(i+1) {
+			t.Errorf("record %d has sequence number %d", i+1, record.Seq)
+		}
+	}
+
+	if err := VerifyChain(nil, records); err != nil {
+		t.Error(err)
+	}
+
+	// Reopening carries on the chain
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	if err := reopened.Broken(); err != nil {
+		t.Errorf("intact log reported broken: %s", err)
+	}
+
+	next := appendRecords(t, reopened, 1)[0]
+	if next.Seq != 6 || next.Prev != records[4].Hash {
+		t.Errorf("record appended after reopening has sequence number %d and previous hash %s", next.Seq, next.Prev)
+	}
+
+	if count, err := Verify(path); err != nil || count != 6 {
+		t.Errorf("verified %d records (%v), want 6", count, err)
+	}
+
+	deny, err := Query(path, Filter{AfterSeq: 2, Decision: Deny})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deny) != 1 || deny[0].Seq != 4 {
+		t.Errorf("queried %v, want only record 4", deny)
+	}
+}
+
+func TestVerifyChainDetectsChanges(t *testing.T) {
+	l, _, cleanup := tempLog(t)
+	defer cleanup()
+
+	records := appendRecords(t, l, 4)
+
+	edited := append([]Record(nil), records...)
+	edited[2].UID = "04aabbccddeeff"
+	checkChainError(t, VerifyChain(nil, edited), 3)
+
+	removed := append(append([]Record(nil), records[:1]...), records[2:]...)
+	checkChainError(t, VerifyChain(nil, removed), 3)
+
+	reordered := []Record{records[0], records[2], records[1], records[3]}
+	checkChainError(t, VerifyChain(nil, reordered), 3)
+
+	// A record edited and rehashed no longer follows the next one
+	rehashed := append([]Record(nil), records...)
+	rehashed[1].UID = "04aabbccddeeff"
+	if err := rehashed[1].link(&rehashed[0]); err != nil {
+		t.Fatal(err)
+	}
+	checkChainError(t, VerifyChain(nil, rehashed), 3)
+
+	// Records must follow the last one already held
+	checkChainError(t, VerifyChain(&records[0], records[2:]), 3)
+	if err := VerifyChain(&records[1], records[2:]); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLogDetectsTampering(t *testing.T) {
+	l, path, cleanup := tempLog(t)
+	defer cleanup()
+
+	appendRecords(t, l, 4)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	editLines(t, path, func(i int, line []byte) []byte {
+		if i == 1 {
+			return bytes.Replace(line, []byte(`"deny"`), []byte(`"grant"`), 1)
+		}
+
+		return line
+	})
+
+	_, err := Verify(path)
+	checkChainError(t, err, 2)
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	checkChainError(t, reopened.Broken(), 2)
+}
+
+func TestLogSkipsUnreadable(t *testing.T) {
+	l, path, cleanup := tempLog(t)
+	defer cleanup()
+
+	records := appendRecords(t, l, 4)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	editLines(t, path, func(i int, line []byte) []byte {
+		if i == 2 {
+			return append([]byte("garbage"), line...)
+		}
+
+		return line
+	})
+
+	_, err := Verify(path)
+	checkChainError(t, err, 3)
+
+	queried, err := Query(path, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(queried) != 3 || queried[2].Seq != 4 {
+		t.Errorf("queried %d records, want records 1, 2 and 4", len(queried))
+	}
+
+	// The damaged log is reported, but still takes new records
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	checkChainError(t, reopened.Broken(), 3)
+
+	next := appendRecords(t, reopened, 1)[0]
+	if next.Seq != 5 || next.Prev != records[3].Hash {
+		t.Errorf("record appended to a damaged log has sequence number %d and previous hash %s", next.Seq, next.Prev)
+	}
+}
+
+func TestLogDiscardsPartialRecord(t *testing.T) {
+	l, path, cleanup := tempLog(t)
+	defer cleanup()
+
+	records := appendRecords(t, l, 3)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Left behind by a crash part way through writing record 4
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := file.WriteString(`{"seq":4,"time":`); err != nil {
+		t.Fatal(err)
+	}
+	_ = file.Close()
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	if err := reopened.Broken(); err != nil {
+		t.Errorf("log with a partial record reported broken: %s", err)
+	}
+
+	next := appendRecords(t, reopened, 1)[0]
+	if next.Seq != 4 || next.Prev != records[2].Hash {
+		t.Errorf("record appended after a partial one has sequence number %d", next.Seq)
+	}
+
+	if count, err := Verify(path); err != nil || count != 4 {
+		t.Errorf("verified %d records (%v), want 4", count, err)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"time"
+)
+
+// Access decisions
+const (
+	Grant = "grant"
+	Deny  = "deny"
+)
+
+// Represents one access decision. Each record carries the hash of the one
+// before it, so removing, reordering or editing records breaks the chain.
+type Record struct {
+	Seq           uint64     `json:"seq"`
+	Time          time.Time  `json:"time"`
+	Door          string     `json:"door"`
+	Realm         string     `json:"realm"`
+	UID           string     `json:"uid"`
+	AssociationID *uuid.UUID `json:"associationId,omitempty"`
+	Decision      string     `json:"decision"`
+	Reason        string     `json:"reason"`
+	// Error behind the reason, if any
+	Detail string `json:"detail,omitempty"`
+	// Hash of the previous record, empty for the first
+	Prev string `json:"prev,omitempty"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// Represents a break in the hash chain
+type ChainError struct {
+	Seq    uint64
+	Reason string
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("audit log chain broken at record %d: %s", e.Seq, e.Reason)
+}
+
+// computeHash hashes every field of the record but its own hash
+func (r Record) computeHash() (string, error) {
+	r.Hash = ""
+	data, err := json.Marshal(&r)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// link fills in the record's position in the chain after prev, which is
+// nil for the first record
+func (r *Record) link(prev *Record) error {
+	r.Seq, r.Prev = 1, ""
+	if prev != nil {
+		r.Seq, r.Prev = prev.Seq+1, prev.Hash
+	}
+
+	hash, err := r.computeHash()
+	if err != nil {
+		return err
+	}
+
+	r.Hash = hash
+	return nil
+}
+
+// Verifies that records form an unbroken chain following prev. If prev is
+// nil, the first record is trusted as the start of the chain.
+func VerifyChain(prev *Record, records []Record) error {
+	for i := range records {
+		record := &records[i]
+
+		hash, err := record.computeHash()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case hash != record.Hash:
+			return &ChainError{Seq: record.Seq, Reason: "record does not match its hash"}
+		case prev != nil && record.Seq != prev.Seq+1:
+			return &ChainError{Seq: record.Seq, Reason: fmt.Sprintf("expected record %d", prev.Seq+1)}
+		case prev != nil && record.Prev != prev.Hash:
+			return &ChainError{Seq: record.Seq, Reason: "record does not follow the previous one"}
+		}
+
+		prev = record
+	}
+
+	return nil
+}
@@ -0,0 +1,41 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package audit
+
+/*
+  Doors upload their audit logs to the server whenever they can reach it:
+
+    POST /audit/<realm>?door=<name>
+    {"records": [...]}
+
+  Records are sent in order, starting after the last one the server
+  acknowledged. The server answers with the sequence number of the last
+  record it holds for the door: 200 once the records are stored, or 409
+  Conflict when they do not continue the chain it holds, in which case the
+  door resends from the acknowledged record onwards.
+*/
+
+// Represents a batch of records uploaded by a door
+type Upload struct {
+	Records []Record `json:"records"`
+}
+
+// Represents the server's answer to an upload
+type Ack struct {
+	Acknowledged uint64 `json:"acknowledged"`
+}
@@ -0,0 +1,95 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+type apiKeyFile struct {
+	Keys []struct {
+		Name   string   `json:"name"`
+		Key    string   `json:"key"`
+		Scopes []string `json:"scopes"`
+	} `json:"keys"`
+}
+
+type apiKey struct {
+	name   string
+	digest [sha256.Size]byte
+	scopes []string
+}
+
+// Represents the static API keys accepted by the server
+type apiKeySet struct {
+	keys []apiKey
+}
+
+func loadAPIKeys(path string) (*apiKeySet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file apiKeyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("unable to parse API keys: %s", err)
+	}
+
+	set := new(apiKeySet)
+	for _, key := range file.Keys {
+		if key.Name == "" || len(key.Key) < 16 {
+			return nil, fmt.Errorf("API key '%s' must have a name and be at least 16 characters", key.Name)
+		}
+
+		set.keys = append(set.keys, apiKey{
+			name:   key.Name,
+			digest: sha256.Sum256([]byte(key.Key)),
+			scopes: key.Scopes,
+		})
+	}
+
+	return set, nil
+}
+
+func (s *apiKeySet) authenticate(presented string) (*Principal, error) {
+	digest := sha256.Sum256([]byte(presented))
+
+	// Compare against every key so timing does not reveal which one matched
+	var match *apiKey
+	for i := range s.keys {
+		if subtle.ConstantTimeCompare(digest[:], s.keys[i].digest[:]) == 1 {
+			match = &s.keys[i]
+		}
+	}
+
+	if match == nil {
+		return nil, errors.New("unknown API key")
+	}
+
+	return &Principal{
+		Name:   match.name,
+		Method: MethodAPIKey,
+		Scopes: match.scopes,
+	}, nil
+}
@@ -0,0 +1,92 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeAPIKeys writes an API key file to a temporary directory
+func writeAPIKeys(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "gkadm-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "keys.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		_ = os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return path, func() { _ = os.RemoveAll(dir) }
+}
+
+const testAPIKeys = `{"keys": [
+	{"name": "dashboard", "key": "0123456789abcdef-dashboard", "scopes": ["issue"]},
+	{"name": "monitor", "key": "0123456789abcdef-monitor", "scopes": ["read"]}
+]}`
+
+func TestAPIKeys(t *testing.T) {
+	path, cleanup := writeAPIKeys(t, testAPIKeys)
+	defer cleanup()
+
+	keys, err := loadAPIKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	principal, err := keys.authenticate("0123456789abcdef-monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if principal.Name != "monitor" || principal.Method != MethodAPIKey || !principal.HasScope(ScopeRead) || principal.HasScope(ScopeIssue) {
+		t.Errorf("monitor key authenticated as %+v", principal)
+	}
+
+	for _, presented := range []string{
+		"",
+		"0123456789abcdef",
+		"0123456789abcdef-monitor ",
+		"0123456789abcdef-MONITOR",
+		"0123456789abcdef-monitor0123456789abcdef-dashboard",
+	} {
+		if principal, err := keys.authenticate(presented); err == nil {
+			t.Errorf("key %q authenticated as %+v", presented, principal)
+		}
+	}
+}
+
+func TestAPIKeysValidation(t *testing.T) {
+	for name, contents := range map[string]string{
+		"short key":  `{"keys": [{"name": "short", "key": "0123456789", "scopes": ["read"]}]}`,
+		"no name":    `{"keys": [{"key": "0123456789abcdef", "scopes": ["read"]}]}`,
+		"not JSON":   `keys: []`,
+		"wrong type": `{"keys": {"name": "x"}}`,
+	} {
+		path, cleanup := writeAPIKeys(t, contents)
+		if _, err := loadAPIKeys(path); err == nil {
+			t.Errorf("%s: API key file accepted", name)
+		}
+		cleanup()
+	}
+}
@@ -0,0 +1,202 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"errors"
+	"github.com/labstack/echo"
+	"net/http"
+	"strings"
+)
+
+// Scopes granted to principals; each API route requires one of them
+const (
+	// Issue, revoke and format tags
+	ScopeIssue = "issue"
+	// Verify and inspect tags
+	ScopeVerify = "verify"
+	// Read tasks and their logs
+	ScopeRead = "read"
+)
+
+// Authentication methods a principal may have used
+const (
+	MethodAPIKey = "api_key"
+	MethodOIDC   = "oidc"
+	MethodNone   = "none"
+)
+
+const principalKey = "auth.principal"
+
+// Query parameter carrying a bearer token, for clients which cannot set headers
+const TokenQueryParam = "access_token"
+
+// Replaces tokens in logged request URIs
+const redacted = "REDACTED"
+
+var errNoCredentials = errors.New("no credentials presented")
+
+// Represents an authenticated API client
+type Principal struct {
+	Name   string   `json:"name"`
+	Method string   `json:"method"`
+	Scopes []string `json:"-"`
+}
+
+// Reports whether the principal was granted any of the given scopes
+func (p *Principal) HasScope(scopes ...string) bool {
+	for _, granted := range p.Scopes {
+		for _, scope := range scopes {
+			if granted == scope {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Returns the URI of the request with any token in its query redacted, so
+// that it may be logged
+func RedactedURI(r *http.Request) string {
+	u := *r.URL
+	query := u.Query()
+	if _, ok := query[TokenQueryParam]; ok {
+		query.Set(TokenQueryParam, redacted)
+		u.RawQuery = query.Encode()
+	}
+
+	return u.RequestURI()
+}
+
+// Returns the principal that authenticated the request, if any
+func PrincipalFrom(c echo.Context) *Principal {
+	principal, _ := c.Get(principalKey).(*Principal)
+	return principal
+}
+
+type Config struct {
+	// JSON file listing static API keys
+	APIKeysFile string
+
+	// OIDC issuer whose tokens are accepted, and the audience they must carry
+	OIDCIssuer   string
+	OIDCAudience string
+	// Overrides the JWKS URL found through OIDC discovery
+	OIDCJWKSURL string
+
+	// Accept every request without credentials
+	Disabled bool
+}
+
+// Validates the credentials presented with API requests
+type Authenticator struct {
+	apiKeys  *apiKeySet
+	oidc     *oidcVerifier
+	disabled bool
+}
+
+func New(config Config) (*Authenticator, error) {
+	a := &Authenticator{disabled: config.Disabled}
+	if a.disabled {
+		return a, nil
+	}
+
+	if config.APIKeysFile != "" {
+		keys, err := loadAPIKeys(config.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+
+		a.apiKeys = keys
+	}
+
+	if config.OIDCIssuer != "" {
+		a.oidc = newOIDCVerifier(config.OIDCIssuer, config.OIDCAudience, config.OIDCJWKSURL)
+	}
+
+	if a.apiKeys == nil && a.oidc == nil {
+		return nil, errors.New("no API keys or OIDC issuer configured; refusing to serve without authentication")
+	}
+
+	return a, nil
+}
+
+// authenticate identifies the principal behind a request
+func (a *Authenticator) authenticate(r *http.Request) (*Principal, error) {
+	if a.disabled {
+		return &Principal{
+			Name:   "anonymous",
+			Method: MethodNone,
+			Scopes: []string{ScopeIssue, ScopeVerify, ScopeRead},
+		}, nil
+	}
+
+	if key := r.Header.Get("X-API-Key"); key != "" && a.apiKeys != nil {
+		return a.apiKeys.authenticate(key)
+	}
+
+	token := ""
+	if authorization := r.Header.Get(echo.HeaderAuthorization); strings.HasPrefix(authorization, "Bearer ") {
+		token = strings.TrimPrefix(authorization, "Bearer ")
+	} else if r.Method == http.MethodGet {
+		// Browsers cannot set headers on EventSource or WebSocket connections
+		token = r.URL.Query().Get(TokenQueryParam)
+	}
+
+	if token == "" {
+		return nil, errNoCredentials
+	}
+
+	if a.oidc != nil {
+		return a.oidc.authenticate(token)
+	}
+
+	if a.apiKeys != nil {
+		// API keys may also be presented as bearer tokens
+		return a.apiKeys.authenticate(token)
+	}
+
+	return nil, errNoCredentials
+}
+
+// Returns middleware which authenticates each request and requires the
+// principal to hold at least one of the given scopes
+func (a *Authenticator) Require(scopes ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			principal, err := a.authenticate(c.Request())
+			if err != nil {
+				if err != errNoCredentials {
+					c.Logger().Warnf("Rejected credentials from %s: %s", c.RealIP(), err)
+				}
+
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer realm="gkadm"`)
+				return echo.ErrUnauthorized
+			}
+
+			if !principal.HasScope(scopes...) {
+				c.Logger().Warnf("Denied '%s' access to %s %s", principal.Name, c.Request().Method, c.Path())
+				return echo.ErrForbidden
+			}
+
+			c.Set(principalKey, principal)
+			return next(c)
+		}
+	}
+}
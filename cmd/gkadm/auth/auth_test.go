@@ -0,0 +1,143 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// testServer serves a route per scope, each requiring that scope
+func testServer(authenticator *Authenticator) *echo.Echo {
+	e := echo.New()
+	ok := func(c echo.Context) error {
+		return c.String(http.StatusOK, PrincipalFrom(c).Name)
+	}
+
+	e.GET("/read", ok, authenticator.Require(ScopeRead, ScopeVerify, ScopeIssue))
+	e.GET("/verify", ok, authenticator.Require(ScopeVerify, ScopeIssue))
+	e.POST("/issue", ok, authenticator.Require(ScopeIssue))
+	return e
+}
+
+func TestRequireScopes(t *testing.T) {
+	path, cleanup := writeAPIKeys(t, testAPIKeys)
+	defer cleanup()
+
+	issuer := newTestIssuer(t)
+	defer issuer.Close()
+
+	authenticator, err := New(Config{
+		APIKeysFile:  path,
+		OIDCIssuer:   issuer.server.URL,
+		OIDCAudience: testAudience,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readToken := sign(t, jwt.SigningMethodRS256, issuer.rsaKey, "rsa", issuer.claims())
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		header http.Header
+		status int
+	}{
+		{"no credentials", http.MethodGet, "/read", nil, http.StatusUnauthorized},
+		{"read key reads", http.MethodGet, "/read", http.Header{"X-Api-Key": {"0123456789abcdef-monitor"}}, http.StatusOK},
+		{"read key verifies", http.MethodGet, "/verify", http.Header{"X-Api-Key": {"0123456789abcdef-monitor"}}, http.StatusForbidden},
+		{"issue key reads", http.MethodGet, "/read", http.Header{"X-Api-Key": {"0123456789abcdef-dashboard"}}, http.StatusOK},
+		{"issue key issues", http.MethodPost, "/issue", http.Header{"X-Api-Key": {"0123456789abcdef-dashboard"}}, http.StatusOK},
+		{"unknown key", http.MethodGet, "/read", http.Header{"X-Api-Key": {"0123456789abcdef-unknown"}}, http.StatusUnauthorized},
+		{"token verifies", http.MethodGet, "/verify", http.Header{"Authorization": {"Bearer " + readToken}}, http.StatusOK},
+		{"token issues", http.MethodPost, "/issue", http.Header{"Authorization": {"Bearer " + readToken}}, http.StatusForbidden},
+		{"token in query", http.MethodGet, "/read?" + TokenQueryParam + "=" + readToken, nil, http.StatusOK},
+		{"token in query of POST", http.MethodPost, "/issue?" + TokenQueryParam + "=" + readToken, nil, http.StatusUnauthorized},
+		{"malformed token", http.MethodGet, "/read", http.Header{"Authorization": {"Bearer abc"}}, http.StatusUnauthorized},
+	}
+
+	e := testServer(authenticator)
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.target, nil)
+		for name, values := range test.header {
+			req.Header[name] = values
+		}
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		if rec.Code != test.status {
+			t.Errorf("%s: got %d, want %d", test.name, rec.Code, test.status)
+		}
+
+		if rec.Code == http.StatusUnauthorized && rec.Header().Get(echo.HeaderWWWAuthenticate) == "" {
+			t.Errorf("%s: unauthorized response has no WWW-Authenticate challenge", test.name)
+		}
+	}
+}
+
+func TestNewRequiresCredentials(t *testing.T) {
+	if _, err := New(Config{}); err == nil {
+		t.Error("authenticator created without API keys or an OIDC issuer")
+	}
+
+	authenticator, err := New(Config{Disabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	testServer(authenticator).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/issue", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "anonymous" {
+		t.Errorf("disabled authentication returned %d %q, want anonymous access", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRedactedURI(t *testing.T) {
+	tests := map[string]string{
+		"/tasks":                                    "/tasks",
+		"/tasks?state=failed":                       "/tasks?state=failed",
+		"/tasks/1/log?access_token=secret":          "/tasks/1/log?access_token=REDACTED",
+		"/tasks/1/log?offset=2&access_token=secret": "/tasks/1/log?access_token=REDACTED&offset=2",
+		"/tasks/1/log?access_token=a&access_token=": "/tasks/1/log?access_token=REDACTED",
+		"/a%22b?access_token=secret":                "/a%22b?access_token=REDACTED",
+	}
+
+	for target, want := range tests {
+		u, err := url.ParseRequestURI(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := RedactedURI(&http.Request{URL: u})
+		if got != want {
+			t.Errorf("redacted %s as %s, want %s", target, got, want)
+		}
+
+		if strings.Contains(got, "secret") {
+			t.Errorf("redacted %s still contains the token", target)
+		}
+	}
+}
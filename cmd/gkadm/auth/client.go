@@ -0,0 +1,63 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/labstack/echo"
+)
+
+const clientKey = "auth.client"
+
+// Represents the identity of a client that presented a verified TLS certificate
+type ClientIdentity struct {
+	Subject     string `json:"subject"`
+	Issuer      string `json:"issuer"`
+	Serial      string `json:"serial"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// Returns middleware which exposes the verified client certificate of each
+// request, if any, to handlers through ClientFrom
+func ClientCertificates() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			state := c.Request().TLS
+			if state != nil && len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+				cert := state.VerifiedChains[0][0]
+				fingerprint := sha256.Sum256(cert.Raw)
+
+				c.Set(clientKey, &ClientIdentity{
+					Subject:     cert.Subject.String(),
+					Issuer:      cert.Issuer.String(),
+					Serial:      cert.SerialNumber.String(),
+					Fingerprint: hex.EncodeToString(fingerprint[:]),
+				})
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// Returns the verified client certificate identity of the request, if any
+func ClientFrom(c echo.Context) *ClientIdentity {
+	client, _ := c.Get(clientKey).(*ClientIdentity)
+	return client
+}
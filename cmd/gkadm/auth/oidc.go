@@ -0,0 +1,308 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dgrijalva/jwt-go"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimum time between JWKS fetches, so unknown key IDs cannot be used to
+// hammer the issuer
+const jwksRefreshInterval = time.Minute
+
+var oidcSigningMethods = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}
+
+// Validates bearer tokens signed by an OIDC issuer
+type oidcVerifier struct {
+	issuer   string
+	audience string
+	jwksURL  string
+	client   *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]interface{}
+	lastRefresh time.Time
+}
+
+func newOIDCVerifier(issuer, audience, jwksURL string) *oidcVerifier {
+	return &oidcVerifier{
+		issuer:   strings.TrimSuffix(issuer, "/"),
+		audience: audience,
+		jwksURL:  jwksURL,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		keys:     make(map[string]interface{}),
+	}
+}
+
+func (v *oidcVerifier) authenticate(token string) (*Principal, error) {
+	parser := &jwt.Parser{ValidMethods: oidcSigningMethods}
+	claims := jwt.MapClaims{}
+
+	parsed, err := parser.ParseWithClaims(token, claims, v.keyFor)
+	if err != nil {
+		return nil, err
+	}
+
+	if !parsed.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	// Valid only checks exp when it is present, which would leave a token
+	// without one valid forever
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("token has no expiry or has expired")
+	}
+
+	if !claims.VerifyIssuer(v.issuer, true) {
+		return nil, errors.New("token issued by an untrusted issuer")
+	}
+
+	if v.audience != "" && !hasAudience(claims, v.audience) {
+		return nil, errors.New("token not intended for this audience")
+	}
+
+	name, _ := claims["preferred_username"].(string)
+	if name == "" {
+		name, _ = claims["sub"].(string)
+	}
+
+	if name == "" {
+		return nil, errors.New("token has no subject")
+	}
+
+	return &Principal{
+		Name:   name,
+		Method: MethodOIDC,
+		Scopes: tokenScopes(claims),
+	}, nil
+}
+
+// hasAudience checks the aud claim, which may be a string or a list
+func hasAudience(claims jwt.MapClaims, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, entry := range aud {
+			if entry == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// tokenScopes reads the scopes granted by a token, from either a
+// space-separated scope claim or an scp list
+func tokenScopes(claims jwt.MapClaims) []string {
+	if scope, ok := claims["scope"].(string); ok {
+		return strings.Fields(scope)
+	}
+
+	var scopes []string
+	if scp, ok := claims["scp"].([]interface{}); ok {
+		for _, entry := range scp {
+			if scope, ok := entry.(string); ok {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+
+	return scopes
+}
+
+// keyFor returns the issuer's public key that signed the token
+func (v *oidcVerifier) keyFor(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	v.mu.Lock()
+	key, ok := v.keys[kid]
+	refresh := !ok && time.Since(v.lastRefresh) >= jwksRefreshInterval
+	if refresh {
+		// Claim the refresh, so concurrent requests do not all fetch the JWKS
+		v.lastRefresh = time.Now()
+	}
+	jwksURL := v.jwksURL
+	v.mu.Unlock()
+
+	if ok {
+		return key, nil
+	}
+
+	if !refresh {
+		return nil, fmt.Errorf("unknown signing key '%s'", kid)
+	}
+
+	// Fetch without holding the lock, so requests signed with known keys are
+	// not held up by a slow issuer
+	keys, jwksURL, err := v.fetchKeys(jwksURL)
+	if err != nil {
+		return nil, err
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.jwksURL = jwksURL
+	v.mu.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unknown signing key '%s'", kid)
+}
+
+// fetchKeys fetches the issuer's JWKS, discovering its URL first if it is
+// not yet known, and returns the signing keys it holds along with the URL
+func (v *oidcVerifier) fetchKeys(jwksURL string) (map[string]interface{}, string, error) {
+	if jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+
+		if err := v.fetch(v.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, "", err
+		}
+
+		if discovery.JWKSURI == "" {
+			return nil, "", errors.New("OIDC discovery document has no jwks_uri")
+		}
+
+		jwksURL = discovery.JWKSURI
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	if err := v.fetch(jwksURL, &jwks); err != nil {
+		return nil, "", err
+	}
+
+	keys := make(map[string]interface{})
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			// Skip keys of types we do not support
+			continue
+		}
+
+		keys[jwk.Kid] = key
+	}
+
+	return keys, jwksURL, nil
+}
+
+func (v *oidcVerifier) fetch(url string, out interface{}) error {
+	resp, err := v.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status fetching %s: %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Represents a public key published in a JWKS
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC key is not on its curve")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type '%s'", k.Kty)
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,354 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/dgrijalva/jwt-go"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testAudience = "gkadm"
+
+// testIssuer stands in for an OIDC issuer, publishing a discovery document
+// and a JWKS holding an RSA and an EC signing key
+type testIssuer struct {
+	server *httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	mu          sync.Mutex
+	keys        []jsonWebKey
+	jwksFetches int
+	block       chan struct{}
+}
+
+func encodeBigInt(value *big.Int, size int) string {
+	data := value.Bytes()
+	if len(data) < size {
+		data = append(make([]byte, size-len(data)), data...)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) jsonWebKey {
+	return jsonWebKey{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		N:   encodeBigInt(key.N, 0),
+		E:   encodeBigInt(big.NewInt(int64(key.E)), 0),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) jsonWebKey {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return jsonWebKey{
+		Kty: "EC",
+		Kid: kid,
+		Use: "sig",
+		Crv: key.Curve.Params().Name,
+		X:   encodeBigInt(key.X, size),
+		Y:   encodeBigInt(key.Y, size),
+	}
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer := &testIssuer{
+		rsaKey: rsaKey,
+		ecKey:  ecKey,
+		keys: []jsonWebKey{
+			rsaJWK("rsa", &rsaKey.PublicKey),
+			ecJWK("ec", &ecKey.PublicKey),
+			// Encryption keys are never used to verify tokens
+			{Kty: "RSA", Kid: "enc", Use: "enc", N: "AQAB", E: "AQAB"},
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   issuer.server.URL,
+			"jwks_uri": issuer.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		issuer.mu.Lock()
+		issuer.jwksFetches++
+		block := issuer.block
+		keys := append([]jsonWebKey(nil), issuer.keys...)
+		issuer.mu.Unlock()
+
+		if block != nil {
+			<-block
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	})
+
+	issuer.server = httptest.NewServer(mux)
+	return issuer
+}
+
+func (i *testIssuer) Close() {
+	i.server.Close()
+}
+
+func (i *testIssuer) fetches() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.jwksFetches
+}
+
+// claims returns valid claims for a token from this issuer
+func (i *testIssuer) claims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":   i.server.URL,
+		"aud":   testAudience,
+		"sub":   "alice",
+		"scope": "read verify",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+func TestOIDCAcceptsTokens(t *testing.T) {
+	issuer := newTestIssuer(t)
+	defer issuer.Close()
+
+	verifier := newOIDCVerifier(issuer.server.URL+"/", testAudience, "")
+
+	claims := issuer.claims()
+	principal, err := verifier.authenticate(sign(t, jwt.SigningMethodRS256, issuer.rsaKey, "rsa", claims))
+	if err != nil {
+		t.Fatalf("RS256 token rejected: %s", err)
+	}
+
+	if principal.Name != "alice" || principal.Method != MethodOIDC || !principal.HasScope(ScopeVerify) || principal.HasScope(ScopeIssue) {
+		t.Errorf("RS256 token authenticated as %+v", principal)
+	}
+
+	// Audience lists, scp claims and preferred usernames are understood too
+	claims = issuer.claims()
+	claims["aud"] = []string{"other", testAudience}
+	claims["preferred_username"] = "bob"
+	delete(claims, "scope")
+	claims["scp"] = []string{ScopeIssue}
+
+	principal, err = verifier.authenticate(sign(t, jwt.SigningMethodES256, issuer.ecKey, "ec", claims))
+	if err != nil {
+		t.Fatalf("ES256 token rejected: %s", err)
+	}
+
+	if principal.Name != "bob" || !principal.HasScope(ScopeIssue) || principal.HasScope(ScopeRead) {
+		t.Errorf("ES256 token authenticated as %+v", principal)
+	}
+
+	// The JWKS was only fetched once, on discovery
+	if fetches := issuer.fetches(); fetches != 1 {
+		t.Errorf("JWKS fetched %d times, want 1", fetches)
+	}
+}
+
+func TestOIDCRejectsTokens(t *testing.T) {
+	issuer := newTestIssuer(t)
+	defer issuer.Close()
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&issuer.rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	with := func(name string, value interface{}) jwt.MapClaims {
+		claims := issuer.claims()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+
+		return claims
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"wrong issuer", sign(t, jwt.SigningMethodRS256, issuer.rsaKey, "rsa", with("iss", "https://evil.example.com"))},
+		{"no issuer", sign(t, jwt.SigningMethodRS256, issuer.rsaKey, "rsa", with("iss", nil))},
+		{"wrong audience", sign(t, jwt.SigningMethodRS256, issuer.rsaKey, "rsa", with("aud", "other"))},
+		{"wrong audience list", sign(t, jwt.SigningMethodRS256, issuer.rsaKey, "rsa", with("aud", []string{"other"}))},
+		{"no audience", sign(t, jwt.SigningMethodRS256, issuer.rsaKey, "rsa", with("aud", nil))},
+		{"expired", sign(t, jwt.SigningMethodRS256, issuer.rsaKey, "rsa", with("exp", time.Now().Add(-time.Minute).Unix()))},
+		{"no expiry", sign(t, jwt.SigningMethodRS256, issuer.rsaKey, "rsa", with("exp", nil))},
+		{"no subject", sign(t, jwt.SigningMethodRS256, issuer.rsaKey, "rsa", with("sub", nil))},
+		{"unknown key", sign(t, jwt.SigningMethodRS256, otherKey, "other", issuer.claims())},
+		{"forged with a published key ID", sign(t, jwt.SigningMethodRS256, otherKey, "rsa", issuer.claims())},
+		{"encryption key", sign(t, jwt.SigningMethodRS256, otherKey, "enc", issuer.claims())},
+		{"HMAC with the public key", sign(t, jwt.SigningMethodHS256, publicKeyBytes, "rsa", issuer.claims())},
+		{"unsigned", sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "rsa", issuer.claims())},
+		{"garbage", "not.a.token"},
+	}
+
+	verifier := newOIDCVerifier(issuer.server.URL, testAudience, "")
+	for _, test := range tests {
+		if principal, err := verifier.authenticate(test.token); err == nil {
+			t.Errorf("%s: token accepted as %+v", test.name, principal)
+		}
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	issuer := newTestIssuer(t)
+	defer issuer.Close()
+
+	verifier := newOIDCVerifier(issuer.server.URL, testAudience, issuer.server.URL+"/jwks")
+	if _, err := verifier.authenticate(sign(t, jwt.SigningMethodRS256, issuer.rsaKey, "rsa", issuer.claims())); err != nil {
+		t.Fatal(err)
+	}
+
+	// The issuer publishes a new key
+	newKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer.mu.Lock()
+	issuer.keys = append(issuer.keys, ecJWK("new", &newKey.PublicKey))
+	issuer.mu.Unlock()
+
+	token := sign(t, jwt.SigningMethodES384, newKey, "new", issuer.claims())
+
+	// Unknown key IDs do not trigger a fetch until the refresh interval has passed
+	if _, err := verifier.authenticate(token); err == nil {
+		t.Error("token signed with an unfetched key accepted before the refresh interval")
+	}
+
+	if fetches := issuer.fetches(); fetches != 1 {
+		t.Errorf("JWKS fetched %d times, want 1", fetches)
+	}
+
+	verifier.mu.Lock()
+	verifier.lastRefresh = time.Now().Add(-jwksRefreshInterval)
+	verifier.mu.Unlock()
+
+	if _, err := verifier.authenticate(token); err != nil {
+		t.Errorf("token signed with a rotated key rejected: %s", err)
+	}
+
+	if fetches := issuer.fetches(); fetches != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", fetches)
+	}
+}
+
+func TestOIDCRefreshDoesNotBlock(t *testing.T) {
+	issuer := newTestIssuer(t)
+	defer issuer.Close()
+
+	verifier := newOIDCVerifier(issuer.server.URL, testAudience, "")
+	known := sign(t, jwt.SigningMethodRS256, issuer.rsaKey, "rsa", issuer.claims())
+	if _, err := verifier.authenticate(known); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the next JWKS fetch open
+	block := make(chan struct{})
+	issuer.mu.Lock()
+	issuer.block = block
+	issuer.mu.Unlock()
+	defer close(block)
+
+	verifier.mu.Lock()
+	verifier.lastRefresh = time.Now().Add(-jwksRefreshInterval)
+	verifier.mu.Unlock()
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unknown := sign(t, jwt.SigningMethodRS256, otherKey, "other", issuer.claims())
+	go func() {
+		_, _ = verifier.authenticate(unknown)
+	}()
+
+	// Wait for the refresh to start
+	for deadline := time.Now().Add(5 * time.Second); issuer.fetches() < 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("unknown key did not trigger a JWKS fetch")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := verifier.authenticate(known)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("token signed with a known key rejected during refresh: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("token signed with a known key waited for the JWKS fetch")
+	}
+}
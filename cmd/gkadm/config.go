@@ -0,0 +1,180 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/ComputerScienceHouse/gatekeeper/cmd/gkadm/auth"
+	"github.com/labstack/gommon/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"strings"
+	"time"
+)
+
+// Settings may also be given as GKADM_* environment variables, or as keys
+// of the same name in a YAML or TOML config file
+const envPrefix = "GKADM"
+
+var configFile string
+
+// Represents the settings of gkadm serve
+type serveConfig struct {
+	Listen  string
+	TLSCert string
+	TLSKey  string
+	// CA against which client certificates are verified, enabling mutual TLS
+	TLSClientCA string
+	// Whether clients must present a certificate, or may omit one
+	TLSClientOptional bool
+	CORSOrigins       []string
+	NFCDevice         string
+	// How often the reader is opened to check its health while idle
+	NFCProbeInterval time.Duration
+
+	History   string
+	Retention time.Duration
+
+	LogFormat string
+	LogLevel  log.Lvl
+
+	Auth       auth.Config
+	InlineKeys bool
+}
+
+func addServeFlags(flags *pflag.FlagSet) {
+	flags.String("listen", ":42069", "address to listen on")
+	flags.String("tls-cert", "", "TLS certificate file; serves plain HTTP if unset")
+	flags.String("tls-key", "", "TLS private key file")
+	flags.String("tls-client-ca", "", "CA bundle to verify client certificates against, enabling mutual TLS")
+	flags.Bool("tls-client-optional", false, "with tls-client-ca, accept clients that present no certificate")
+	flags.StringSlice("cors-origins", []string{"https://gatekeeper.csh.rit.edu", "http://localhost:3000"}, "origins allowed to make cross-origin requests")
+	flags.String("nfc-device", "", "libnfc connection string of the reader (default first available device)")
+	flags.Duration("nfc-probe-interval", 30*time.Second, "how often to check the reader while it is idle")
+
+	flags.String("history", "", "file in which to keep task history (default in-memory)")
+	flags.Duration("retention", 30*24*time.Hour, "how long to keep finished tasks (0 keeps them forever)")
+
+	flags.String("log-format", "text", "log format: text or json")
+	flags.String("log-level", "info", "log level: debug, info, warn or error")
+
+	flags.String("api-keys", "", "JSON file of static API keys and their scopes")
+	flags.String("oidc-issuer", "", "OIDC issuer whose bearer tokens are accepted")
+	flags.String("oidc-audience", "", "audience required in OIDC bearer tokens")
+	flags.String("oidc-jwks-url", "", "JWKS URL, if not found through OIDC discovery")
+	flags.Bool("no-auth", false, "serve the API without authentication (development only)")
+
+	flags.Bool("inline-keys", false, "accept the system secret and realm keys inline in requests")
+}
+
+// loadConfig merges the command's flags with the environment and config
+// file; flags set on the command line take precedence
+func loadConfig(cmd *cobra.Command) (*viper.Viper, error) {
+	v := viper.New()
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	v.AutomaticEnv()
+
+	if err := v.BindPFlags(cmd.Flags()); err != nil {
+		return nil, err
+	}
+
+	if configFile != "" {
+		v.SetConfigFile(configFile)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("unable to read config file: %s", err)
+		}
+	}
+
+	// The keystore is shared with the keystore subcommands
+	keystorePath = v.GetString("keystore")
+	keystorePassphraseFile = v.GetString("keystore-passphrase-file")
+
+	return v, nil
+}
+
+func loadServeConfig(cmd *cobra.Command) (*serveConfig, error) {
+	v, err := loadConfig(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &serveConfig{
+		Listen:            v.GetString("listen"),
+		TLSCert:           v.GetString("tls-cert"),
+		TLSKey:            v.GetString("tls-key"),
+		TLSClientCA:       v.GetString("tls-client-ca"),
+		TLSClientOptional: v.GetBool("tls-client-optional"),
+		CORSOrigins:       v.GetStringSlice("cors-origins"),
+		NFCDevice:         v.GetString("nfc-device"),
+		NFCProbeInterval:  v.GetDuration("nfc-probe-interval"),
+		History:           v.GetString("history"),
+		Retention:         v.GetDuration("retention"),
+		LogFormat:         v.GetString("log-format"),
+		Auth: auth.Config{
+			APIKeysFile:  v.GetString("api-keys"),
+			OIDCIssuer:   v.GetString("oidc-issuer"),
+			OIDCAudience: v.GetString("oidc-audience"),
+			OIDCJWKSURL:  v.GetString("oidc-jwks-url"),
+			Disabled:     v.GetBool("no-auth"),
+		},
+		InlineKeys: v.GetBool("inline-keys"),
+	}
+
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		return nil, fmt.Errorf("tls-cert and tls-key must be set together")
+	}
+
+	if config.TLSClientCA != "" && config.TLSCert == "" {
+		return nil, fmt.Errorf("tls-client-ca requires tls-cert and tls-key")
+	}
+
+	// Fail closed: the API issues and revokes tags, so it is never served
+	// without authentication or keys unless explicitly asked to
+	if !config.Auth.Disabled && config.Auth.APIKeysFile == "" && config.Auth.OIDCIssuer == "" {
+		return nil, fmt.Errorf("no authentication configured; set api-keys or oidc-issuer, or no-auth for development")
+	}
+
+	if keystorePath == "" && !config.InlineKeys {
+		return nil, fmt.Errorf("no keystore configured; set keystore, or inline-keys to accept keys in requests")
+	}
+
+	if config.NFCProbeInterval <= 0 {
+		return nil, fmt.Errorf("nfc-probe-interval must be positive")
+	}
+
+	if config.LogFormat != "text" && config.LogFormat != "json" {
+		return nil, fmt.Errorf("unknown log format '%s'", config.LogFormat)
+	}
+
+	switch level := v.GetString("log-level"); level {
+	case "debug":
+		config.LogLevel = log.DEBUG
+	case "info":
+		config.LogLevel = log.INFO
+	case "warn":
+		config.LogLevel = log.WARN
+	case "error":
+		config.LogLevel = log.ERROR
+	default:
+		return nil, fmt.Errorf("unknown log level '%s'", level)
+	}
+
+	return config, nil
+}
@@ -0,0 +1,172 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"github.com/labstack/gommon/log"
+	"github.com/spf13/pflag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parseServe parses args as given to gkadm serve, and loads its config
+func parseServe(t *testing.T, args ...string) (*serveConfig, error) {
+	t.Helper()
+
+	// The keystore and config file settings are kept in package variables
+	defer func() {
+		configFile, keystorePath, keystorePassphraseFile = "", "", ""
+	}()
+
+	serveCmd, _, err := newRootCmd().Find([]string{"serve"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := serveCmd.ParseFlags(args); err != nil {
+		t.Fatal(err)
+	}
+
+	return loadServeConfig(serveCmd)
+}
+
+// setenv sets environment variables, returning a func which unsets them
+func setenv(t *testing.T, vars map[string]string) func() {
+	for name, value := range vars {
+		if err := os.Setenv(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return func() {
+		for name := range vars {
+			_ = os.Unsetenv(name)
+		}
+	}
+}
+
+func TestServeConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gkadm-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "gkadm.yaml")
+	err = ioutil.WriteFile(path, []byte(`
+listen: ":1001"
+log-format: json
+log-level: debug
+nfc-device: "pn532_uart:/dev/ttyUSB0"
+oidc-issuer: https://sso.example.com
+inline-keys: true
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer setenv(t, map[string]string{
+		"GKADM_LISTEN":     ":1002",
+		"GKADM_LOG_FORMAT": "text",
+		"GKADM_HISTORY":    "/var/lib/gkadm/history.db",
+	})()
+
+	config, err := parseServe(t, "--config", path, "--listen", ":1003")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		got, want interface{}
+	}{
+		// A flag beats the environment and the config file
+		{"listen", config.Listen, ":1003"},
+		// The environment beats the config file
+		{"log-format", config.LogFormat, "text"},
+		// The config file beats the default
+		{"log-level", config.LogLevel, log.DEBUG},
+		{"nfc-device", config.NFCDevice, "pn532_uart:/dev/ttyUSB0"},
+		{"oidc-issuer", config.Auth.OIDCIssuer, "https://sso.example.com"},
+		{"inline-keys", config.InlineKeys, true},
+		// The environment beats the default
+		{"history", config.History, "/var/lib/gkadm/history.db"},
+		// Anything unset takes the default
+		{"retention", config.Retention, 30 * 24 * time.Hour},
+		{"nfc-probe-interval", config.NFCProbeInterval, 30 * time.Second},
+		{"no-auth", config.Auth.Disabled, false},
+	}
+
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, test.got, test.want)
+		}
+	}
+}
+
+func TestServeConfigFailsClosed(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		err  string
+	}{
+		{"defaults", nil, "no authentication configured"},
+		{"no keys", []string{"--api-keys", "keys.json"}, "no keystore configured"},
+		{"no authentication", []string{"--keystore", "keystore.json"}, "no authentication configured"},
+		{"inline keys without authentication", []string{"--inline-keys"}, "no authentication configured"},
+	}
+
+	for _, test := range tests {
+		if _, err := parseServe(t, test.args...); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got %v, want an error containing %q", test.name, err, test.err)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"--no-auth", "--inline-keys"},
+		{"--api-keys", "keys.json", "--keystore", "keystore.json"},
+		{"--oidc-issuer", "https://sso.example.com", "--inline-keys"},
+	} {
+		if _, err := parseServe(t, args...); err != nil {
+			t.Errorf("%s: %s", strings.Join(args, " "), err)
+		}
+	}
+}
+
+func TestRootCommandServes(t *testing.T) {
+	root := newRootCmd()
+	if root.RunE == nil {
+		t.Fatal("gkadm without a subcommand does nothing")
+	}
+
+	// The root command takes the same flags as serve
+	serveCmd, _, err := root.Find([]string{"serve"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serveCmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if root.Flags().Lookup(flag.Name) == nil {
+			t.Errorf("gkadm does not accept --%s", flag.Name)
+		}
+	})
+}
@@ -0,0 +1,141 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ComputerScienceHouse/gatekeeper/cmd/gkadm/keystore"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const keystorePassphraseEnv = "GKADM_KEYSTORE_PASSPHRASE"
+
+var (
+	keystorePath           string
+	keystorePassphraseFile string
+)
+
+// readPassphrase reads the keystore passphrase from the configured file,
+// falling back to the environment
+func readPassphrase() ([]byte, error) {
+	if keystorePassphraseFile != "" {
+		data, err := ioutil.ReadFile(keystorePassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return []byte(strings.TrimRight(string(data), "\r\n")), nil
+	}
+
+	if passphrase := os.Getenv(keystorePassphraseEnv); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+
+	return nil, fmt.Errorf("no keystore passphrase; set --keystore-passphrase-file or $%s", keystorePassphraseEnv)
+}
+
+func openKeystore() (*keystore.Keystore, error) {
+	passphrase, err := readPassphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	return keystore.Open(keystorePath, passphrase)
+}
+
+func newKeystoreCmd() *cobra.Command {
+	var keystoreCmd = &cobra.Command{
+		Use:   "keystore",
+		Short: "Manage the encrypted keystore",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if _, err := loadConfig(cmd); err != nil {
+				return err
+			}
+
+			if keystorePath == "" {
+				return errors.New("--keystore is required")
+			}
+
+			return nil
+		},
+	}
+
+	var sealCmd = &cobra.Command{
+		Use:   "seal <contents.json>",
+		Short: "Encrypt a JSON file of key material into the keystore",
+		Long: `Encrypts a JSON document of the form
+  {"systemSecret": "...", "realms": [{"id": "...", "name": "...", "slot": 0, "authKey": "...", ...}]}
+into the keystore, replacing its contents. Delete the plaintext file afterwards.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			data, err := ioutil.ReadFile(args[0])
+			if err != nil {
+				return err
+			}
+
+			contents := new(keystore.Contents)
+			if err := json.Unmarshal(data, contents); err != nil {
+				return err
+			}
+
+			passphrase, err := readPassphrase()
+			if err != nil {
+				return err
+			}
+
+			if err := keystore.Seal(keystorePath, passphrase, contents); err != nil {
+				return err
+			}
+
+			fmt.Printf("Sealed %d realms into %s\n", len(contents.Realms), keystorePath)
+			return nil
+		},
+	}
+
+	var listCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List the realms held in the keystore",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ks, err := openKeystore()
+			if err != nil {
+				return err
+			}
+
+			if _, ok := ks.SystemSecret(); ok {
+				fmt.Println("System secret: present")
+			} else {
+				fmt.Println("System secret: absent")
+			}
+
+			for _, realm := range ks.Realms() {
+				fmt.Printf("%s\t%s\tslot %d\n", realm.ID, realm.Name, realm.Slot)
+			}
+
+			return nil
+		},
+	}
+
+	keystoreCmd.AddCommand(sealCmd, listCmd)
+	return keystoreCmd
+}
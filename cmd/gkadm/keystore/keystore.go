@@ -0,0 +1,264 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const formatVersion = 1
+
+// scrypt parameters used when sealing a keystore
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+	saltLen      = 16
+)
+
+// Limits on the scrypt parameters accepted from a keystore file, so a
+// corrupt or hostile file cannot make opening it exhaust memory or CPU
+const (
+	minScryptN      = 1 << 14
+	maxScryptN      = 1 << 20
+	maxScryptR      = 32
+	maxScryptP      = 16
+	maxScryptMemory = 1 << 30
+)
+
+// Represents a realm's key material as held in the keystore, encoded the
+// same way as in inline task requests
+type Realm struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Slot       int    `json:"slot"`
+	AuthKey    string `json:"authKey"`
+	ReadKey    string `json:"readKey"`
+	UpdateKey  string `json:"updateKey"`
+	PublicKey  string `json:"publicKey"`
+	PrivateKey string `json:"privateKey"`
+}
+
+// Represents the decrypted contents of a keystore
+type Contents struct {
+	SystemSecret string  `json:"systemSecret"`
+	Realms       []Realm `json:"realms"`
+}
+
+// Represents a keystore file on disk; only the KDF parameters are in the clear
+type envelope struct {
+	Version    int    `json:"version"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// Holds the system secret and realm keys decrypted from a keystore file
+type Keystore struct {
+	contents Contents
+}
+
+// checkParams rejects key derivation parameters outside the limits
+func (env *envelope) checkParams() error {
+	switch {
+	case env.N < minScryptN || env.N > maxScryptN || env.N&(env.N-1) != 0:
+		return fmt.Errorf("invalid keystore scrypt N %d, must be a power of two from %d to %d", env.N, minScryptN, maxScryptN)
+	case env.R < 1 || env.R > maxScryptR:
+		return fmt.Errorf("invalid keystore scrypt r %d, must be from 1 to %d", env.R, maxScryptR)
+	case env.P < 1 || env.P > maxScryptP:
+		return fmt.Errorf("invalid keystore scrypt p %d, must be from 1 to %d", env.P, maxScryptP)
+	case env.R > maxScryptMemory/128/env.N:
+		return fmt.Errorf("keystore scrypt parameters need more than %d MiB", maxScryptMemory>>20)
+	case len(env.Salt) < saltLen:
+		return fmt.Errorf("keystore salt is too short, must be at least %d bytes", saltLen)
+	}
+
+	return nil
+}
+
+func newAEAD(passphrase, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, n, r, p, scryptKeyLen)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Decrypts the keystore at path
+func Open(path string, passphrase []byte) (*Keystore, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("unable to parse keystore: %s", err)
+	}
+
+	if env.Version != formatVersion {
+		return nil, fmt.Errorf("unsupported keystore version %d", env.Version)
+	}
+
+	if err := env.checkParams(); err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(passphrase, env.Salt, env.N, env.R, env.P)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(env.Nonce) != aead.NonceSize() {
+		return nil, errors.New("keystore is corrupt")
+	}
+
+	plaintext, err := aead.Open(nil, env.Nonce, env.Ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("unable to decrypt keystore: wrong passphrase or corrupt file")
+	}
+
+	ks := new(Keystore)
+	if err := json.Unmarshal(plaintext, &ks.contents); err != nil {
+		return nil, fmt.Errorf("unable to parse keystore contents: %s", err)
+	}
+
+	if err := ks.validate(); err != nil {
+		return nil, err
+	}
+
+	return ks, nil
+}
+
+// Encrypts contents with the passphrase and writes them to path, replacing
+// any existing keystore
+func Seal(path string, passphrase []byte, contents *Contents) error {
+	if err := (&Keystore{*contents}).validate(); err != nil {
+		return err
+	}
+
+	plaintext, err := json.Marshal(contents)
+	if err != nil {
+		return err
+	}
+
+	env := envelope{
+		Version: formatVersion,
+		N:       scryptN,
+		R:       scryptR,
+		P:       scryptP,
+		Salt:    make([]byte, saltLen),
+	}
+
+	if _, err := rand.Read(env.Salt); err != nil {
+		return err
+	}
+
+	aead, err := newAEAD(passphrase, env.Salt, env.N, env.R, env.P)
+	if err != nil {
+		return err
+	}
+
+	env.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(env.Nonce); err != nil {
+		return err
+	}
+
+	env.Ciphertext = aead.Seal(nil, env.Nonce, plaintext, nil)
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a failed write never loses the old keystore
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".keystore")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (k *Keystore) validate() error {
+	seen := make(map[string]bool)
+	for _, realm := range k.contents.Realms {
+		if realm.ID == "" || realm.Name == "" {
+			return errors.New("every realm in the keystore needs an ID and a name")
+		}
+
+		if seen[realm.ID] || seen[realm.Name] {
+			return fmt.Errorf("realm '%s' appears more than once in the keystore", realm.Name)
+		}
+
+		seen[realm.ID] = true
+		seen[realm.Name] = true
+	}
+
+	return nil
+}
+
+// Returns the encoded system secret, if the keystore holds one
+func (k *Keystore) SystemSecret() (string, bool) {
+	return k.contents.SystemSecret, k.contents.SystemSecret != ""
+}
+
+// Looks up a realm by its ID or name
+func (k *Keystore) Realm(ref string) (*Realm, bool) {
+	for i, realm := range k.contents.Realms {
+		if realm.ID == ref || realm.Name == ref {
+			return &k.contents.Realms[i], true
+		}
+	}
+
+	return nil, false
+}
+
+// Returns every realm in the keystore
+func (k *Keystore) Realms() []Realm {
+	return append([]Realm(nil), k.contents.Realms...)
+}
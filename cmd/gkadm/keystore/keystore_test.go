@@ -0,0 +1,264 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package keystore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testPassphrase = []byte("correct horse battery staple")
+
+func testContents() *Contents {
+	return &Contents{
+		SystemSecret: "c2VjcmV0",
+		Realms: []Realm{
+			{ID: "1", Name: "front", Slot: 1, ReadKey: "cmVhZA=="},
+			{ID: "2", Name: "back", Slot: 2, ReadKey: "a2V5"},
+		},
+	}
+}
+
+// tempDir creates a temporary directory, returning it and a cleanup func
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "gkadm-keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, func() {
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// sealed seals the test contents, returning the keystore's path
+func sealed(t *testing.T, dir string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, "keystore.json")
+	if err := Seal(path, testPassphrase, testContents()); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// editEnvelope rewrites the keystore at path
+func editEnvelope(t *testing.T, path string, edit func(env *envelope)) {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		t.Fatal(err)
+	}
+
+	edit(&env)
+
+	if data, err = json.Marshal(&env); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeystoreRoundTrip(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	path := sealed(t, dir)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(data), "c2VjcmV0") {
+		t.Error("keystore file holds the system secret in the clear")
+	}
+
+	ks, err := Open(path, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if secret, ok := ks.SystemSecret(); !ok || secret != "c2VjcmV0" {
+		t.Errorf("system secret %q (%t), want c2VjcmV0", secret, ok)
+	}
+
+	if realms := ks.Realms(); len(realms) != 2 {
+		t.Errorf("keystore holds %d realms, want 2", len(realms))
+	}
+
+	for _, ref := range []string{"2", "back"} {
+		if realm, ok := ks.Realm(ref); !ok || realm.Slot != 2 || realm.ReadKey != "a2V5" {
+			t.Errorf("looking up realm %s found %+v (%t)", ref, realm, ok)
+		}
+	}
+
+	if _, ok := ks.Realm("side"); ok {
+		t.Error("found a realm which is not in the keystore")
+	}
+}
+
+func TestKeystoreWrongPassphrase(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	path := sealed(t, dir)
+	if _, err := Open(path, []byte("wrong")); err == nil {
+		t.Error("keystore opened with the wrong passphrase")
+	}
+}
+
+func TestKeystoreTampered(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	tests := []struct {
+		name string
+		edit func(env *envelope)
+	}{
+		{"ciphertext", func(env *envelope) { env.Ciphertext[0] ^= 1 }},
+		{"nonce", func(env *envelope) { env.Nonce[0] ^= 1 }},
+		{"salt", func(env *envelope) { env.Salt[0] ^= 1 }},
+		{"short nonce", func(env *envelope) { env.Nonce = env.Nonce[:4] }},
+		{"version", func(env *envelope) { env.Version = 2 }},
+	}
+
+	for _, test := range tests {
+		path := sealed(t, dir)
+		editEnvelope(t, path, test.edit)
+
+		if _, err := Open(path, testPassphrase); err == nil {
+			t.Errorf("%s: tampered keystore opened", test.name)
+		}
+	}
+}
+
+func TestKeystoreParams(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	tests := []struct {
+		name string
+		edit func(env *envelope)
+	}{
+		{"N too large", func(env *envelope) { env.N = 1 << 30 }},
+		{"N too small", func(env *envelope) { env.N = 1 << 10 }},
+		{"N not a power of two", func(env *envelope) { env.N = 3 << 14 }},
+		{"no r", func(env *envelope) { env.R = 0 }},
+		{"r too large", func(env *envelope) { env.R = 1 << 20 }},
+		{"no p", func(env *envelope) { env.P = 0 }},
+		{"p too large", func(env *envelope) { env.P = 1 << 20 }},
+		{"too much memory", func(env *envelope) { env.N, env.R = maxScryptN, maxScryptR }},
+		{"short salt", func(env *envelope) { env.Salt = env.Salt[:4] }},
+	}
+
+	for _, test := range tests {
+		path := sealed(t, dir)
+		editEnvelope(t, path, test.edit)
+
+		if _, err := Open(path, testPassphrase); err == nil || !strings.Contains(err.Error(), "keystore") {
+			t.Errorf("%s: got %v, want the parameters rejected", test.name, err)
+		}
+	}
+}
+
+func TestKeystoreDuplicateRealms(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "keystore.json")
+
+	tests := []struct {
+		name   string
+		realms []Realm
+	}{
+		{"ID", []Realm{{ID: "1", Name: "front"}, {ID: "1", Name: "back"}}},
+		{"name", []Realm{{ID: "1", Name: "front"}, {ID: "2", Name: "front"}}},
+		{"ID matching a name", []Realm{{ID: "1", Name: "front"}, {ID: "front", Name: "back"}}},
+		{"no ID", []Realm{{Name: "front"}}},
+	}
+
+	for _, test := range tests {
+		if err := Seal(path, testPassphrase, &Contents{Realms: test.realms}); err == nil {
+			t.Errorf("duplicate %s: keystore sealed", test.name)
+		}
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("invalid keystore written: %v", err)
+	}
+}
+
+func TestKeystoreWriteFailure(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	path := sealed(t, dir)
+	original, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory in the way of the keystore makes the final rename fail
+	blocked := filepath.Join(dir, "blocked")
+	if err := os.MkdirAll(filepath.Join(blocked, "child"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Seal(blocked, testPassphrase, testContents()); err == nil {
+		t.Error("keystore sealed over a directory")
+	}
+
+	// Nothing is left behind, and the existing keystore is untouched
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".keystore") {
+			t.Errorf("temporary file %s left behind", entry.Name())
+		}
+	}
+
+	if err := Seal(filepath.Join(dir, "missing", "keystore.json"), testPassphrase, testContents()); err == nil {
+		t.Error("keystore sealed into a missing directory")
+	}
+
+	current, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(current) != string(original) {
+		t.Error("failed writes changed the existing keystore")
+	}
+}
@@ -18,13 +18,16 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"github.com/ComputerScienceHouse/gatekeeper/cmd/gkadm/auth"
 	"github.com/ComputerScienceHouse/gatekeeper/cmd/gkadm/tasks"
-	"github.com/ComputerScienceHouse/gatekeeper/device"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
-	"github.com/labstack/gommon/log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"runtime"
@@ -36,24 +39,64 @@ var (
 	commitHash string
 )
 
-func serve() {
+// Log formats for the server log
+var logHeaders = map[string]string{
+	"text": "[${time_rfc3339}] [${level}]",
+	"json": `{"time":"${time_rfc3339}","level":"${level}"}`,
+}
+
+func serve(config *serveConfig) {
 	e := echo.New()
 
 	// Configuration
-	e.Logger.SetLevel(log.INFO)
+	e.Logger.SetLevel(config.LogLevel)
 	e.HideBanner = true
-	e.Logger.SetHeader("[${time_rfc3339}] [${level}]")
+	e.Logger.SetHeader(logHeaders[config.LogFormat])
+
+	authenticator, err := auth.New(config.Auth)
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+
+	if config.Auth.Disabled {
+		e.Logger.Warn("API authentication is disabled; anyone who can reach this server may issue tags")
+	}
+
+	// Key material
+	if keystorePath != "" {
+		ks, err := openKeystore()
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+
+		tasks.UseKeystore(ks)
+		e.Logger.Infof("Loaded %d realms from keystore", len(ks.Realms()))
+	}
+
+	tasks.AllowInlineKeys(config.InlineKeys)
+	tasks.UseNFCDevice(config.NFCDevice)
+	tasks.StartNFCProber(config.NFCProbeInterval)
+
+	// Task history
+	if config.History != "" {
+		if err := tasks.OpenHistory(config.History); err != nil {
+			e.Logger.Fatal(err)
+		}
+
+		defer tasks.CloseHistory()
+	}
+
+	if config.Retention > 0 {
+		tasks.StartPruning(config.Retention, e.Logger)
+	}
 
 	// Middleware
-	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
-		Format: "[${time_rfc3339}] ${method} ${uri} (${status})\n",
-	}))
+	e.Use(auth.ClientCertificates())
+
+	e.Use(requestLogger(config.LogFormat, os.Stdout))
 
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: []string{
-			"https://gatekeeper.csh.rit.edu",
-			"http://localhost:3000",
-		},
+		AllowOrigins: config.CORSOrigins,
 		AllowMethods: []string{
 			http.MethodGet,
 			http.MethodHead,
@@ -75,32 +118,113 @@ func serve() {
 		return c.String(http.StatusOK, "ok")
 	})
 
-	e.GET("/healthz/nfc", func(c echo.Context) error {
-		if device.NFCHealthz() {
-			return c.String(http.StatusOK, "ok")
-		} else {
-			return c.NoContent(http.StatusServiceUnavailable)
-		}
-	})
+	e.GET("/healthz/nfc", tasks.GetNFCHealth)
+
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+
+	canRead := authenticator.Require(auth.ScopeRead, auth.ScopeVerify, auth.ScopeIssue)
+	canVerify := authenticator.Require(auth.ScopeVerify, auth.ScopeIssue)
+	canIssue := authenticator.Require(auth.ScopeIssue)
 
-	e.GET("/tasks", tasks.GetTasks)
-	e.GET("/tasks/:id", tasks.GetTask)
-	e.GET("/tasks/:id/log", tasks.GetTaskLog)
-	e.POST("/issue", tasks.CreateIssueTask)
-	e.POST("/verify", tasks.CreateVerifyTask)
+	e.GET("/tasks", tasks.GetTasks, canRead)
+	e.GET("/tasks/:id", tasks.GetTask, canRead)
+	e.GET("/tasks/:id/log", tasks.GetTaskLog, canRead)
+	e.DELETE("/tasks/:id", tasks.CancelTask, canVerify)
+	e.POST("/issue", tasks.CreateIssueTask, canIssue)
+	e.POST("/verify", tasks.CreateVerifyTask, canVerify)
+	e.POST("/revoke", tasks.CreateRevokeTask, canIssue)
+	e.POST("/format", tasks.CreateFormatTask, canIssue)
+	e.POST("/inspect", tasks.CreateInspectTask, canVerify)
 
 	// Start the server
-	e.Logger.Fatal(e.Start(":42069"))
+	switch {
+	case config.TLSClientCA != "":
+		tlsConfig, err := mutualTLSConfig(config)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+
+		e.Logger.Fatal(e.StartServer(&http.Server{
+			Addr:      config.Listen,
+			TLSConfig: tlsConfig,
+		}))
+	case config.TLSCert != "":
+		e.Logger.Fatal(e.StartTLS(config.Listen, config.TLSCert, config.TLSKey))
+	default:
+		e.Logger.Fatal(e.Start(config.Listen))
+	}
 }
 
-func main() {
+// mutualTLSConfig builds a TLS configuration which verifies client
+// certificates against the configured CA
+func mutualTLSConfig(config *serveConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+
+	caPEM, err := ioutil.ReadFile(config.TLSClientCA)
+	if err != nil {
+		return nil, err
+	}
+
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", config.TLSClientCA)
+	}
+
+	clientAuth := tls.RequireAndVerifyClientCert
+	if config.TLSClientOptional {
+		clientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   clientAuth,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Explains the settings without which the server refuses to start
+const serveRequirements = `
+The server fails closed: it refuses to start until it has both
+  - a way to authenticate clients: --api-keys or --oidc-issuer, or --no-auth
+    for development only
+  - key material: --keystore, or --inline-keys to accept keys in requests`
+
+func runServe(cmd *cobra.Command, args []string) error {
+	// Configuration errors are not usage errors, and main prints them
+	cmd.SilenceUsage = true
+	cmd.SilenceErrors = true
+
+	config, err := loadServeConfig(cmd)
+	if err != nil {
+		return err
+	}
+
+	serve(config)
+	return nil
+}
+
+func newRootCmd() *cobra.Command {
+	// Running gkadm without a subcommand serves the API, as it always has
 	var rootCmd = &cobra.Command{
 		Use:   "gkadm",
 		Short: "Gatekeeper Admin",
-		Long:  `The Gatekeeper Admin Server`,
-		Run: func(cmd *cobra.Command, args []string) {
-			serve()
-		},
+		Long: `The Gatekeeper Admin Server. Without a subcommand, serves the admin API.
+` + serveRequirements,
+		Args: cobra.NoArgs,
+		RunE: runServe,
+	}
+
+	var serveCmd = &cobra.Command{
+		Use:   "serve",
+		Short: "Run the admin API server",
+		Long: `Run the admin API server.
+` + serveRequirements,
+		Args: cobra.NoArgs,
+		RunE: runServe,
 	}
 
 	var versionCmd = &cobra.Command{
@@ -119,8 +243,21 @@ func main() {
 		},
 	}
 
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "YAML or TOML config file")
+	rootCmd.PersistentFlags().StringVar(&keystorePath, "keystore", "", "encrypted keystore holding the system secret and realm keys")
+	rootCmd.PersistentFlags().StringVar(&keystorePassphraseFile, "keystore-passphrase-file", "", "file containing the keystore passphrase (default $"+keystorePassphraseEnv+")")
+
+	addServeFlags(rootCmd.Flags())
+	addServeFlags(serveCmd.Flags())
+
+	rootCmd.AddCommand(serveCmd)
 	rootCmd.AddCommand(versionCmd)
-	if err := rootCmd.Execute(); err != nil {
+	rootCmd.AddCommand(newKeystoreCmd())
+	return rootCmd
+}
+
+func main() {
+	if err := newRootCmd().Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
@@ -0,0 +1,71 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ComputerScienceHouse/gatekeeper/cmd/gkadm/auth"
+	"github.com/labstack/echo"
+	"io"
+	"time"
+)
+
+// Represents a line of the request log in the JSON format
+type requestLogEntry struct {
+	Time   string `json:"time"`
+	Method string `json:"method"`
+	URI    string `json:"uri"`
+	Status int    `json:"status"`
+}
+
+// Returns middleware which logs each request to out once it has been
+// handled. Tokens in the query string are redacted, and JSON lines are
+// encoded rather than templated, so URIs are always escaped.
+func requestLogger(format string, out io.Writer) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if err := next(c); err != nil {
+				// Let the error handler write the response, so its status is logged
+				c.Error(err)
+			}
+
+			entry := requestLogEntry{
+				Time:   time.Now().Format(time.RFC3339),
+				Method: c.Request().Method,
+				URI:    auth.RedactedURI(c.Request()),
+				Status: c.Response().Status,
+			}
+
+			var line []byte
+			if format == "json" {
+				encoded, err := json.Marshal(entry)
+				if err != nil {
+					return err
+				}
+
+				line = append(encoded, '\n')
+			} else {
+				line = []byte(fmt.Sprintf("[%s] %s %s (%d)\n", entry.Time, entry.Method, entry.URI, entry.Status))
+			}
+
+			_, err := out.Write(line)
+			return err
+		}
+	}
+}
@@ -0,0 +1,64 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/labstack/echo"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestLoggerRedactsTokens(t *testing.T) {
+	for _, format := range []string{"text", "json"} {
+		var out bytes.Buffer
+
+		e := echo.New()
+		e.Use(requestLogger(format, &out))
+		e.GET("/tasks/:id/log", func(c echo.Context) error {
+			return echo.ErrForbidden
+		})
+
+		req := httptest.NewRequest(http.MethodGet, `/tasks/a"b/log?offset=1&access_token=secret`, nil)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+
+		line := out.String()
+		if strings.Contains(line, "secret") {
+			t.Errorf("%s request log contains the token: %s", format, line)
+		}
+
+		if format == "text" {
+			if want := `GET /tasks/a%22b/log?access_token=REDACTED&offset=1 (403)`; !strings.Contains(line, want) {
+				t.Errorf("text request log is %q, want it to contain %q", line, want)
+			}
+			continue
+		}
+
+		var entry requestLogEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("JSON request log is not valid JSON: %s: %s", err, line)
+		}
+
+		if entry.Method != http.MethodGet || entry.Status != http.StatusForbidden || entry.URI != `/tasks/a%22b/log?access_token=REDACTED&offset=1` {
+			t.Errorf("JSON request log is %+v", entry)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tasks
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"go.etcd.io/bbolt"
+	"time"
+)
+
+var tasksBucket = []byte("tasks")
+
+// Keeps task records in a BoltDB file so they survive restarts
+type boltHistory struct {
+	db *bbolt.DB
+}
+
+func openBoltHistory(path string) (*boltHistory, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(tasksBucket)
+		if err != nil {
+			return err
+		}
+
+		// Tasks still pending or running were cut short by the last shutdown
+		var interrupted []*taskRecord
+		err = bucket.ForEach(func(k, v []byte) error {
+			record := new(taskRecord)
+			if err := json.Unmarshal(v, record); err != nil {
+				return err
+			}
+
+			if record.FinishedAt == nil {
+				interrupted = append(interrupted, record)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for _, record := range interrupted {
+			record.State = taskStateFailed
+			record.FinishedAt = &now
+			record.ErrorCode = errorCodeInterrupted
+			record.ErrorMessage = "server stopped before the task finished"
+
+			if err := putRecord(bucket, record); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &boltHistory{db}, nil
+}
+
+func putRecord(bucket *bbolt.Bucket, record *taskRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(record.ID[:], value)
+}
+
+func (h *boltHistory) Save(record *taskRecord) error {
+	return h.db.Update(func(tx *bbolt.Tx) error {
+		return putRecord(tx.Bucket(tasksBucket), record)
+	})
+}
+
+func (h *boltHistory) Get(id uuid.UUID) (*taskRecord, error) {
+	var record *taskRecord
+
+	err := h.db.View(func(tx *bbolt.Tx) error {
+		value := tx.Bucket(tasksBucket).Get(id[:])
+		if value == nil {
+			return nil
+		}
+
+		record = new(taskRecord)
+		return json.Unmarshal(value, record)
+	})
+
+	return record, err
+}
+
+func (h *boltHistory) records(tx *bbolt.Tx) ([]*taskRecord, error) {
+	var records []*taskRecord
+
+	err := tx.Bucket(tasksBucket).ForEach(func(k, v []byte) error {
+		record := new(taskRecord)
+		if err := json.Unmarshal(v, record); err != nil {
+			return err
+		}
+
+		records = append(records, record)
+		return nil
+	})
+
+	return records, err
+}
+
+func (h *boltHistory) List(filter historyFilter) ([]*taskRecord, int, error) {
+	var records []*taskRecord
+
+	err := h.db.View(func(tx *bbolt.Tx) (err error) {
+		records, err = h.records(tx)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	page, total := filterRecords(records, filter)
+	return page, total, nil
+}
+
+func (h *boltHistory) Prune(before time.Time) (int, error) {
+	pruned := 0
+
+	err := h.db.Update(func(tx *bbolt.Tx) error {
+		records, err := h.records(tx)
+		if err != nil {
+			return err
+		}
+
+		bucket := tx.Bucket(tasksBucket)
+		for _, record := range records {
+			if !finishedBefore(record, before) {
+				continue
+			}
+
+			if err := bucket.Delete(record.ID[:]); err != nil {
+				return err
+			}
+
+			pruned++
+		}
+
+		return nil
+	})
+
+	return pruned, err
+}
+
+func (h *boltHistory) Close() error {
+	return h.db.Close()
+}
@@ -0,0 +1,118 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tasks
+
+import (
+	"fmt"
+	"github.com/ComputerScienceHouse/gatekeeper/device"
+	"github.com/labstack/echo"
+	"net/http"
+)
+
+const taskTypeFormat = "format"
+
+type formatRequest struct {
+	taskOptions
+	SystemSecret string `json:"systemSecret"`
+
+	// Realms on the tag, used only to retrieve the real UID of tags with
+	// random UIDs enabled, i.e. any tag which has been issued. Each needs just
+	// an ID, or a slot and read key; when none are given, every realm in the
+	// keystore is tried.
+	Realms []issueRequestRealm `json:"realms"`
+}
+
+type formatResult struct {
+	UID string `json:"uid"`
+}
+
+type taskFormat struct {
+	*taskBase
+	Request *formatRequest
+}
+
+func (m *taskFormat) Run(reader device.Reader) {
+	m.Logger.Info("Parsing format request...")
+
+	systemSecret, err := resolveSystemSecret(m.Request.SystemSecret)
+	if err != nil {
+		m.fail(errorCodeInvalidRequest, err)
+		return
+	}
+
+	realms, err := resolveLookupRealms(m.Request.Realms)
+	if err != nil {
+		m.fail(errorCodeInvalidRequest, err)
+		return
+	}
+
+	target, err := m.connect(reader, m.Request.CardTimeout)
+	if err != nil {
+		m.fail(connectErrorCode(err), err)
+		return
+	}
+
+	m.Logger.Info("Formatting tag...")
+
+	uid, err := reader.Format(m.ctx, target, systemSecret, realms, m.Logger)
+	if err != nil {
+		m.fail(errorCodeCardError, err)
+		return
+	}
+
+	m.setUID(uid)
+	m.setResult(&formatResult{
+		UID: uid,
+	})
+	m.Logger.Infof("Formatted tag with UID %s", uid)
+
+	m.Logger.Info("Success")
+	m.succeed()
+}
+
+func NewTaskFormat(request *formatRequest) (*taskFormat, error) {
+	base, err := newTaskBase(taskTypeFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	return &taskFormat{
+		taskBase: base,
+		Request:  request,
+	}, nil
+}
+
+func CreateFormatTask(c echo.Context) error {
+	req := new(formatRequest)
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+
+	task, err := NewTaskFormat(req)
+	if err != nil {
+		return err
+	}
+
+	register(c, task)
+	c.Logger().Info(fmt.Sprintf("Created '%s' task: %s", task.Type, task.ID.String()))
+	manager.Enqueue(task)
+
+	taskURL := c.Echo().URL(GetTask, task.ID.String())
+	c.Response().Header().Set(echo.HeaderLocation, taskURL)
+	return c.NoContent(http.StatusSeeOther)
+}
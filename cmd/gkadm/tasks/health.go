@@ -0,0 +1,124 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tasks
+
+import (
+	"github.com/ComputerScienceHouse/gatekeeper/device"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Represents the last known state of the reader, as reported by /healthz/nfc
+type readerHealth struct {
+	Healthy       bool               `json:"healthy"`
+	Reader        *device.ReaderInfo `json:"reader,omitempty"`
+	LastOpen      *time.Time         `json:"lastOpen,omitempty"`
+	LastError     string             `json:"lastError,omitempty"`
+	LastErrorAt   *time.Time         `json:"lastErrorAt,omitempty"`
+	LastCheckedAt *time.Time         `json:"lastCheckedAt,omitempty"`
+	InUse         bool               `json:"inUse"`
+	QueuedTasks   int                `json:"queuedTasks"`
+}
+
+// recordOpen updates the reader health with the result of opening it
+func (d *deviceManager) recordOpen(reader device.Reader, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	d.health.LastCheckedAt = &now
+
+	if err != nil {
+		d.health.Healthy = false
+		d.health.LastError = err.Error()
+		d.health.LastErrorAt = &now
+		return
+	}
+
+	info := reader.Info()
+	d.health.Healthy = true
+	d.health.Reader = &info
+	d.health.LastOpen = &now
+}
+
+// probe opens and closes the reader to refresh its health, unless a task
+// holds it or is waiting for it, in which case that task's open is recent
+// enough
+func (d *deviceManager) probe() {
+	d.mu.Lock()
+	if d.current != nil || len(d.queue) > 0 || d.probing {
+		d.mu.Unlock()
+		return
+	}
+
+	d.probing = true
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		d.probing = false
+		d.cond.Broadcast()
+		d.mu.Unlock()
+	}()
+
+	nullLog := log.New("")
+	nullLog.SetOutput(ioutil.Discard)
+
+	reader, err := openReader(*nullLog)
+	d.recordOpen(reader, err)
+	if err == nil {
+		_ = reader.Close(*nullLog)
+	}
+}
+
+// Returns the cached reader health without touching the reader
+func (d *deviceManager) Health() readerHealth {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	health := d.health
+	health.InUse = d.current != nil
+	health.QueuedTasks = len(d.queue)
+
+	return health
+}
+
+// Probes the reader every interval while it is idle, so that health checks
+// never have to open it themselves
+func StartNFCProber(interval time.Duration) {
+	go func() {
+		for {
+			manager.probe()
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Reports the last known state of the reader; responds 503 if it could not
+// be opened
+func GetNFCHealth(c echo.Context) error {
+	health := manager.Health()
+	if !health.Healthy {
+		return c.JSON(http.StatusServiceUnavailable, health)
+	}
+
+	return c.JSON(http.StatusOK, health)
+}
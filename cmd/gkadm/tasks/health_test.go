@@ -0,0 +1,127 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tasks
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/ComputerScienceHouse/gatekeeper/device"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// getNFCHealth requests the reader health from GetNFCHealth
+func getNFCHealth(t *testing.T) (int, readerHealth) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/healthz/nfc", nil), rec)
+	if err := GetNFCHealth(c); err != nil {
+		t.Fatal(err)
+	}
+
+	var health readerHealth
+	if err := json.Unmarshal(rec.Body.Bytes(), &health); err != nil {
+		t.Fatal(err)
+	}
+
+	return rec.Code, health
+}
+
+func TestNFCHealth(t *testing.T) {
+	defer func(previous *deviceManager) { manager = previous }(manager)
+	manager = newDeviceManager()
+
+	defer func(previous func(log.Logger) (device.Reader, error)) { openReader = previous }(openReader)
+	openReader = func(log.Logger) (device.Reader, error) {
+		return nil, errors.New("no reader attached")
+	}
+
+	// Unhealthy until the reader has been opened
+	if code, health := getNFCHealth(t); code != http.StatusServiceUnavailable || health.LastCheckedAt != nil {
+		t.Errorf("health before any check answered %d: %+v", code, health)
+	}
+
+	manager.probe()
+	if code, health := getNFCHealth(t); code != http.StatusServiceUnavailable || health.LastError != "no reader attached" || health.LastErrorAt == nil {
+		t.Errorf("health after a failed open answered %d: %+v", code, health)
+	}
+
+	openReader = func(log.Logger) (device.Reader, error) {
+		return device.NewEmulatedReader(), nil
+	}
+
+	manager.probe()
+	code, health := getNFCHealth(t)
+	if code != http.StatusOK || health.LastOpen == nil || health.Reader == nil || health.Reader.Connstring != "emulator" {
+		t.Errorf("health after an open answered %d: %+v", code, health)
+	}
+}
+
+func TestNFCProbeSkipsBusyReader(t *testing.T) {
+	defer func(previous *deviceManager) { manager = previous }(manager)
+	manager = newDeviceManager()
+
+	systemSecret := testKey(t, 32)
+	realm := testRealm(t, "test", 3, systemSecret)
+	reader := issuedReader(t, systemSecret, realm)
+
+	// The task holds the reader until released; any other open is counted
+	opens := make(chan struct{}, 2)
+	release := make(chan struct{})
+
+	defer func(previous func(log.Logger) (device.Reader, error)) { openReader = previous }(openReader)
+	openReader = func(log.Logger) (device.Reader, error) {
+		opens <- struct{}{}
+		<-release
+		return reader, nil
+	}
+
+	tk := newVerify(t, systemSecret, realm)
+	manager.Enqueue(tk)
+	<-opens
+
+	probed := make(chan struct{})
+	go func() {
+		manager.probe()
+		close(probed)
+	}()
+
+	select {
+	case <-probed:
+	case <-time.After(5 * time.Second):
+		t.Error("probe waited for the reader held by a task")
+	}
+
+	if len(opens) != 0 {
+		t.Error("probe opened the reader held by a task")
+	}
+
+	if _, health := getNFCHealth(t); !health.InUse {
+		t.Errorf("health while a task holds the reader: %+v", health)
+	}
+
+	close(release)
+	if record := waitForRecord(t, tk); record.State != taskStateSucceeded {
+		t.Errorf("task %s (%s), want %s", record.State, record.ErrorMessage, taskStateSucceeded)
+	}
+}
@@ -0,0 +1,193 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tasks
+
+import (
+	"github.com/google/uuid"
+	"github.com/labstack/echo"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Represents the persisted history of a task. The task request is never
+// recorded, so secrets submitted with a task do not outlive it.
+type taskRecord struct {
+	taskInfo
+	UID string     `json:"uid,omitempty"`
+	Log []logEvent `json:"log,omitempty"`
+}
+
+// Selects a page of task records, newest first
+type historyFilter struct {
+	Type   string
+	State  taskState
+	Offset int
+	Limit  int
+}
+
+// Represents a backend in which task records are kept
+type historyStore interface {
+	Save(record *taskRecord) error
+	Get(id uuid.UUID) (*taskRecord, error)
+	List(filter historyFilter) ([]*taskRecord, int, error)
+	Prune(before time.Time) (int, error)
+	Close() error
+}
+
+// Ensure each history backend conforms to the historyStore interface
+var (
+	_ historyStore = (*memoryHistory)(nil)
+	_ historyStore = (*boltHistory)(nil)
+)
+
+// Task records are kept in memory unless a history file is opened
+var history historyStore = newMemoryHistory()
+
+// Switches the task history to the BoltDB file at path
+func OpenHistory(path string) error {
+	store, err := openBoltHistory(path)
+	if err != nil {
+		return err
+	}
+
+	history = store
+	return nil
+}
+
+func CloseHistory() error {
+	return history.Close()
+}
+
+// Periodically removes records of tasks that finished more than retention ago
+func StartPruning(retention time.Duration, logger echo.Logger) {
+	interval := time.Hour
+	if retention < interval {
+		interval = retention
+	}
+
+	go func() {
+		for {
+			pruned, err := history.Prune(time.Now().Add(-retention))
+			if err != nil {
+				logger.Errorf("Unable to prune task history: %s", err)
+			} else if pruned > 0 {
+				logger.Infof("Pruned %d tasks from history", pruned)
+			}
+
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// filterRecords applies a history filter to an unordered set of records,
+// returning the requested page along with the total number of matches
+func filterRecords(records []*taskRecord, filter historyFilter) ([]*taskRecord, int) {
+	var matched []*taskRecord
+	for _, record := range records {
+		if filter.Type != "" && record.Type != filter.Type {
+			continue
+		}
+
+		if filter.State != "" && record.State != filter.State {
+			continue
+		}
+
+		matched = append(matched, record)
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].CreatedAt.After(matched[j].CreatedAt)
+	})
+
+	total := len(matched)
+	if filter.Offset >= total {
+		return make([]*taskRecord, 0), total
+	}
+
+	matched = matched[filter.Offset:]
+	if filter.Limit > 0 && filter.Limit < len(matched) {
+		matched = matched[:filter.Limit]
+	}
+
+	return matched, total
+}
+
+// finishedBefore reports whether a record is for a task that finished before t
+func finishedBefore(record *taskRecord, t time.Time) bool {
+	return record.FinishedAt != nil && record.FinishedAt.Before(t)
+}
+
+// Keeps task records in memory; they are lost when the server restarts
+type memoryHistory struct {
+	mu      sync.RWMutex
+	records map[uuid.UUID]*taskRecord
+}
+
+func newMemoryHistory() *memoryHistory {
+	return &memoryHistory{
+		records: make(map[uuid.UUID]*taskRecord),
+	}
+}
+
+func (h *memoryHistory) Save(record *taskRecord) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.records[record.ID] = record
+	return nil
+}
+
+func (h *memoryHistory) Get(id uuid.UUID) (*taskRecord, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.records[id], nil
+}
+
+func (h *memoryHistory) List(filter historyFilter) ([]*taskRecord, int, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	records := make([]*taskRecord, 0, len(h.records))
+	for _, record := range h.records {
+		records = append(records, record)
+	}
+
+	page, total := filterRecords(records, filter)
+	return page, total, nil
+}
+
+func (h *memoryHistory) Prune(before time.Time) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	pruned := 0
+	for id, record := range h.records {
+		if finishedBefore(record, before) {
+			delete(h.records, id)
+			pruned++
+		}
+	}
+
+	return pruned, nil
+}
+
+func (h *memoryHistory) Close() error {
+	return nil
+}
@@ -0,0 +1,330 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tasks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/ComputerScienceHouse/gatekeeper/device"
+	"github.com/ComputerScienceHouse/gatekeeper/keys"
+	"github.com/ComputerScienceHouse/gatekeeper/sig"
+	"github.com/google/uuid"
+	"go.etcd.io/bbolt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// tempHistory opens a BoltDB history in a temporary directory, returning its path
+func tempHistory(t *testing.T) (*boltHistory, string, func()) {
+	dir, err := ioutil.TempDir("", "gkadm-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "history.db")
+	store, err := openBoltHistory(path)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return store, path, func() {
+		_ = store.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// testRecord creates a task record, finished at the given time unless it is zero
+func testRecord(taskType string, state taskState, createdAt, finishedAt time.Time) *taskRecord {
+	record := &taskRecord{
+		taskInfo: taskInfo{
+			ID:   uuid.New(),
+			Type: taskType,
+			taskStatus: taskStatus{
+				State:     state,
+				CreatedAt: createdAt,
+			},
+		},
+	}
+
+	if !finishedAt.IsZero() {
+		record.FinishedAt = &finishedAt
+	}
+
+	return record
+}
+
+// forEachHistory runs a test against each history backend
+func forEachHistory(t *testing.T, test func(t *testing.T, store historyStore)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, newMemoryHistory())
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		store, _, cleanup := tempHistory(t)
+		defer cleanup()
+
+		test(t, store)
+	})
+}
+
+func TestHistoryList(t *testing.T) {
+	forEachHistory(t, func(t *testing.T, store historyStore) {
+		start := time.Now().Add(-time.Hour)
+
+		// Alternating issue and format tasks, where every third task failed
+		var saved []*taskRecord
+		for i := 0; i < 6; i++ {
+			taskType, state := taskTypeIssue, taskStateSucceeded
+			if i%2 == 1 {
+				taskType = taskTypeFormat
+			}
+			if i%3 == 2 {
+				state = taskStateFailed
+			}
+
+			created := start.Add(time.Duration(i) * time.Minute)
+			record := testRecord(taskType, state, created, created.Add(time.Second))
+			if err := store.Save(record); err != nil {
+				t.Fatal(err)
+			}
+
+			saved = append(saved, record)
+		}
+
+		tests := []struct {
+			name   string
+			filter historyFilter
+			want   []int
+			total  int
+		}{
+			{"all", historyFilter{}, []int{5, 4, 3, 2, 1, 0}, 6},
+			{"first page", historyFilter{Limit: 2}, []int{5, 4}, 6},
+			{"second page", historyFilter{Offset: 2, Limit: 2}, []int{3, 2}, 6},
+			{"past the end", historyFilter{Offset: 6, Limit: 2}, []int{}, 6},
+			{"by type", historyFilter{Type: taskTypeFormat}, []int{5, 3, 1}, 3},
+			{"by state", historyFilter{State: taskStateFailed}, []int{5, 2}, 2},
+			{"by type and state", historyFilter{Type: taskTypeIssue, State: taskStateSucceeded, Limit: 1}, []int{4}, 2},
+		}
+
+		for _, test := range tests {
+			page, total, err := store.List(test.filter)
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+
+			if total != test.total {
+				t.Errorf("%s: total %d, want %d", test.name, total, test.total)
+			}
+
+			if len(page) != len(test.want) {
+				t.Errorf("%s: got %d records, want %d", test.name, len(page), len(test.want))
+				continue
+			}
+
+			for i, index := range test.want {
+				if page[i].ID != saved[index].ID {
+					t.Errorf("%s: record %d is %s, want %s", test.name, i, page[i].ID, saved[index].ID)
+				}
+			}
+		}
+	})
+}
+
+func TestHistoryPrune(t *testing.T) {
+	forEachHistory(t, func(t *testing.T, store historyStore) {
+		now := time.Now()
+		old := testRecord(taskTypeIssue, taskStateSucceeded, now.Add(-48*time.Hour), now.Add(-47*time.Hour))
+		recent := testRecord(taskTypeIssue, taskStateFailed, now.Add(-time.Hour), now.Add(-time.Hour))
+		running := testRecord(taskTypeIssue, taskStateRunning, now.Add(-72*time.Hour), time.Time{})
+
+		for _, record := range []*taskRecord{old, recent, running} {
+			if err := store.Save(record); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		pruned, err := store.Prune(now.Add(-24 * time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if pruned != 1 {
+			t.Errorf("pruned %d records, want 1", pruned)
+		}
+
+		// Unfinished tasks are kept however old they are
+		for _, record := range []*taskRecord{old, recent, running} {
+			stored, err := store.Get(record.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if kept := stored != nil; kept != (record != old) {
+				t.Errorf("record finished at %v kept: %t", record.FinishedAt, kept)
+			}
+		}
+	})
+}
+
+func TestBoltHistoryMarksInterrupted(t *testing.T) {
+	store, path, cleanup := tempHistory(t)
+	defer cleanup()
+
+	now := time.Now()
+	finished := testRecord(taskTypeIssue, taskStateSucceeded, now, now)
+	running := testRecord(taskTypeIssue, taskStateRunning, now, time.Time{})
+	pending := testRecord(taskTypeFormat, taskStatePending, now, time.Time{})
+
+	for _, record := range []*taskRecord{finished, running, pending} {
+		if err := store.Save(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Reopen the history, as if the server had restarted
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openBoltHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	for _, record := range []*taskRecord{running, pending} {
+		stored, err := reopened.Get(record.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stored.State != taskStateFailed || stored.ErrorCode != errorCodeInterrupted || stored.FinishedAt == nil {
+			t.Errorf("%s task reopened as %s (%s), want %s (%s)", record.State, stored.State, stored.ErrorCode, taskStateFailed, errorCodeInterrupted)
+		}
+	}
+
+	stored, err := reopened.Get(finished.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.State != taskStateSucceeded || stored.ErrorCode != "" {
+		t.Errorf("finished task reopened as %s (%s), want %s", stored.State, stored.ErrorCode, taskStateSucceeded)
+	}
+}
+
+func TestIssueRecordHasNoKeys(t *testing.T) {
+	store, _, cleanup := tempHistory(t)
+	defer cleanup()
+
+	defer func(previous historyStore) { history = previous }(history)
+	history = store
+
+	secret := func() []byte {
+		key := make([]byte, 16)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+
+		return key
+	}
+
+	systemSecret, authKey, readKey, updateKey := secret(), secret(), secret(), secret()
+	privateKey, _, err := sig.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encodedPrivateKey, err := sig.EncodePrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encodedPublicKey, err := sig.EncodePublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tk, err := NewTaskIssue(&issueRequest{
+		taskOptions:  taskOptions{CardTimeout: 5},
+		SystemSecret: keys.Encode(systemSecret),
+		Realms: []issueRequestRealm{{
+			Name:          "test",
+			Slot:          1,
+			AssociationId: uuid.New().String(),
+			AuthKey:       keys.Encode(authKey),
+			ReadKey:       keys.Encode(readKey),
+			UpdateKey:     keys.Encode(updateKey),
+			PublicKey:     *encodedPublicKey,
+			PrivateKey:    *encodedPrivateKey,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tag, err := device.NewRandomEmulatedTag()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := device.NewEmulatedReader()
+	reader.Present(tag)
+
+	tk.base().start()
+	tk.Run(reader)
+	archive(tk)
+
+	if state := tk.Info().State; state != taskStateSucceeded {
+		t.Fatalf("issue task %s: %s", state, tk.Info().ErrorMessage)
+	}
+
+	// Check the raw bytes stored for the task, rather than the decoded record
+	var stored []byte
+	err = store.db.View(func(tx *bbolt.Tx) error {
+		stored = append(stored, tx.Bucket(tasksBucket).Get(tk.ID[:])...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored) == 0 {
+		t.Fatal("issue task was not saved")
+	}
+
+	material := map[string][]byte{
+		"system secret":      []byte(keys.Encode(systemSecret)),
+		"auth key":           []byte(keys.Encode(authKey)),
+		"read key":           []byte(keys.Encode(readKey)),
+		"update key":         []byte(keys.Encode(updateKey)),
+		"private key":        []byte(*encodedPrivateKey),
+		"private key header": []byte("PRIVATE KEY"),
+		"private key scalar": []byte(keys.Encode(privateKey.D.Bytes())),
+	}
+
+	for name, value := range material {
+		if bytes.Contains(stored, value) {
+			t.Errorf("stored task contains the %s", name)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tasks
+
+import (
+	"fmt"
+	"github.com/ComputerScienceHouse/gatekeeper/device"
+	"github.com/labstack/echo"
+	"net/http"
+)
+
+const taskTypeInspect = "inspect"
+
+type inspectRequest struct {
+	taskOptions
+	SystemSecret string              `json:"systemSecret"`
+	Realms       []issueRequestRealm `json:"realms"`
+}
+
+type taskInspect struct {
+	*taskBase
+	Request *inspectRequest
+}
+
+func (m *taskInspect) Run(reader device.Reader) {
+	m.Logger.Info("Parsing inspect request...")
+
+	// The system secret is optional, and only used to list the contents of issued tags
+	var systemSecret []byte
+
+	if hasSystemSecret(m.Request.SystemSecret) {
+		decodedSecret, err := resolveSystemSecret(m.Request.SystemSecret)
+		if err != nil {
+			m.fail(errorCodeInvalidRequest, err)
+			return
+		}
+
+		systemSecret = decodedSecret
+	}
+
+	var realms []device.Realm
+
+	for _, realm := range m.Request.Realms {
+		parsedRealm, err := resolveRealm(realm)
+		if err != nil {
+			m.fail(errorCodeInvalidRequest, err)
+			return
+		}
+
+		realms = append(realms, *parsedRealm)
+	}
+
+	target, err := m.connect(reader, m.Request.CardTimeout)
+	if err != nil {
+		m.fail(connectErrorCode(err), err)
+		return
+	}
+
+	m.Logger.Info("Inspecting tag...")
+
+	info, err := reader.Inspect(m.ctx, target, systemSecret, realms, m.Logger)
+	if err != nil {
+		m.fail(errorCodeCardError, err)
+		return
+	}
+
+	m.setUID(info.UID)
+	m.setResult(info)
+	m.Logger.Infof("Tag UID: %s (random UID: %t)", info.UID, info.RandomUID)
+	m.Logger.Infof("Free memory: %d bytes", info.FreeMemory)
+
+	for _, app := range info.Applications {
+		m.Logger.Infof("Application %s in slot %d: %d file(s)", app.AID, app.Slot, len(app.Files))
+	}
+
+	for _, realm := range info.Realms {
+		if realm.Authenticated {
+			m.Logger.Infof("Realm '%s' authenticated with UUID %s (matches: %t)", realm.Name, realm.AssociationID, realm.Matches)
+		} else {
+			m.Logger.Warnf("Realm '%s' failed to authenticate: %s", realm.Name, realm.Error)
+		}
+	}
+
+	for _, infoErr := range info.Errors {
+		m.Logger.Warnf("%s", infoErr)
+	}
+
+	m.Logger.Info("Success")
+	m.succeed()
+}
+
+func NewTaskInspect(request *inspectRequest) (*taskInspect, error) {
+	base, err := newTaskBase(taskTypeInspect)
+	if err != nil {
+		return nil, err
+	}
+
+	return &taskInspect{
+		taskBase: base,
+		Request:  request,
+	}, nil
+}
+
+func CreateInspectTask(c echo.Context) error {
+	req := new(inspectRequest)
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+
+	task, err := NewTaskInspect(req)
+	if err != nil {
+		return err
+	}
+
+	register(c, task)
+	c.Logger().Info(fmt.Sprintf("Created '%s' task: %s", task.Type, task.ID.String()))
+	manager.Enqueue(task)
+
+	taskURL := c.Echo().URL(GetTask, task.ID.String())
+	c.Response().Header().Set(echo.HeaderLocation, taskURL)
+	return c.NoContent(http.StatusSeeOther)
+}
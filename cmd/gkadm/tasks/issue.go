@@ -25,18 +25,29 @@ import (
 	"github.com/ComputerScienceHouse/gatekeeper/sig"
 	"github.com/google/uuid"
 	"github.com/labstack/echo"
-	"github.com/labstack/gommon/log"
 	"net/http"
+	"time"
 )
 
 const taskTypeIssue = "issue"
 
 type issueRequest struct {
+	taskOptions
 	SystemSecret string              `json:"systemSecret"`
 	Realms       []issueRequestRealm `json:"realms"`
+	Overwrite    bool                `json:"overwrite"`
+
+	// Realms already on the tag, used only to retrieve the real UID of tags
+	// with random UIDs enabled, i.e. any tag which has been issued before.
+	// Each needs just an ID, or a slot and read key; when none are given,
+	// every realm in the keystore is tried.
+	ExistingRealms []issueRequestRealm `json:"existingRealms"`
 }
 
+// Represents a realm in a request, either referenced by the ID or name of
+// a realm in the keystore, or with its keys inline
 type issueRequestRealm struct {
+	ID            string `json:"id"`
 	Name          string `json:"name"`
 	Slot          int    `json:"slot"`
 	AssociationId string `json:"associationId"`
@@ -47,150 +58,156 @@ type issueRequestRealm struct {
 	PrivateKey    string `json:"privateKey"`
 }
 
-type taskIssue struct {
-	ID      uuid.UUID     `json:"id"`
-	Type    string        `json:"type"`
-	Request *issueRequest `json:"-"`
-	Output  chanWriter    `json:"-"`
-	Logger  log.Logger    `json:"-"`
-}
+func parseSlot(slot int) (uint32, error) {
+	if slot < 0 || slot > 15 {
+		return 0, errors.New("invalid slot number for realm, must be between 0-14")
+	}
 
-func (m *taskIssue) TaskType() string {
-	return taskTypeIssue
+	return uint32(slot), nil
 }
 
-func (m *taskIssue) GetOutput() chanWriter {
-	return m.Output
-}
+func parseRealm(realm issueRequestRealm) (*device.Realm, error) {
+	slot, err := parseSlot(realm.Slot)
+	if err != nil {
+		return nil, err
+	}
+
+	associationId, err := uuid.Parse(realm.AssociationId)
+	if err != nil {
+		return nil, err
+	}
+
+	authKey, err := keys.Decode(realm.AuthKey)
+	if err != nil {
+		return nil, err
+	}
+
+	readKey, err := keys.Decode(realm.ReadKey)
+	if err != nil {
+		return nil, err
+	}
+
+	updateKey, err := keys.Decode(realm.UpdateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, publicKey, err := sig.Decode(realm.PrivateKey, realm.PublicKey)
+	if err != nil {
+		return nil, err
+	}
 
-func (m *taskIssue) LogError(err error) {
-	m.Logger.Errorf("[ERROR] %s", err)
-	m.Logger.Errorf("Aborting")
+	return &device.Realm{
+		Name:          realm.Name,
+		Slot:          slot,
+		AssociationID: associationId,
+		AuthKey:       authKey,
+		ReadKey:       readKey,
+		UpdateKey:     updateKey,
+		PublicKey:     publicKey,
+		PrivateKey:    privateKey,
+	}, nil
 }
 
-func (m *taskIssue) Run() {
-	m.Logger.Info("Parsing issue request...")
+// parseLookupRealm parses a realm which is only used to authenticate with its
+// read key, so needs no association ID or other keys
+func parseLookupRealm(realm issueRequestRealm) (*device.Realm, error) {
+	slot, err := parseSlot(realm.Slot)
+	if err != nil {
+		return nil, err
+	}
 
-	systemSecret, err := keys.Decode(m.Request.SystemSecret)
+	readKey, err := keys.Decode(realm.ReadKey)
 	if err != nil {
-		m.LogError(err)
-		return
+		return nil, err
 	}
 
-	var realms []device.Realm
+	return &device.Realm{
+		Name:    realm.Name,
+		Slot:    slot,
+		ReadKey: readKey,
+	}, nil
+}
 
-	for _, realm := range m.Request.Realms {
-		if realm.Slot < 0 || realm.Slot > 15 {
-			m.LogError(errors.New("invalid slot number for realm, must be between 0-14"))
-			return
-		}
+type issueResult struct {
+	UID     string   `json:"uid"`
+	Slots   []uint32 `json:"slots"`
+	Skipped []uint32 `json:"skipped"`
+}
 
-		slot := uint32(realm.Slot)
+type taskIssue struct {
+	*taskBase
+	Request *issueRequest
+}
 
-		associationId, err := uuid.Parse(realm.AssociationId)
-		if err != nil {
-			m.LogError(err)
-			return
-		}
+func (m *taskIssue) Run(reader device.Reader) {
+	defer m.observeDuration(time.Now())
 
-		authKey, err := keys.Decode(realm.AuthKey)
-		if err != nil {
-			m.LogError(err)
-			return
-		}
+	m.Logger.Info("Parsing issue request...")
 
-		readKey, err := keys.Decode(realm.ReadKey)
-		if err != nil {
-			m.LogError(err)
-			return
-		}
+	systemSecret, err := resolveSystemSecret(m.Request.SystemSecret)
+	if err != nil {
+		m.fail(errorCodeInvalidRequest, err)
+		return
+	}
 
-		updateKey, err := keys.Decode(realm.UpdateKey)
-		if err != nil {
-			m.LogError(err)
-			return
-		}
+	var realms []device.Realm
 
-		privateKey, publicKey, err := sig.Decode(realm.PrivateKey, realm.PublicKey)
+	for _, realm := range m.Request.Realms {
+		parsedRealm, err := resolveRealm(realm)
 		if err != nil {
-			m.LogError(err)
+			m.fail(errorCodeInvalidRequest, err)
 			return
 		}
 
-		realms = append(realms, device.Realm{
-			Name:          realm.Name,
-			Slot:          slot,
-			AssociationID: associationId,
-			AuthKey:       authKey,
-			ReadKey:       readKey,
-			UpdateKey:     updateKey,
-			PublicKey:     publicKey,
-			PrivateKey:    privateKey,
-		})
+		realms = append(realms, *parsedRealm)
 	}
 
-	m.Logger.Info("Opening NFC device...")
-
-	nfcDevice, err := device.OpenNFCDevice(m.Logger)
+	existingRealms, err := resolveLookupRealms(m.Request.ExistingRealms)
 	if err != nil {
-		m.LogError(err)
+		m.fail(errorCodeInvalidRequest, err)
 		return
 	}
 
-	target, err := nfcDevice.Connect(m.Logger)
+	target, err := m.connect(reader, m.Request.CardTimeout)
 	if err != nil {
-		m.LogError(err)
-		err = nfcDevice.Close(m.Logger)
-		if err != nil {
-			m.LogError(err)
-		}
+		m.fail(connectErrorCode(err), err)
 		return
 	}
 
 	m.Logger.Info("Writing tag...")
 
-	err = nfcDevice.Issue(*target, systemSecret, realms, m.Logger)
+	result, err := reader.Issue(m.ctx, target, systemSecret, realms, existingRealms, m.Request.Overwrite, m.Logger)
 	if err != nil {
-		m.LogError(err)
-		err = nfcDevice.Close(m.Logger)
-		if err != nil {
-			m.LogError(err)
-		}
+		m.fail(errorCodeCardError, err)
 		return
 	}
 
-	m.Logger.Info("Closing NFC device...")
+	m.setUID(result.UID)
+	m.setResult(&issueResult{
+		UID:     result.UID,
+		Slots:   result.Written,
+		Skipped: result.Skipped,
+	})
+	m.Logger.Infof("Issued slots %v to tag with UID %s", result.Written, result.UID)
 
-	err = nfcDevice.Close(m.Logger)
-	if err != nil {
-		m.LogError(err)
-		err = nfcDevice.Close(m.Logger)
-		if err != nil {
-			m.LogError(err)
-		}
-		return
+	if len(result.Skipped) > 0 {
+		m.Logger.Warnf("Skipped existing slots %v", result.Skipped)
 	}
 
 	m.Logger.Info("Success")
+	m.succeed()
 }
 
 func NewTaskIssue(request *issueRequest) (*taskIssue, error) {
-	id, err := uuid.NewRandom()
+	base, err := newTaskBase(taskTypeIssue)
 	if err != nil {
 		return nil, err
 	}
 
-	output := newChanWriter()
-	logger := log.New(fmt.Sprintf("issue_%s", id))
-	logger.SetHeader("[${level}]")
-	logger.SetOutput(output)
-
 	return &taskIssue{
-		ID:      id,
-		Type:    taskTypeIssue,
-		Request: request,
-		Output:  *output,
-		Logger:  *logger,
+		taskBase: base,
+		Request:  request,
 	}, nil
 }
 
@@ -205,9 +222,9 @@ func CreateIssueTask(c echo.Context) error {
 		return err
 	}
 
-	taskStore[task.ID] = task
+	register(c, task)
 	c.Logger().Info(fmt.Sprintf("Created '%s' task: %s", task.Type, task.ID.String()))
-	go task.Run()
+	manager.Enqueue(task)
 
 	taskURL := c.Echo().URL(GetTask, task.ID.String())
 	c.Response().Header().Set(echo.HeaderLocation, taskURL)
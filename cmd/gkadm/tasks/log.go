@@ -0,0 +1,167 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tasks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Task loggers emit each line as a JSON object, which logBuffer parses into
+// a logEvent
+const taskLogHeader = `{"time":"${time_rfc3339_nano}","level":"${level}"}`
+
+// Represents a single line of a task's log
+type logEvent struct {
+	Level     string    `json:"level"`
+	Timestamp time.Time `json:"timestamp"`
+	Message   string    `json:"message"`
+}
+
+// parseLogEvent decodes a line written by a task logger. Lines which are
+// not JSON are kept verbatim as info messages.
+func parseLogEvent(line string) logEvent {
+	var raw struct {
+		Time    time.Time `json:"time"`
+		Level   string    `json:"level"`
+		Message string    `json:"message"`
+	}
+
+	if err := json.Unmarshal([]byte(line), &raw); err != nil {
+		return logEvent{
+			Level:     "info",
+			Timestamp: time.Now(),
+			Message:   line,
+		}
+	}
+
+	return logEvent{
+		Level:     strings.ToLower(raw.Level),
+		Timestamp: raw.Time,
+		Message:   raw.Message,
+	}
+}
+
+// Formats the event as a plain text line, as sent to websocket clients
+func (e logEvent) String() string {
+	return fmt.Sprintf("[%s] %s\n", strings.ToUpper(e.Level), e.Message)
+}
+
+// Holds every line logged by a task. Writes never block; any number of
+// subscribers may read the log from any offset, and are told when the log
+// has ended because the task finished.
+type logBuffer struct {
+	mu     sync.Mutex
+	events []logEvent
+	closed bool
+	notify chan struct{}
+}
+
+func newLogBuffer() *logBuffer {
+	return &logBuffer{notify: make(chan struct{})}
+}
+
+// newClosedLogBuffer returns an ended log holding the given events
+func newClosedLogBuffer(events []logEvent) *logBuffer {
+	b := newLogBuffer()
+	b.events = events
+	b.closed = true
+	close(b.notify)
+
+	return b
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		// Late writes, such as from a goroutine outliving its task, are dropped
+		return len(p), nil
+	}
+
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		b.events = append(b.events, parseLogEvent(line))
+	}
+	b.wake()
+
+	return len(p), nil
+}
+
+// Ends the log, releasing any waiting subscribers
+func (b *logBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.closed {
+		b.closed = true
+		close(b.notify)
+	}
+
+	return nil
+}
+
+// wake releases subscribers waiting for new lines; callers must hold b.mu
+func (b *logBuffer) wake() {
+	close(b.notify)
+	b.notify = make(chan struct{})
+}
+
+// Returns a copy of the events logged so far, from offset onwards
+func (b *logBuffer) Events(offset int) []logEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if offset >= len(b.events) {
+		return nil
+	}
+
+	return append([]logEvent(nil), b.events[offset:]...)
+}
+
+// Returns the events logged from offset onwards, waiting until at least one
+// is available. ok is false once the log has ended and no events remain, or
+// if ctx is done first.
+func (b *logBuffer) Read(ctx context.Context, offset int) (events []logEvent, ok bool) {
+	for {
+		b.mu.Lock()
+		if offset < len(b.events) {
+			events = append([]logEvent(nil), b.events[offset:]...)
+			b.mu.Unlock()
+			return events, true
+		}
+
+		closed := b.closed
+		notify := b.notify
+		b.mu.Unlock()
+
+		if closed {
+			return nil, false
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-notify:
+		}
+	}
+}
@@ -0,0 +1,163 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readAll reads the log from offset until it ends, returning the messages read
+func readAll(b *logBuffer, offset int) []string {
+	var messages []string
+	for {
+		events, ok := b.Read(context.Background(), offset)
+		if !ok {
+			return messages
+		}
+
+		for _, event := range events {
+			messages = append(messages, event.Message)
+		}
+
+		offset += len(events)
+	}
+}
+
+func checkMessages(t *testing.T, name string, messages []string, first, count int) {
+	t.Helper()
+
+	if len(messages) != count {
+		t.Errorf("%s read %d lines, want %d", name, len(messages), count)
+		return
+	}
+
+	for i, message := range messages {
+		if want := fmt.Sprintf("line %d", first+i); message != want {
+			t.Errorf("%s line %d is %q, want %q", name, i, message, want)
+			return
+		}
+	}
+}
+
+func TestLogBufferSubscribers(t *testing.T) {
+	const lines = 200
+
+	b := newLogBuffer()
+	results := make([][]string, 3)
+
+	var wg sync.WaitGroup
+	subscribe := func(i int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = readAll(b, 0)
+		}()
+	}
+
+	// Two subscribers follow the log from the start
+	subscribe(0)
+	subscribe(1)
+
+	for i := 0; i < lines; i++ {
+		if i == lines/2 {
+			// A late joiner still reads the log from the start
+			subscribe(2)
+		}
+
+		if _, err := fmt.Fprintf(b, "line %d\n", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscribers were not released when the log ended")
+	}
+
+	for i, messages := range results {
+		checkMessages(t, fmt.Sprintf("subscriber %d", i), messages, 0, lines)
+	}
+}
+
+func TestLogBufferOffsets(t *testing.T) {
+	b := newLogBuffer()
+
+	// Multiple lines in one write are separate events
+	if _, err := fmt.Fprint(b, "line 0\nline 1\nline 2\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fmt.Fprintf(b, `{"time":"2019-01-01T00:00:00Z","level":"WARN","message":"line 3"}`+"\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Task loggers write JSON lines, which are decoded
+	events := b.Events(3)
+	if len(events) != 1 || events[0].Level != "warn" || events[0].Message != "line 3" {
+		t.Errorf("decoded events %+v, want a single warn event", events)
+	}
+
+	// Reading resumes from an offset
+	events, ok := b.Read(context.Background(), 2)
+	if !ok || len(events) != 2 || events[0].Message != "line 2" {
+		t.Errorf("read from offset 2 returned %+v (%t), want lines 2-3", events, ok)
+	}
+
+	// Readers wait at the end of an open log, until their context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if events, ok := b.Read(ctx, 4); ok || len(events) != 0 {
+		t.Errorf("read past the end of an open log returned %+v (%t), want to time out", events, ok)
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes after the log ends are dropped
+	if _, err := fmt.Fprint(b, "line 4\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	checkMessages(t, "reader from offset 1", readAll(b, 1), 1, 3)
+
+	if events, ok := b.Read(context.Background(), 4); ok || len(events) != 0 {
+		t.Errorf("read past the end of an ended log returned %+v (%t), want the end of the log", events, ok)
+	}
+
+	// Closing twice is harmless
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,161 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tasks
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ComputerScienceHouse/gatekeeper/cmd/gkadm/auth"
+	"github.com/labstack/echo"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"strconv"
+)
+
+const (
+	mimeEventStream = "text/event-stream"
+	mimeJSONLines   = "application/x-ndjson"
+)
+
+// Sends each log line as a websocket text message
+func streamLogWebsocket(c echo.Context, output *logBuffer, offset int) error {
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer func() {
+			err := ws.Close()
+			if err != nil {
+				c.Logger().Error(err)
+			}
+		}()
+
+		c.Logger().Info(fmt.Sprintf("WebSocket connected: %s", auth.RedactedURI(c.Request())))
+
+		ctx := c.Request().Context()
+		for {
+			events, ok := output.Read(ctx, offset)
+			if !ok {
+				// The task finished and its whole log has been sent
+				return
+			}
+
+			for _, event := range events {
+				err := websocket.Message.Send(ws, event.String())
+				if err != nil {
+					c.Logger().Error(err)
+					return
+				}
+			}
+
+			offset += len(events)
+		}
+	}).ServeHTTP(c.Response(), c.Request())
+
+	return nil
+}
+
+// Writes the given events as JSON lines
+func writeLogLines(c echo.Context, events []logEvent) error {
+	c.Response().Header().Set(echo.HeaderContentType, mimeJSONLines)
+	c.Response().WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(c.Response())
+	for _, event := range events {
+		if err := enc.Encode(event); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Streams events as JSON lines until the task finishes
+func streamLogLines(c echo.Context, output *logBuffer, offset int) error {
+	c.Response().Header().Set(echo.HeaderContentType, mimeJSONLines)
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	c.Response().WriteHeader(http.StatusOK)
+	c.Response().Flush()
+
+	enc := json.NewEncoder(c.Response())
+	ctx := c.Request().Context()
+	for {
+		events, ok := output.Read(ctx, offset)
+		if !ok {
+			return nil
+		}
+
+		for _, event := range events {
+			if err := enc.Encode(event); err != nil {
+				return err
+			}
+		}
+
+		c.Response().Flush()
+		offset += len(events)
+	}
+}
+
+// Streams events as Server-Sent Events until the task finishes. Each event
+// carries its offset as its ID, so reconnecting clients resume where they
+// left off; an "end" event marks the end of the log.
+func streamLogEvents(c echo.Context, output *logBuffer, offset int) error {
+	if lastID := c.Request().Header.Get("Last-Event-ID"); lastID != "" {
+		id, err := strconv.Atoi(lastID)
+		if err != nil || id < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid Last-Event-ID")
+		}
+
+		offset = id + 1
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, mimeEventStream)
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	c.Response().WriteHeader(http.StatusOK)
+	c.Response().Flush()
+
+	ctx := c.Request().Context()
+	for {
+		events, ok := output.Read(ctx, offset)
+		if !ok {
+			break
+		}
+
+		for _, event := range events {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+
+			_, err = fmt.Fprintf(c.Response(), "id: %d\nevent: log\ndata: %s\n\n", offset, data)
+			if err != nil {
+				return err
+			}
+
+			offset++
+		}
+
+		c.Response().Flush()
+	}
+
+	if ctx.Err() != nil {
+		// The client went away
+		return nil
+	}
+
+	_, err := fmt.Fprint(c.Response(), "event: end\ndata: {}\n\n")
+	c.Response().Flush()
+	return err
+}
@@ -0,0 +1,240 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tasks
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/labstack/echo"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func logServer() *httptest.Server {
+	e := echo.New()
+	e.GET("/tasks/:id/log", GetTaskLog)
+	return httptest.NewServer(e)
+}
+
+// archivedTask saves a finished task with the given log lines to the task history
+func archivedTask(t *testing.T, lines int) uuid.UUID {
+	record := testRecord(taskTypeIssue, taskStateSucceeded, time.Now(), time.Now())
+	for i := 0; i < lines; i++ {
+		record.Log = append(record.Log, logEvent{Level: "info", Timestamp: time.Now(), Message: fmt.Sprintf("line %d", i)})
+	}
+
+	if err := history.Save(record); err != nil {
+		t.Fatal(err)
+	}
+
+	return record.ID
+}
+
+func getLog(t *testing.T, server *httptest.Server, id uuid.UUID, query string, header http.Header) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/tasks/%s/log%s", server.URL, id, query), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+// sseEvent is a single Server-Sent Event
+type sseEvent struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+// readEvents reads Server-Sent Events until the end event or the stream closes
+func readEvents(t *testing.T, resp *http.Response) []sseEvent {
+	defer resp.Body.Close()
+
+	var events []sseEvent
+	var current sseEvent
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			events = append(events, current)
+			if current.Event == "end" {
+				return events
+			}
+			current = sseEvent{}
+		case strings.HasPrefix(line, "id: "):
+			current.ID = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			current.Event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			current.Data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Error(err)
+	}
+
+	return events
+}
+
+func checkEvents(t *testing.T, events []sseEvent, first, count int) {
+	t.Helper()
+
+	if len(events) != count+1 {
+		t.Fatalf("read %d events, want %d log events and an end event", len(events), count)
+	}
+
+	for i, event := range events[:count] {
+		var decoded logEvent
+		if err := json.Unmarshal([]byte(event.Data), &decoded); err != nil {
+			t.Fatal(err)
+		}
+
+		if event.Event != "log" || event.ID != fmt.Sprint(first+i) || decoded.Message != fmt.Sprintf("line %d", first+i) {
+			t.Errorf("event %d is %+v, want log event %d", i, event, first+i)
+		}
+	}
+
+	if end := events[count]; end.Event != "end" {
+		t.Errorf("last event is %+v, want the end event", end)
+	}
+}
+
+func TestStreamLogEventsResume(t *testing.T) {
+	server := logServer()
+	defer server.Close()
+
+	id := archivedTask(t, 5)
+	sse := http.Header{echo.HeaderAccept: {mimeEventStream}}
+
+	resp := getLog(t, server, id, "", sse)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(echo.HeaderContentType) != mimeEventStream {
+		t.Fatalf("got %d %s, want an event stream", resp.StatusCode, resp.Header.Get(echo.HeaderContentType))
+	}
+	checkEvents(t, readEvents(t, resp), 0, 5)
+
+	// Reconnecting clients resume after the last event they received
+	resumed := http.Header{echo.HeaderAccept: {mimeEventStream}, "Last-Event-Id": {"2"}}
+	checkEvents(t, readEvents(t, getLog(t, server, id, "", resumed)), 3, 2)
+
+	// As do clients passing an offset
+	checkEvents(t, readEvents(t, getLog(t, server, id, "?offset=4", sse)), 4, 1)
+
+	// A client which has seen every event just gets the end event
+	caughtUp := http.Header{echo.HeaderAccept: {mimeEventStream}, "Last-Event-Id": {"4"}}
+	checkEvents(t, readEvents(t, getLog(t, server, id, "", caughtUp)), 5, 0)
+
+	invalid := http.Header{echo.HeaderAccept: {mimeEventStream}, "Last-Event-Id": {"abc"}}
+	resp = getLog(t, server, id, "", invalid)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid Last-Event-ID returned %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestStreamLogLines(t *testing.T) {
+	server := logServer()
+	defer server.Close()
+
+	id := archivedTask(t, 3)
+
+	resp := getLog(t, server, id, "?offset=1&follow=false", nil)
+	defer resp.Body.Close()
+
+	if resp.Header.Get(echo.HeaderContentType) != mimeJSONLines {
+		t.Errorf("content type %s, want %s", resp.Header.Get(echo.HeaderContentType), mimeJSONLines)
+	}
+
+	var messages []string
+	decoder := json.NewDecoder(resp.Body)
+	for decoder.More() {
+		var event logEvent
+		if err := decoder.Decode(&event); err != nil {
+			t.Fatal(err)
+		}
+
+		messages = append(messages, event.Message)
+	}
+
+	checkMessages(t, "JSON lines reader", messages, 1, 2)
+}
+
+func TestStreamLogEventsFollow(t *testing.T) {
+	server := logServer()
+	defer server.Close()
+
+	tk, err := NewTaskFormat(&formatRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	activeTasksMu.Lock()
+	activeTasks[tk.ID] = tk
+	activeTasksMu.Unlock()
+
+	defer func() {
+		activeTasksMu.Lock()
+		delete(activeTasks, tk.ID)
+		activeTasksMu.Unlock()
+	}()
+
+	sse := http.Header{echo.HeaderAccept: {mimeEventStream}}
+	results := make(chan []sseEvent, 2)
+	for i := 0; i < 2; i++ {
+		resp := getLog(t, server, tk.ID, "", sse)
+		go func() {
+			results <- readEvents(t, resp)
+		}()
+	}
+
+	// Lines logged while subscribers are connected are streamed to each of them
+	for i := 0; i < 3; i++ {
+		if _, err := fmt.Fprintf(tk.Output, "line %d\n", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tk.Output.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case events := <-results:
+			checkEvents(t, events, 0, 3)
+		case <-time.After(5 * time.Second):
+			t.Fatal("stream did not end with the task log")
+		}
+	}
+}
@@ -0,0 +1,152 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tasks
+
+import (
+	"context"
+	"sync"
+)
+
+// Owns the reader on behalf of every task; queued tasks are run one at a
+// time, in FIFO order, so concurrent requests never contend for the reader
+type deviceManager struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []task
+	current task
+	probing bool
+	health  readerHealth
+}
+
+var manager = newDeviceManager()
+
+func newDeviceManager() *deviceManager {
+	d := &deviceManager{}
+	d.cond = sync.NewCond(&d.mu)
+
+	go d.worker()
+
+	return d
+}
+
+// Queues a task to be run once the reader is free
+func (d *deviceManager) Enqueue(t task) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.queue = append(d.queue, t)
+	d.cond.Broadcast()
+}
+
+// Returns the 1-based position of a task waiting for the reader
+func (d *deviceManager) Position(t task) (int, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i, queued := range d.queue {
+		if queued == t {
+			return i + 1, true
+		}
+	}
+
+	return 0, false
+}
+
+// Cancels a task, removing it from the queue if it has not started yet
+func (d *deviceManager) Cancel(t task) bool {
+	d.mu.Lock()
+	for i, queued := range d.queue {
+		if queued == t {
+			d.queue = append(d.queue[:i], d.queue[i+1:]...)
+			d.mu.Unlock()
+
+			t.base().Cancel()
+			t.base().fail(errorCodeCancelled, context.Canceled)
+			archive(t)
+			return true
+		}
+	}
+	d.mu.Unlock()
+
+	return t.base().Cancel()
+}
+
+// Returns the number of tasks waiting for the reader and holding it
+func (d *deviceManager) Load() (queued, running int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.current != nil {
+		running = 1
+	}
+
+	return len(d.queue), running
+}
+
+func (d *deviceManager) worker() {
+	for {
+		d.mu.Lock()
+		for len(d.queue) == 0 || d.probing {
+			d.cond.Wait()
+		}
+
+		t := d.queue[0]
+		d.queue = d.queue[1:]
+		d.current = t
+		d.mu.Unlock()
+
+		d.run(t)
+		archive(t)
+
+		d.mu.Lock()
+		d.current = nil
+		d.cond.Broadcast()
+		d.mu.Unlock()
+	}
+}
+
+func (d *deviceManager) run(t task) {
+	m := t.base()
+	if err := m.ctx.Err(); err != nil {
+		// Cancelled before it could start
+		m.fail(errorCodeCancelled, err)
+		return
+	}
+
+	m.start()
+
+	m.Logger.Info("Opening NFC device...")
+
+	reader, err := openReader(m.Logger)
+	d.recordOpen(reader, err)
+	if err != nil {
+		m.fail(errorCodeDeviceUnavailable, err)
+		return
+	}
+
+	// Always release the reader, however the task ends
+	defer func() {
+		m.Logger.Info("Closing NFC device...")
+
+		if err := reader.Close(m.Logger); err != nil {
+			m.LogError(err)
+		}
+	}()
+
+	t.Run(reader)
+}
@@ -0,0 +1,85 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tasks
+
+import (
+	"context"
+	"github.com/ComputerScienceHouse/gatekeeper/device"
+	"github.com/labstack/gommon/log"
+	"testing"
+	"time"
+)
+
+// waitForRecord waits for a task to be archived in the task history; tasks
+// are saved there while pending and running too, but only finished once
+// archived
+func waitForRecord(t *testing.T, tk task) *taskRecord {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		record, err := history.Get(tk.base().ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if record != nil && record.FinishedAt != nil {
+			return record
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("task was never archived")
+	return nil
+}
+
+func TestManagerFinishesCancelledTask(t *testing.T) {
+	defer func(previous func(log.Logger) (device.Reader, error)) { openReader = previous }(openReader)
+	openReader = func(log.Logger) (device.Reader, error) {
+		t.Error("reader opened for a cancelled task")
+		return device.NewEmulatedReader(), nil
+	}
+
+	tk, err := NewTaskFormat(&formatRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cancel the task after it has left the queue, but before it starts
+	if !tk.Cancel() {
+		t.Fatal("pending task could not be cancelled")
+	}
+
+	d := newDeviceManager()
+	d.Enqueue(tk)
+
+	record := waitForRecord(t, tk)
+	if record.State != taskStateCancelled || record.ErrorCode != errorCodeCancelled {
+		t.Errorf("archived task is %s (%s), want %s (%s)", record.State, record.ErrorCode, taskStateCancelled, errorCodeCancelled)
+	}
+
+	// Subscribers to the task log are released
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	offset := len(tk.Output.Events(0))
+	if _, ok := tk.Output.Read(ctx, offset); ok || ctx.Err() != nil {
+		t.Error("task log was not closed")
+	}
+}
@@ -0,0 +1,82 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tasks
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+var (
+	tasksCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gatekeeper",
+		Name:      "tasks_created_total",
+		Help:      "Number of tasks created, by type.",
+	}, []string{"type"})
+
+	tasksSucceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gatekeeper",
+		Name:      "tasks_succeeded_total",
+		Help:      "Number of tasks that succeeded, by type.",
+	}, []string{"type"})
+
+	tasksFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gatekeeper",
+		Name:      "tasks_failed_total",
+		Help:      "Number of tasks that failed or were cancelled, by type and error code.",
+	}, []string{"type", "error"})
+
+	taskDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gatekeeper",
+		Name:      "task_duration_seconds",
+		Help:      "Time taken to run a task once it holds the reader, including waiting for a card.",
+		Buckets:   prometheus.ExponentialBuckets(0.25, 2, 10),
+	}, []string{"type", "state"})
+
+	tasksQueued = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "gatekeeper",
+		Name:      "tasks_queued",
+		Help:      "Number of tasks waiting for the reader.",
+	}, func() float64 {
+		queued, _ := manager.Load()
+		return float64(queued)
+	})
+
+	tasksRunning = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "gatekeeper",
+		Name:      "tasks_running",
+		Help:      "Number of tasks holding the reader.",
+	}, func() float64 {
+		_, running := manager.Load()
+		return float64(running)
+	})
+)
+
+func init() {
+	prometheus.MustRegister(tasksCreated, tasksSucceeded, tasksFailed, taskDuration, tasksQueued, tasksRunning)
+}
+
+// observeDuration records how long the task has run since start, labelled
+// with the state it finished in
+func (m *taskBase) observeDuration(start time.Time) {
+	m.mu.RLock()
+	state := m.status.State
+	m.mu.RUnlock()
+
+	taskDuration.WithLabelValues(m.Type, string(state)).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,121 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tasks
+
+import (
+	"github.com/ComputerScienceHouse/gatekeeper/device"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// observations returns the number of values a histogram has observed
+func observations(t *testing.T, histogram prometheus.Observer) uint64 {
+	t.Helper()
+
+	var metric dto.Metric
+	if err := histogram.(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestTaskMetrics(t *testing.T) {
+	systemSecret := testKey(t, 32)
+	realm := testRealm(t, "test", 3, systemSecret)
+
+	// Each task opens its own reader, holding it until the queue has been checked
+	readers := make(chan device.Reader, 2)
+	readers <- issuedReader(t, systemSecret, realm)
+	readers <- issuedReader(t, systemSecret, realm)
+
+	wrongReadKey := realm
+	wrongReadKey.ReadKey = testKey(t, 16)
+
+	opened := make(chan struct{}, 2)
+	release := make(chan struct{})
+
+	defer func(previous func(log.Logger) (device.Reader, error)) { openReader = previous }(openReader)
+	openReader = func(log.Logger) (device.Reader, error) {
+		opened <- struct{}{}
+		<-release
+		return <-readers, nil
+	}
+
+	// Metrics are global, so only their changes are checked
+	created := testutil.ToFloat64(tasksCreated.WithLabelValues(taskTypeVerify))
+	succeeded := testutil.ToFloat64(tasksSucceeded.WithLabelValues(taskTypeVerify))
+	failed := testutil.ToFloat64(tasksFailed.WithLabelValues(taskTypeVerify, errorCodeAuthFailed))
+	succeededRuns := observations(t, taskDuration.WithLabelValues(taskTypeVerify, string(taskStateSucceeded)))
+	failedRuns := observations(t, taskDuration.WithLabelValues(taskTypeVerify, string(taskStateFailed)))
+
+	e := echo.New()
+	tasks := []*taskVerify{
+		newVerify(t, systemSecret, realm),
+		newVerify(t, systemSecret, wrongReadKey),
+	}
+
+	for _, tk := range tasks {
+		register(e.NewContext(httptest.NewRequest(http.MethodPost, "/verify", nil), httptest.NewRecorder()), tk)
+		manager.Enqueue(tk)
+	}
+
+	<-opened
+	if running := testutil.ToFloat64(tasksRunning); running != 1 {
+		t.Errorf("%v tasks running, want 1", running)
+	}
+
+	if queued := testutil.ToFloat64(tasksQueued); queued != 1 {
+		t.Errorf("%v tasks queued, want 1", queued)
+	}
+
+	close(release)
+	for _, tk := range tasks {
+		waitForRecord(t, tk)
+	}
+
+	counters := []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"created", testutil.ToFloat64(tasksCreated.WithLabelValues(taskTypeVerify)), created + 2},
+		{"succeeded", testutil.ToFloat64(tasksSucceeded.WithLabelValues(taskTypeVerify)), succeeded + 1},
+		{"failed", testutil.ToFloat64(tasksFailed.WithLabelValues(taskTypeVerify, errorCodeAuthFailed)), failed + 1},
+	}
+
+	for _, c := range counters {
+		if c.got != c.want {
+			t.Errorf("%s tasks counted %v, want %v", c.name, c.got, c.want)
+		}
+	}
+
+	if runs := observations(t, taskDuration.WithLabelValues(taskTypeVerify, string(taskStateSucceeded))); runs != succeededRuns+1 {
+		t.Errorf("%d durations of succeeded tasks observed, want %d", runs, succeededRuns+1)
+	}
+
+	if runs := observations(t, taskDuration.WithLabelValues(taskTypeVerify, string(taskStateFailed))); runs != failedRuns+1 {
+		t.Errorf("%d durations of failed tasks observed, want %d", runs, failedRuns+1)
+	}
+}
@@ -0,0 +1,118 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tasks
+
+import (
+	"fmt"
+	"github.com/ComputerScienceHouse/gatekeeper/device"
+	"github.com/labstack/echo"
+	"net/http"
+)
+
+const taskTypeRevoke = "revoke"
+
+type revokeRequest struct {
+	taskOptions
+	SystemSecret string `json:"systemSecret"`
+
+	// The realm to remove, which needs just an ID, or a slot and read key;
+	// its read key also retrieves the real UID of tags with random UIDs enabled
+	Realm issueRequestRealm `json:"realm"`
+}
+
+type revokeResult struct {
+	UID  string `json:"uid"`
+	Slot uint32 `json:"slot"`
+}
+
+type taskRevoke struct {
+	*taskBase
+	Request *revokeRequest
+}
+
+func (m *taskRevoke) Run(reader device.Reader) {
+	m.Logger.Info("Parsing revoke request...")
+
+	systemSecret, err := resolveSystemSecret(m.Request.SystemSecret)
+	if err != nil {
+		m.fail(errorCodeInvalidRequest, err)
+		return
+	}
+
+	realm, err := resolveLookupRealm(m.Request.Realm)
+	if err != nil {
+		m.fail(errorCodeInvalidRequest, err)
+		return
+	}
+
+	target, err := m.connect(reader, m.Request.CardTimeout)
+	if err != nil {
+		m.fail(connectErrorCode(err), err)
+		return
+	}
+
+	m.Logger.Infof("Revoking '%s' realm from tag...", realm.Name)
+
+	uid, err := reader.Revoke(m.ctx, target, systemSecret, *realm, m.Logger)
+	if err != nil {
+		m.fail(errorCodeCardError, err)
+		return
+	}
+
+	m.setUID(uid)
+	m.setResult(&revokeResult{
+		UID:  uid,
+		Slot: realm.Slot,
+	})
+	m.Logger.Infof("Revoked slot %d from tag with UID %s", realm.Slot, uid)
+
+	m.Logger.Info("Success")
+	m.succeed()
+}
+
+func NewTaskRevoke(request *revokeRequest) (*taskRevoke, error) {
+	base, err := newTaskBase(taskTypeRevoke)
+	if err != nil {
+		return nil, err
+	}
+
+	return &taskRevoke{
+		taskBase: base,
+		Request:  request,
+	}, nil
+}
+
+func CreateRevokeTask(c echo.Context) error {
+	req := new(revokeRequest)
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+
+	task, err := NewTaskRevoke(req)
+	if err != nil {
+		return err
+	}
+
+	register(c, task)
+	c.Logger().Info(fmt.Sprintf("Created '%s' task: %s", task.Type, task.ID.String()))
+	manager.Enqueue(task)
+
+	taskURL := c.Echo().URL(GetTask, task.ID.String())
+	c.Response().Header().Set(echo.HeaderLocation, taskURL)
+	return c.NoContent(http.StatusSeeOther)
+}
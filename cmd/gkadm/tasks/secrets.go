@@ -0,0 +1,165 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tasks
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ComputerScienceHouse/gatekeeper/cmd/gkadm/keystore"
+	"github.com/ComputerScienceHouse/gatekeeper/device"
+	"github.com/ComputerScienceHouse/gatekeeper/keys"
+)
+
+var (
+	// Local source of the system secret and realm keys, if one is configured
+	keyStore *keystore.Keystore
+
+	// Whether requests may carry key material themselves
+	inlineKeys = true
+)
+
+var errInlineKeysDisabled = errors.New("inline keys are disabled; reference realms by ID")
+
+// Loads the system secret and realm keys from a keystore, so that requests
+// may reference realms by ID
+func UseKeystore(ks *keystore.Keystore) {
+	keyStore = ks
+}
+
+// Sets whether requests may carry the system secret and realm keys inline
+func AllowInlineKeys(allow bool) {
+	inlineKeys = allow
+}
+
+// hasSystemSecret reports whether a system secret is available, either
+// inline in the request or from the keystore
+func hasSystemSecret(inline string) bool {
+	if inline != "" {
+		return true
+	}
+
+	if keyStore == nil {
+		return false
+	}
+
+	_, ok := keyStore.SystemSecret()
+	return ok
+}
+
+// resolveSystemSecret returns the system secret sent with a request, or the
+// one held in the keystore if the request has none
+func resolveSystemSecret(inline string) ([]byte, error) {
+	if inline != "" {
+		if !inlineKeys {
+			return nil, errInlineKeysDisabled
+		}
+
+		return keys.Decode(inline)
+	}
+
+	if keyStore != nil {
+		if secret, ok := keyStore.SystemSecret(); ok {
+			return keys.Decode(secret)
+		}
+	}
+
+	return nil, errors.New("no system secret in request or keystore")
+}
+
+// resolveRealm returns a realm referenced by ID from the keystore, or the
+// realm sent inline with a request
+func resolveRealm(realm issueRequestRealm) (*device.Realm, error) {
+	if realm.ID == "" {
+		if !inlineKeys {
+			return nil, errInlineKeysDisabled
+		}
+
+		return parseRealm(realm)
+	}
+
+	if keyStore == nil {
+		return nil, errors.New("realms cannot be referenced by ID without a keystore")
+	}
+
+	stored, ok := keyStore.Realm(realm.ID)
+	if !ok {
+		return nil, fmt.Errorf("realm '%s' not found in keystore", realm.ID)
+	}
+
+	// Only the association ID comes from the request
+	return parseRealm(issueRequestRealm{
+		Name:          stored.Name,
+		Slot:          stored.Slot,
+		AssociationId: realm.AssociationId,
+		AuthKey:       stored.AuthKey,
+		ReadKey:       stored.ReadKey,
+		UpdateKey:     stored.UpdateKey,
+		PublicKey:     stored.PublicKey,
+		PrivateKey:    stored.PrivateKey,
+	})
+}
+
+// resolveLookupRealm returns a realm used only to retrieve the real UID of a
+// tag, referenced by ID from the keystore or sent inline with a request
+func resolveLookupRealm(realm issueRequestRealm) (*device.Realm, error) {
+	if realm.ID == "" {
+		if !inlineKeys {
+			return nil, errInlineKeysDisabled
+		}
+
+		return parseLookupRealm(realm)
+	}
+
+	if keyStore == nil {
+		return nil, errors.New("realms cannot be referenced by ID without a keystore")
+	}
+
+	stored, ok := keyStore.Realm(realm.ID)
+	if !ok {
+		return nil, fmt.Errorf("realm '%s' not found in keystore", realm.ID)
+	}
+
+	return parseLookupRealm(issueRequestRealm{
+		Name:    stored.Name,
+		Slot:    stored.Slot,
+		ReadKey: stored.ReadKey,
+	})
+}
+
+// resolveLookupRealms returns the realms used to retrieve the real UID of a
+// tag, defaulting to every realm in the keystore when the request has none
+func resolveLookupRealms(requested []issueRequestRealm) ([]device.Realm, error) {
+	if len(requested) == 0 && keyStore != nil {
+		for _, stored := range keyStore.Realms() {
+			requested = append(requested, issueRequestRealm{ID: stored.ID})
+		}
+	}
+
+	var realms []device.Realm
+
+	for _, realm := range requested {
+		parsedRealm, err := resolveLookupRealm(realm)
+		if err != nil {
+			return nil, err
+		}
+
+		realms = append(realms, *parsedRealm)
+	}
+
+	return realms, nil
+}
@@ -18,60 +18,415 @@
 package tasks
 
 import (
+	"context"
 	"fmt"
+	"github.com/ComputerScienceHouse/gatekeeper/cmd/gkadm/auth"
+	"github.com/ComputerScienceHouse/gatekeeper/device"
 	"github.com/google/uuid"
 	"github.com/labstack/echo"
-	"golang.org/x/net/websocket"
+	"github.com/labstack/gommon/log"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-type chanWriter struct {
-	ch chan string
+// Represents interface to which each task type must conform
+type task interface {
+	TaskType() string
+	GetOutput() *logBuffer
+	Info() taskInfo
+	Run(reader device.Reader)
+	base() *taskBase
 }
 
-func newChanWriter() *chanWriter {
-	return &chanWriter{make(chan string, 50)}
+// Represents the lifecycle state of a task
+type taskState string
+
+const (
+	taskStatePending   taskState = "pending"
+	taskStateRunning   taskState = "running"
+	taskStateSucceeded taskState = "succeeded"
+	taskStateFailed    taskState = "failed"
+	taskStateCancelled taskState = "cancelled"
+)
+
+// Machine-readable error codes reported by failed tasks
+const (
+	errorCodeCancelled         = "cancelled"
+	errorCodeCardTimeout       = "card_timeout"
+	errorCodeInterrupted       = "interrupted"
+	errorCodeInvalidRequest    = "invalid_request"
+	errorCodeDeviceUnavailable = "device_unavailable"
+	errorCodeDeviceError       = "device_error"
+	errorCodeCardError         = "card_error"
+	errorCodeAuthFailed        = "authentication_failed"
+	errorCodeSignatureInvalid  = "signature_invalid"
+	errorCodeUUIDMismatch      = "uuid_mismatch"
+)
+
+// Options accepted by every task request
+type taskOptions struct {
+	// Seconds to wait for a card to be presented; zero waits until the task is cancelled
+	CardTimeout int `json:"cardTimeout"`
 }
 
-func (w *chanWriter) Chan() <-chan string {
-	return w.ch
+type taskStatus struct {
+	State        taskState  `json:"state"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	StartedAt    *time.Time `json:"startedAt,omitempty"`
+	FinishedAt   *time.Time `json:"finishedAt,omitempty"`
+	ErrorCode    string     `json:"errorCode,omitempty"`
+	ErrorMessage string     `json:"errorMessage,omitempty"`
 }
 
-func (w *chanWriter) Write(p []byte) (int, error) {
-	w.ch <- string(p)
-	return len(p), nil
+// Represents a snapshot of a task, as returned by the task API
+type taskInfo struct {
+	ID        uuid.UUID            `json:"id"`
+	Type      string               `json:"type"`
+	Principal *auth.Principal      `json:"principal,omitempty"`
+	Client    *auth.ClientIdentity `json:"client,omitempty"`
+	taskStatus
+	QueuePosition *int        `json:"queuePosition,omitempty"`
+	Result        interface{} `json:"result,omitempty"`
 }
 
-func (w *chanWriter) Close() error {
-	close(w.ch)
-	return nil
+// Fields and lifecycle handling shared by each task type
+type taskBase struct {
+	ID     uuid.UUID
+	Type   string
+	Output *logBuffer
+	Logger log.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.RWMutex
+	principal *auth.Principal
+	client    *auth.ClientIdentity
+	status    taskStatus
+	result    interface{}
+	uid       string
 }
 
-// Represents interface to which each task type must conform
-type task interface {
-	TaskType() string
-	GetOutput() chanWriter
-	Run()
+func newTaskBase(taskType string) (*taskBase, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	output := newLogBuffer()
+	logger := log.New(fmt.Sprintf("%s_%s", taskType, id))
+	logger.SetHeader(taskLogHeader)
+	logger.SetOutput(output)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &taskBase{
+		ID:     id,
+		Type:   taskType,
+		Output: output,
+		Logger: *logger,
+		ctx:    ctx,
+		cancel: cancel,
+		status: taskStatus{
+			State:     taskStatePending,
+			CreatedAt: time.Now(),
+		},
+	}, nil
+}
+
+func (m *taskBase) base() *taskBase {
+	return m
+}
+
+func (m *taskBase) TaskType() string {
+	return m.Type
+}
+
+func (m *taskBase) GetOutput() *logBuffer {
+	return m.Output
+}
+
+func (m *taskBase) Info() taskInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return taskInfo{
+		ID:         m.ID,
+		Type:       m.Type,
+		Principal:  m.principal,
+		Client:     m.client,
+		taskStatus: m.status,
+		Result:     m.result,
+	}
+}
+
+// record returns the task as it is kept in the task history
+func (m *taskBase) record() *taskRecord {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return &taskRecord{
+		taskInfo: taskInfo{
+			ID:         m.ID,
+			Type:       m.Type,
+			Principal:  m.principal,
+			Client:     m.client,
+			taskStatus: m.status,
+			Result:     m.result,
+		},
+		UID: m.uid,
+		Log: m.Output.Events(0),
+	}
+}
+
+// save writes the current state of the task to the task history
+func (m *taskBase) save() {
+	if err := history.Save(m.record()); err != nil {
+		m.Logger.Warnf("Unable to record task in history: %s", err)
+	}
+}
+
+func (m *taskBase) LogError(err error) {
+	m.Logger.Errorf("[ERROR] %s", err)
+	m.Logger.Errorf("Aborting")
+}
+
+func (m *taskBase) start() {
+	m.mu.Lock()
+	now := time.Now()
+	m.status.State = taskStateRunning
+	m.status.StartedAt = &now
+	m.mu.Unlock()
+
+	m.save()
+}
+
+func (m *taskBase) setResult(result interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.result = result
+}
+
+// setUID records the UID of the tag the task operated on
+func (m *taskBase) setUID(uid string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.uid = uid
+}
+
+func (m *taskBase) succeed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.status.State = taskStateSucceeded
+	m.status.FinishedAt = &now
+	m.cancel()
+
+	tasksSucceeded.WithLabelValues(m.Type).Inc()
+}
+
+// fail logs the error and marks the task as failed with the given error
+// code, or as cancelled if the failure was caused by cancelling the task
+func (m *taskBase) fail(code string, err error) {
+	m.LogError(err)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.status.FinishedAt != nil {
+		return
+	}
+
+	now := time.Now()
+	m.status.State = taskStateFailed
+	m.status.FinishedAt = &now
+	m.status.ErrorCode = code
+	m.status.ErrorMessage = err.Error()
+
+	if m.ctx.Err() == context.Canceled {
+		m.status.State = taskStateCancelled
+		m.status.ErrorCode = errorCodeCancelled
+	}
+
+	m.cancel()
+
+	tasksFailed.WithLabelValues(m.Type, m.status.ErrorCode).Inc()
+}
+
+// Requests cancellation of the task, returning false if it already finished
+func (m *taskBase) Cancel() bool {
+	m.mu.RLock()
+	finished := m.status.FinishedAt != nil
+	m.mu.RUnlock()
+
+	if finished {
+		return false
+	}
+
+	m.cancel()
+	return true
+}
+
+// connect waits for a target to be presented, giving up after timeout seconds if set
+func (m *taskBase) connect(reader device.Reader, timeout int) (device.DESFireTarget, error) {
+	ctx := m.ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		defer cancel()
+	}
+
+	target, err := reader.Connect(ctx, m.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	m.setUID(target.UID())
+	return target, nil
+}
+
+func connectErrorCode(err error) string {
+	if err == context.DeadlineExceeded {
+		return errorCodeCardTimeout
+	}
+
+	return errorCodeDeviceUnavailable
+}
+
+// authErrorCode distinguishes a tag whose association ID is not signed by
+// the realm from one which could not be authenticated at all
+func authErrorCode(err error) string {
+	if err == device.ErrSignatureInvalid {
+		return errorCodeSignatureInvalid
+	}
+
+	return errorCodeAuthFailed
 }
 
 // Ensure each task type conforms to the task interface
 var (
 	_ task = (*taskIssue)(nil)
+	_ task = (*taskVerify)(nil)
+	_ task = (*taskRevoke)(nil)
+	_ task = (*taskFormat)(nil)
+	_ task = (*taskInspect)(nil)
+)
+
+// Tasks which have not yet been archived to the task history
+var (
+	activeTasksMu sync.RWMutex
+	activeTasks   = make(map[uuid.UUID]task)
 )
 
-var taskStore = make(map[uuid.UUID]task)
+// register makes a newly created task visible to the task API, recording
+// the principal and client that created it
+func register(c echo.Context, t task) {
+	t.base().mu.Lock()
+	t.base().principal = auth.PrincipalFrom(c)
+	t.base().client = auth.ClientFrom(c)
+	t.base().mu.Unlock()
+
+	activeTasksMu.Lock()
+	activeTasks[t.base().ID] = t
+	activeTasksMu.Unlock()
+
+	tasksCreated.WithLabelValues(t.TaskType()).Inc()
+
+	t.base().save()
+}
+
+// archive ends the log of a finished task, saves it to the task history
+// and forgets it
+func archive(t task) {
+	_ = t.base().Output.Close()
+	t.base().save()
+
+	activeTasksMu.Lock()
+	delete(activeTasks, t.base().ID)
+	activeTasksMu.Unlock()
+}
+
+func lookupTask(id uuid.UUID) (task, bool) {
+	activeTasksMu.RLock()
+	defer activeTasksMu.RUnlock()
+
+	t, ok := activeTasks[id]
+	return t, ok
+}
+
+// libnfc connection string of the reader; empty selects the default device
+var nfcConnstring string
+
+// The reader backend used by tasks; libnfc hardware unless replaced
+var openReader = func(log log.Logger) (device.Reader, error) {
+	return device.OpenNFCDevice(nfcConnstring, log)
+}
+
+// Selects the libnfc device used by tasks
+func UseNFCDevice(connstring string) {
+	nfcConnstring = connstring
+}
+
+// describeTask returns a snapshot of the task, including its position in the reader queue
+func describeTask(t task) taskInfo {
+	info := t.Info()
+	if position, ok := manager.Position(t); ok {
+		info.QueuePosition = &position
+	}
+
+	return info
+}
+
+// Largest page of tasks returned by GetTasks
+const maxTaskPage = 500
 
 func GetTasks(c echo.Context) error {
-	var resp []task
-	for _, task := range taskStore {
-		resp = append(resp, task)
+	filter := historyFilter{
+		Type:  c.QueryParam("type"),
+		State: taskState(c.QueryParam("status")),
+		Limit: 50,
 	}
 
-	if resp == nil {
-		// Return an empty array instead of nil
-		resp = make([]task, 0)
+	if rawOffset := c.QueryParam("offset"); rawOffset != "" {
+		offset, err := strconv.Atoi(rawOffset)
+		if err != nil || offset < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid offset")
+		}
+
+		filter.Offset = offset
 	}
 
+	if rawLimit := c.QueryParam("limit"); rawLimit != "" {
+		limit, err := strconv.Atoi(rawLimit)
+		if err != nil || limit < 1 || limit > maxTaskPage {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid limit")
+		}
+
+		filter.Limit = limit
+	}
+
+	records, total, err := history.List(filter)
+	if err != nil {
+		return err
+	}
+
+	resp := make([]taskInfo, 0, len(records))
+	for _, record := range records {
+		// Active tasks know more about themselves than their last saved record
+		if task, ok := lookupTask(record.ID); ok {
+			resp = append(resp, describeTask(task))
+		} else {
+			resp = append(resp, record.taskInfo)
+		}
+	}
+
+	c.Response().Header().Set("X-Total-Count", strconv.Itoa(total))
 	return c.JSON(http.StatusOK, resp)
 }
 
@@ -83,45 +438,105 @@ func GetTask(c echo.Context) error {
 		return c.NoContent(http.StatusNotFound)
 	}
 
-	task, ok := taskStore[taskId]
-	if !ok {
+	if task, ok := lookupTask(taskId); ok {
+		return c.JSON(http.StatusOK, describeTask(task))
+	}
+
+	record, err := history.Get(taskId)
+	if err != nil {
+		return err
+	}
+
+	if record == nil {
 		return c.NoContent(http.StatusNotFound)
 	}
 
-	return c.JSON(http.StatusOK, task)
+	return c.JSON(http.StatusOK, record.taskInfo)
 }
 
-func GetTaskLog(c echo.Context) error {
+func CancelTask(c echo.Context) error {
 	rawTaskId := c.Param("id")
+
 	taskId, err := uuid.Parse(rawTaskId)
 	if err != nil {
 		return c.NoContent(http.StatusNotFound)
 	}
 
-	task, ok := taskStore[taskId]
+	task, ok := lookupTask(taskId)
 	if !ok {
+		// Tasks in the history have already finished
+		record, err := history.Get(taskId)
+		if err != nil {
+			return err
+		}
+
+		if record == nil {
+			return c.NoContent(http.StatusNotFound)
+		}
+
+		return c.NoContent(http.StatusConflict)
+	}
+
+	if !manager.Cancel(task) {
+		return c.NoContent(http.StatusConflict)
+	}
+
+	c.Logger().Info(fmt.Sprintf("Cancelled '%s' task: %s", task.TaskType(), taskId.String()))
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Streams a task's log. Websocket clients receive plain text lines; other
+// clients receive structured events, either as Server-Sent Events when they
+// accept text/event-stream, or as JSON lines. With ?follow=false the log
+// collected so far is returned without waiting for the task to finish.
+func GetTaskLog(c echo.Context) error {
+	rawTaskId := c.Param("id")
+	taskId, err := uuid.Parse(rawTaskId)
+	if err != nil {
 		return c.NoContent(http.StatusNotFound)
 	}
 
-	websocket.Handler(func(ws *websocket.Conn) {
-		defer func() {
-			err = ws.Close()
-			if err != nil {
-				c.Logger().Error(err)
-			}
-		}()
+	offset := 0
+	if rawOffset := c.QueryParam("offset"); rawOffset != "" {
+		offset, err = strconv.Atoi(rawOffset)
+		if err != nil || offset < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid offset")
+		}
+	}
 
-		c.Logger().Info(fmt.Sprintf("WebSocket connected: %s", c.Request().RequestURI))
+	follow := true
+	if rawFollow := c.QueryParam("follow"); rawFollow != "" {
+		follow, err = strconv.ParseBool(rawFollow)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid follow")
+		}
+	}
 
-		output := task.GetOutput()
-		for msg := range output.Chan() {
-			err := websocket.Message.Send(ws, msg)
-			if err != nil {
-				c.Logger().Error(err)
-				break
-			}
+	var output *logBuffer
+	if task, ok := lookupTask(taskId); ok {
+		output = task.GetOutput()
+	} else {
+		// Finished tasks replay their log from the task history
+		record, err := history.Get(taskId)
+		if err != nil {
+			return err
 		}
-	}).ServeHTTP(c.Response(), c.Request())
 
-	return nil
+		if record == nil {
+			return c.NoContent(http.StatusNotFound)
+		}
+
+		output = newClosedLogBuffer(record.Log)
+	}
+
+	switch {
+	case strings.EqualFold(c.Request().Header.Get(echo.HeaderUpgrade), "websocket"):
+		return streamLogWebsocket(c, output, offset)
+	case !follow:
+		return writeLogLines(c, output.Events(offset))
+	case strings.Contains(c.Request().Header.Get(echo.HeaderAccept), mimeEventStream):
+		return streamLogEvents(c, output, offset)
+	default:
+		return streamLogLines(c, output, offset)
+	}
 }
@@ -21,171 +21,103 @@ import (
 	"errors"
 	"fmt"
 	"github.com/ComputerScienceHouse/gatekeeper/device"
-	"github.com/ComputerScienceHouse/gatekeeper/keys"
-	"github.com/ComputerScienceHouse/gatekeeper/sig"
-	"github.com/google/uuid"
 	"github.com/labstack/echo"
-	"github.com/labstack/gommon/log"
 	"net/http"
+	"time"
 )
 
 const taskTypeVerify = "verify"
 
-type taskVerify struct {
-	ID      uuid.UUID     `json:"id"`
-	Type    string        `json:"type"`
-	Request *issueRequest `json:"-"`
-	Output  chanWriter    `json:"-"`
-	Logger  log.Logger    `json:"-"`
+type verifyResult struct {
+	Realms []verifyRealmResult `json:"realms"`
 }
 
-func (m *taskVerify) TaskType() string {
-	return taskTypeVerify
+type verifyRealmResult struct {
+	Name          string `json:"name"`
+	Slot          uint32 `json:"slot"`
+	AssociationID string `json:"associationId"`
 }
 
-func (m *taskVerify) GetOutput() chanWriter {
-	return m.Output
+type taskVerify struct {
+	*taskBase
+	Request *issueRequest
 }
 
-func (m *taskVerify) LogError(err error) {
-	m.Logger.Errorf("[ERROR] %s", err)
-	m.Logger.Errorf("Aborting")
-}
+func (m *taskVerify) Run(reader device.Reader) {
+	defer m.observeDuration(time.Now())
 
-func (m *taskVerify) Run() {
 	m.Logger.Info("Parsing verify request...")
 
-	_, err := keys.Decode(m.Request.SystemSecret)
+	_, err := resolveSystemSecret(m.Request.SystemSecret)
 	if err != nil {
-		m.LogError(err)
+		m.fail(errorCodeInvalidRequest, err)
 		return
 	}
 
 	var realms []device.Realm
 
 	for _, realm := range m.Request.Realms {
-		if realm.Slot < 0 || realm.Slot > 15 {
-			m.LogError(errors.New("invalid slot number for realm, must be between 0-14"))
-			return
-		}
-
-		slot := uint32(realm.Slot)
-
-		associationId, err := uuid.Parse(realm.AssociationId)
-		if err != nil {
-			m.LogError(err)
-			return
-		}
-
-		authKey, err := keys.Decode(realm.AuthKey)
-		if err != nil {
-			m.LogError(err)
-			return
-		}
-
-		readKey, err := keys.Decode(realm.ReadKey)
-		if err != nil {
-			m.LogError(err)
-			return
-		}
-
-		updateKey, err := keys.Decode(realm.UpdateKey)
+		parsedRealm, err := resolveRealm(realm)
 		if err != nil {
-			m.LogError(err)
+			m.fail(errorCodeInvalidRequest, err)
 			return
 		}
 
-		privateKey, publicKey, err := sig.Decode(realm.PrivateKey, realm.PublicKey)
-		if err != nil {
-			m.LogError(err)
-			return
-		}
-
-		realms = append(realms, device.Realm{
-			Name:          realm.Name,
-			Slot:          slot,
-			AssociationID: associationId,
-			AuthKey:       authKey,
-			ReadKey:       readKey,
-			UpdateKey:     updateKey,
-			PublicKey:     publicKey,
-			PrivateKey:    privateKey,
-		})
+		realms = append(realms, *parsedRealm)
 	}
 
-	m.Logger.Info("Opening NFC device...")
-
-	nfcDevice, err := device.OpenNFCDevice(m.Logger)
+	target, err := m.connect(reader, m.Request.CardTimeout)
 	if err != nil {
-		m.LogError(err)
+		m.fail(connectErrorCode(err), err)
 		return
 	}
 
-	target, err := nfcDevice.Connect(m.Logger)
-	if err != nil {
-		m.LogError(err)
-		err = nfcDevice.Close(m.Logger)
-		if err != nil {
-			m.LogError(err)
-		}
-		return
+	result := &verifyResult{
+		Realms: make([]verifyRealmResult, 0),
 	}
 
 	for _, realm := range realms {
 		m.Logger.Infof("Verifying tag for '%s' realm...", realm.Name)
 
-		tagUUID, err := nfcDevice.Authenticate(*target, realm, m.Logger)
+		tagUUID, err := reader.Authenticate(m.ctx, target, realm, m.Logger)
 		if err != nil {
-			m.LogError(errors.New("unable to authenticate tag"))
-			err = nfcDevice.Close(m.Logger)
-			if err != nil {
-				m.LogError(err)
-			}
+			m.setResult(result)
+			m.fail(authErrorCode(err), fmt.Errorf("unable to authenticate tag for realm '%s': %s", realm.Name, err))
 			return
 		}
 
+		result.Realms = append(result.Realms, verifyRealmResult{
+			Name:          realm.Name,
+			Slot:          realm.Slot,
+			AssociationID: tagUUID.String(),
+		})
+
 		if tagUUID.String() != realm.AssociationID.String() {
-			m.LogError(errors.New(fmt.Sprintf(
+			m.setResult(result)
+			m.fail(errorCodeUUIDMismatch, errors.New(fmt.Sprintf(
 				"invalid UUID read from tag for realm '%s': expected '%s', got '%s'",
 				realm.Name,
 				realm.AssociationID.String(),
 				tagUUID.String())))
-			err = nfcDevice.Close(m.Logger)
-			if err != nil {
-				m.LogError(err)
-			}
 			return
 		}
 	}
 
-	m.Logger.Info("Closing NFC device...")
-
-	err = nfcDevice.Close(m.Logger)
-	if err != nil {
-		m.LogError(err)
-		return
-	}
+	m.setResult(result)
 
 	m.Logger.Info("Success")
+	m.succeed()
 }
 
 func NewTaskVerify(request *issueRequest) (*taskVerify, error) {
-	id, err := uuid.NewRandom()
+	base, err := newTaskBase(taskTypeVerify)
 	if err != nil {
 		return nil, err
 	}
 
-	output := newChanWriter()
-	logger := log.New(fmt.Sprintf("verify_%s", id))
-	logger.SetHeader("[${level}]")
-	logger.SetOutput(output)
-
 	return &taskVerify{
-		ID:      id,
-		Type:    taskTypeVerify,
-		Request: request,
-		Output:  *output,
-		Logger:  *logger,
+		taskBase: base,
+		Request:  request,
 	}, nil
 }
 
@@ -200,9 +132,9 @@ func CreateVerifyTask(c echo.Context) error {
 		return err
 	}
 
-	taskStore[task.ID] = task
+	register(c, task)
 	c.Logger().Info(fmt.Sprintf("Created '%s' task: %s", task.Type, task.ID.String()))
-	go task.Run()
+	manager.Enqueue(task)
 
 	taskURL := c.Echo().URL(GetTask, task.ID.String())
 	c.Response().Header().Set(echo.HeaderLocation, taskURL)
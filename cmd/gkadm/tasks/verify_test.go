@@ -0,0 +1,167 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tasks
+
+import (
+	"context"
+	"crypto/rand"
+	"github.com/ComputerScienceHouse/gatekeeper/device"
+	"github.com/ComputerScienceHouse/gatekeeper/keys"
+	"github.com/ComputerScienceHouse/gatekeeper/sig"
+	"github.com/google/uuid"
+	"github.com/labstack/gommon/log"
+	"io/ioutil"
+	"testing"
+)
+
+func testKey(t *testing.T, length int) []byte {
+	key := make([]byte, length)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// testRealm creates a realm with a fresh read key and signing key pair. The
+// auth and update keys are the system secret the application keys are
+// derived from.
+func testRealm(t *testing.T, name string, slot uint32, systemSecret []byte) device.Realm {
+	privateKey, _, err := sig.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return device.Realm{
+		Name:          name,
+		Slot:          slot,
+		AssociationID: uuid.New(),
+		AuthKey:       systemSecret,
+		ReadKey:       testKey(t, 16),
+		UpdateKey:     systemSecret,
+		PublicKey:     &privateKey.PublicKey,
+		PrivateKey:    privateKey,
+	}
+}
+
+// inlineRealm encodes a realm with its keys inline, as sent in a request
+func inlineRealm(t *testing.T, realm device.Realm) issueRequestRealm {
+	privateKey, publicKey, err := sig.Encode(realm.PrivateKey, realm.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return issueRequestRealm{
+		Name:          realm.Name,
+		Slot:          int(realm.Slot),
+		AssociationId: realm.AssociationID.String(),
+		AuthKey:       keys.Encode(realm.AuthKey),
+		ReadKey:       keys.Encode(realm.ReadKey),
+		UpdateKey:     keys.Encode(realm.UpdateKey),
+		PublicKey:     *publicKey,
+		PrivateKey:    *privateKey,
+	}
+}
+
+// issuedReader returns an emulated reader presenting a tag issued for realms
+func issuedReader(t *testing.T, systemSecret []byte, realms ...device.Realm) *device.EmulatedReader {
+	reader := device.NewEmulatedReader()
+	tag := device.NewEmulatedTag([]byte{0x04, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66})
+	if err := tag.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := log.New("test")
+	logger.SetOutput(ioutil.Discard)
+
+	if _, err := reader.Issue(context.Background(), tag, systemSecret, realms, nil, false, *logger); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tag.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader.Present(tag)
+	return reader
+}
+
+// newVerify creates a verify task for realms, with their keys inline
+func newVerify(t *testing.T, systemSecret []byte, realms ...device.Realm) *taskVerify {
+	t.Helper()
+
+	request := &issueRequest{SystemSecret: keys.Encode(systemSecret)}
+	request.CardTimeout = 5
+	for _, realm := range realms {
+		request.Realms = append(request.Realms, inlineRealm(t, realm))
+	}
+
+	tk, err := NewTaskVerify(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tk
+}
+
+// runVerify runs a verify task for realms against the reader
+func runVerify(t *testing.T, reader device.Reader, systemSecret []byte, realms ...device.Realm) taskInfo {
+	t.Helper()
+
+	tk := newVerify(t, systemSecret, realms...)
+	tk.Run(reader)
+	return tk.Info()
+}
+
+func TestVerifyErrorCodes(t *testing.T) {
+	systemSecret := testKey(t, 32)
+	realm := testRealm(t, "test", 3, systemSecret)
+	reader := issuedReader(t, systemSecret, realm)
+
+	wrongID := realm
+	wrongID.AssociationID = uuid.New()
+
+	wrongPublicKey := realm
+	wrongPublicKey.PrivateKey = testRealm(t, "other", 3, systemSecret).PrivateKey
+	wrongPublicKey.PublicKey = &wrongPublicKey.PrivateKey.PublicKey
+
+	wrongReadKey := realm
+	wrongReadKey.ReadKey = testKey(t, 16)
+
+	notIssued := testRealm(t, "other", 4, systemSecret)
+
+	cases := []struct {
+		name  string
+		realm device.Realm
+		state taskState
+		code  string
+	}{
+		{"issued realm", realm, taskStateSucceeded, ""},
+		{"another association ID", wrongID, taskStateFailed, errorCodeUUIDMismatch},
+		{"another public key", wrongPublicKey, taskStateFailed, errorCodeSignatureInvalid},
+		{"another read key", wrongReadKey, taskStateFailed, errorCodeAuthFailed},
+		{"realm not on the tag", notIssued, taskStateFailed, errorCodeAuthFailed},
+	}
+
+	for _, c := range cases {
+		info := runVerify(t, reader, systemSecret, c.realm)
+		if info.State != c.state || info.ErrorCode != c.code {
+			t.Errorf("%s: task %s (%s: %s), want %s (%s)", c.name, info.State, info.ErrorCode, info.ErrorMessage, c.state, c.code)
+		}
+	}
+}
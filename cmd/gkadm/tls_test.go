@@ -0,0 +1,300 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/ComputerScienceHouse/gatekeeper/cmd/gkadm/auth"
+	"github.com/ComputerScienceHouse/gatekeeper/cmd/gkadm/tasks"
+	"github.com/labstack/echo"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificate is a key pair signed by a test CA, or by itself
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCertificate(t *testing.T, template *x509.Certificate, parent *testCertificate) *testCertificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCertificate{cert: cert, key: key, der: der}
+}
+
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+// writePEM writes the certificate, and its key unless keyPath is empty, as PEM files
+func (c *testCertificate) writePEM(t *testing.T, certPath string, keyPath string) {
+	t.Helper()
+
+	err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if keyPath == "" {
+		return
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testPKI holds a CA, a server certificate for 127.0.0.1 and a client
+// certificate, with the CA and server certificate written to dir
+type testPKI struct {
+	ca     *testCertificate
+	server *testCertificate
+	client *testCertificate
+	config *serveConfig
+}
+
+func newTestPKI(t *testing.T, dir string) *testPKI {
+	ca := newTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Gatekeeper Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+
+	server := newTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "gkadm"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+
+	client := newTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(424242),
+		Subject:      pkix.Name{CommonName: "dashboard", Organization: []string{"Computer Science House"}},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+
+	config := &serveConfig{
+		TLSCert:     filepath.Join(dir, "server.pem"),
+		TLSKey:      filepath.Join(dir, "server-key.pem"),
+		TLSClientCA: filepath.Join(dir, "ca.pem"),
+	}
+
+	server.writePEM(t, config.TLSCert, config.TLSKey)
+	ca.writePEM(t, config.TLSClientCA, "")
+
+	return &testPKI{ca: ca, server: server, client: client, config: config}
+}
+
+// startTLSServer serves task creation and lookup over TLS as configured
+// by mutualTLSConfig
+func startTLSServer(t *testing.T, config *serveConfig) *httptest.Server {
+	t.Helper()
+
+	tlsConfig, err := mutualTLSConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Use(auth.ClientCertificates())
+	e.GET("/tasks/:id", tasks.GetTask)
+	e.POST("/inspect", tasks.CreateInspectTask)
+
+	server := httptest.NewUnstartedServer(e)
+	server.TLS = tlsConfig
+	server.StartTLS()
+	return server
+}
+
+// newTLSClient trusts the test CA, presenting the given client certificate, if any
+func (p *testPKI) newTLSClient(certificates ...tls.Certificate) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(p.ca.cert)
+
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: roots,
+				// Present the certificate even if the server asks for another CA
+				GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					if len(certificates) == 0 {
+						return &tls.Certificate{}, nil
+					}
+
+					return &certificates[0], nil
+				},
+			},
+		},
+	}
+}
+
+// createTask creates an inspect task and returns the task as first described
+func createTask(t *testing.T, client *http.Client, server *httptest.Server) map[string]json.RawMessage {
+	t.Helper()
+
+	// The redirect to the new task is followed to describe it
+	res, err := client.Post(server.URL+"/inspect", echo.MIMEApplicationJSON, strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("creating a task answered %d", res.StatusCode)
+	}
+
+	var info map[string]json.RawMessage
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+
+	return info
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gkadm-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Tasks fail to open this reader rather than touching real hardware
+	tasks.UseNFCDevice("gkadm_test:none")
+	defer tasks.UseNFCDevice("")
+
+	pki := newTestPKI(t, dir)
+	fingerprint := sha256.Sum256(pki.client.der)
+	want := auth.ClientIdentity{
+		Subject:     "CN=dashboard,O=Computer Science House",
+		Issuer:      "CN=Gatekeeper Test CA",
+		Serial:      "424242",
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+	}
+
+	t.Run("required", func(t *testing.T) {
+		server := startTLSServer(t, pki.config)
+		defer server.Close()
+
+		if res, err := pki.newTLSClient().Get(server.URL + "/tasks/none"); err == nil {
+			res.Body.Close()
+			t.Fatalf("request without a client certificate answered %d", res.StatusCode)
+		}
+
+		info := createTask(t, pki.newTLSClient(pki.client.tlsCertificate()), server)
+
+		var got auth.ClientIdentity
+		if err := json.Unmarshal(info["client"], &got); err != nil {
+			t.Fatalf("task has no client: %s", err)
+		}
+
+		if got != want {
+			t.Errorf("task client is %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("optional", func(t *testing.T) {
+		optional := *pki.config
+		optional.TLSClientOptional = true
+
+		server := startTLSServer(t, &optional)
+		defer server.Close()
+
+		info := createTask(t, pki.newTLSClient(), server)
+		if client, ok := info["client"]; ok {
+			t.Errorf("task without a client certificate has client %s", client)
+		}
+
+		info = createTask(t, pki.newTLSClient(pki.client.tlsCertificate()), server)
+		if _, ok := info["client"]; !ok {
+			t.Error("task has no client")
+		}
+	})
+
+	t.Run("untrusted", func(t *testing.T) {
+		optional := *pki.config
+		optional.TLSClientOptional = true
+
+		server := startTLSServer(t, &optional)
+		defer server.Close()
+
+		// A certificate not issued by the client CA is refused, even when optional
+		stranger := newTestCertificate(t, &x509.Certificate{
+			SerialNumber: big.NewInt(3),
+			Subject:      pkix.Name{CommonName: "stranger"},
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, nil)
+
+		if res, err := pki.newTLSClient(stranger.tlsCertificate()).Get(server.URL + "/tasks/none"); err == nil {
+			res.Body.Close()
+			t.Fatalf("request with an untrusted certificate answered %d", res.StatusCode)
+		}
+	})
+}
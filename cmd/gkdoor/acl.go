@@ -0,0 +1,118 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/ComputerScienceHouse/gatekeeper/acl"
+	"github.com/labstack/gommon/log"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// reloadACL picks up an access list installed while the door is running
+func reloadACL(cache *acl.Cache, log log.Logger) {
+	if err := cache.Reload(); err != nil {
+		log.Errorf("Unable to reload access list, keeping the current one: %s", err)
+		return
+	}
+
+	snapshot := cache.Snapshot()
+	log.Infof("Reloaded access list version %d with %d entries", snapshot.Version, len(snapshot.Allowed))
+}
+
+func newACLCmd(configFile *string) *cobra.Command {
+	var aclCmd = &cobra.Command{
+		Use:   "acl",
+		Short: "Manage the cached access list",
+	}
+
+	var installCmd = &cobra.Command{
+		Use:   "install <snapshot>",
+		Short: "Verify a signed access list and install it, unless older than the current one",
+		Long: `Verify a signed access list and install it, unless older than the current one.
+Send SIGHUP to a running gkdoor to start using it.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := loadDoorConfig(cmd, *configFile)
+			if err != nil {
+				return err
+			}
+
+			data, err := ioutil.ReadFile(args[0])
+			if err != nil {
+				return err
+			}
+
+			cache, err := acl.OpenCache(config.ACLFile, config.Realm.Name, config.ACLPublicKey)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Replacing unreadable access list: %s\n", err)
+			}
+
+			snapshot, err := cache.Apply(data)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Installed access list version %d with %d entries\n", snapshot.Version, len(snapshot.Allowed))
+			return nil
+		},
+	}
+
+	var showCmd = &cobra.Command{
+		Use:   "show",
+		Short: "Show the cached access list",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := loadDoorConfig(cmd, *configFile)
+			if err != nil {
+				return err
+			}
+
+			cache, err := acl.OpenCache(config.ACLFile, config.Realm.Name, config.ACLPublicKey)
+			if err != nil {
+				return err
+			}
+
+			snapshot := cache.Snapshot()
+			if snapshot == nil {
+				return fmt.Errorf("no access list installed at %s", config.ACLFile)
+			}
+
+			status := "valid"
+			if snapshot.Expired(time.Now()) {
+				status = "expired"
+			}
+
+			fmt.Printf("realm   : %s\nversion : %d\nissued  : %s\nexpires : %s (%s)\n",
+				snapshot.Realm, snapshot.Version,
+				snapshot.IssuedAt.Format(time.RFC3339), snapshot.ExpiresAt.Format(time.RFC3339), status)
+			for _, id := range snapshot.Allowed {
+				fmt.Println(id)
+			}
+
+			return nil
+		},
+	}
+
+	aclCmd.AddCommand(installCmd)
+	aclCmd.AddCommand(showCmd)
+	return aclCmd
+}
@@ -0,0 +1,125 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ComputerScienceHouse/gatekeeper/audit"
+	"github.com/spf13/cobra"
+	"os"
+	"time"
+)
+
+func newAuditCmd(configFile *string) *cobra.Command {
+	var auditCmd = &cobra.Command{
+		Use:   "audit",
+		Short: "Inspect the audit log of access decisions",
+	}
+
+	var (
+		filter audit.Filter
+		since  time.Duration
+		asJSON bool
+	)
+
+	var showCmd = &cobra.Command{
+		Use:   "show",
+		Short: "Show access decisions, oldest first",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := loadDoorConfig(cmd, *configFile)
+			if err != nil {
+				return err
+			}
+
+			if since > 0 {
+				filter.Since = time.Now().Add(-since)
+			}
+
+			records, err := audit.Query(config.AuditFile, filter)
+			if err != nil {
+				return err
+			}
+
+			if asJSON {
+				encoder := json.NewEncoder(os.Stdout)
+				for i := range records {
+					if err := encoder.Encode(&records[i]); err != nil {
+						return err
+					}
+				}
+
+				return nil
+			}
+
+			for _, record := range records {
+				id := "unknown"
+				if record.AssociationID != nil {
+					id = record.AssociationID.String()
+				}
+
+				reason := record.Reason
+				if record.Detail != "" {
+					reason += ": " + record.Detail
+				}
+
+				fmt.Printf("%6d  %s  %-5s  %s  %s  %s\n", record.Seq,
+					record.Time.Local().Format(time.RFC3339), record.Decision, record.UID, id, reason)
+			}
+
+			return nil
+		},
+	}
+
+	showCmd.Flags().DurationVar(&since, "since", 0, "only decisions made within this long")
+	showCmd.Flags().StringVar(&filter.Decision, "decision", "", "only decisions of this kind: grant or deny")
+	showCmd.Flags().StringVar(&filter.UID, "uid", "", "only decisions about the card with this UID")
+	showCmd.Flags().IntVar(&filter.Limit, "limit", 0, "show at most this many decisions")
+	showCmd.Flags().BoolVar(&asJSON, "json", false, "print records as JSON lines")
+
+	var verifyCmd = &cobra.Command{
+		Use:   "verify",
+		Short: "Check the audit log's hash chain is intact",
+		Long: `Check that the audit log's hash chain is intact, finding records which were
+corrupted, edited or removed in place.
+
+The chain is not keyed, so someone able to write the log can rewrite every
+hash after their edit and it will still verify here. Such tampering is only
+detectable by the server, against the records already uploaded to it.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := loadDoorConfig(cmd, *configFile)
+			if err != nil {
+				return err
+			}
+
+			count, err := audit.Verify(config.AuditFile)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Verified %d audit records\n", count)
+			return nil
+		},
+	}
+
+	auditCmd.AddCommand(showCmd)
+	auditCmd.AddCommand(verifyCmd)
+	return auditCmd
+}
@@ -0,0 +1,227 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"github.com/ComputerScienceHouse/gatekeeper/device"
+	"github.com/ComputerScienceHouse/gatekeeper/keys"
+	"github.com/ComputerScienceHouse/gatekeeper/lock"
+	"github.com/ComputerScienceHouse/gatekeeper/sig"
+	"github.com/labstack/gommon/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"os"
+	"strings"
+	"time"
+)
+
+// Settings may also be given as GKDOOR_* environment variables, or as keys
+// of the same name in a YAML or TOML config file
+const envPrefix = "GKDOOR"
+
+// Represents the settings of the door controller
+type doorConfig struct {
+	// Identifies the door to the server
+	Name      string
+	NFCDevice string
+	Realm     device.Realm
+
+	// Where the signed access list is cached, and the key it must be signed with
+	ACLFile      string
+	ACLPublicKey *ecdsa.PublicKey
+	Sync         syncConfig
+	AuditFile    string
+
+	Lock       lockConfig
+	StrikeTime time.Duration
+	// Pause after each card, so a card held to the reader is not read again immediately
+	Cooldown time.Duration
+	// Longest wait before reopening the reader after an error
+	MaxBackoff time.Duration
+}
+
+// Selects and configures the lock actuator
+type lockConfig struct {
+	Driver    string
+	Chip      string
+	Line      uint32
+	ActiveLow bool
+	StateFile string
+}
+
+// Configures pulling access list updates from the server
+type syncConfig struct {
+	// Base URL of the server; syncing is disabled when empty
+	URL      string
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+func (c lockConfig) open(log *log.Logger) (lock.Lock, error) {
+	switch c.Driver {
+	case "gpio":
+		return lock.OpenGPIO(lock.GPIOConfig{
+			Chip:      c.Chip,
+			Line:      c.Line,
+			ActiveLow: c.ActiveLow,
+		}, log)
+	case "fake":
+		return lock.NewFakeLock(c.StateFile, log)
+	default:
+		return nil, fmt.Errorf("unknown lock driver '%s'", c.Driver)
+	}
+}
+
+func addDoorFlags(flags *pflag.FlagSet) {
+	flags.String("name", "", "name identifying this door to the server (default hostname)")
+	flags.String("nfc-device", "", "libnfc connection string of the reader (default first available device)")
+
+	flags.String("realm.name", "", "name of the realm this door belongs to")
+	flags.Int("realm.slot", 0, "slot of the realm's application on tags")
+	flags.String("realm.auth-key", "", "hex encoded realm authentication key")
+	flags.String("realm.read-key", "", "hex encoded realm read key")
+	flags.String("realm.public-key", "", "PEM encoded realm signing public key")
+
+	flags.String("acl.file", "/var/lib/gkdoor/acl.json", "file in which the signed access list is cached")
+	flags.String("acl.public-key", "", "PEM encoded access list signing public key (default realm.public-key)")
+	flags.String("audit.file", "/var/lib/gkdoor/audit.log", "append-only log of access decisions")
+	flags.String("sync.url", "", "base URL of the server to pull access list updates from (default no syncing)")
+	flags.Duration("sync.interval", 30*time.Second, "how often to poll the server for access list updates")
+	flags.Duration("sync.timeout", 10*time.Second, "how long to wait for the server to answer a poll")
+
+	flags.String("lock.driver", "fake", "lock actuator driver: gpio or fake")
+	flags.String("lock.chip", "/dev/gpiochip0", "GPIO character device driving the strike")
+	flags.Int("lock.line", 0, "GPIO line offset driving the strike")
+	flags.Bool("lock.active-low", false, "release the strike by driving the line low")
+	flags.String("lock.state-file", "", "file to which the fake lock writes its state")
+	flags.Duration("lock.strike-time", 5*time.Second, "how long the strike is released after access is granted")
+	flags.Duration("cooldown", 2*time.Second, "pause after each card before reading the next")
+	flags.Duration("max-backoff", 30*time.Second, "longest wait before reopening the reader after an error")
+}
+
+func loadDoorConfig(cmd *cobra.Command, configFile string) (*doorConfig, error) {
+	v := viper.New()
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_", ".", "_"))
+	v.AutomaticEnv()
+
+	if err := v.BindPFlags(cmd.Flags()); err != nil {
+		return nil, err
+	}
+
+	if configFile != "" {
+		v.SetConfigFile(configFile)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("unable to read config file: %s", err)
+		}
+	}
+
+	if v.GetInt("lock.line") < 0 {
+		return nil, fmt.Errorf("invalid lock.line, must not be negative")
+	}
+
+	slot := v.GetInt("realm.slot")
+	if slot < 0 || slot > 15 {
+		return nil, fmt.Errorf("invalid slot number for realm, must be between 0-15")
+	}
+
+	authKey, err := keys.Decode(v.GetString("realm.auth-key"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid realm auth key: %s", err)
+	}
+
+	readKey, err := keys.Decode(v.GetString("realm.read-key"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid realm read key: %s", err)
+	}
+
+	if len(authKey) == 0 || len(readKey) == 0 {
+		return nil, fmt.Errorf("realm.auth-key and realm.read-key are required")
+	}
+
+	publicKey, err := sig.DecodePublicKey(v.GetString("realm.public-key"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid realm public key: %s", err)
+	}
+
+	aclPublicKey := publicKey
+	if rawKey := v.GetString("acl.public-key"); rawKey != "" {
+		aclPublicKey, err = sig.DecodePublicKey(rawKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access list public key: %s", err)
+		}
+	}
+
+	name := v.GetString("name")
+	if name == "" {
+		if name, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("unable to determine door name: %s", err)
+		}
+	}
+
+	config := &doorConfig{
+		Name:      name,
+		NFCDevice: v.GetString("nfc-device"),
+		Realm: device.Realm{
+			Name:      v.GetString("realm.name"),
+			Slot:      uint32(slot),
+			AuthKey:   authKey,
+			ReadKey:   readKey,
+			PublicKey: publicKey,
+		},
+		ACLFile:      v.GetString("acl.file"),
+		ACLPublicKey: aclPublicKey,
+		AuditFile:    v.GetString("audit.file"),
+		Sync: syncConfig{
+			URL:      strings.TrimSuffix(v.GetString("sync.url"), "/"),
+			Interval: v.GetDuration("sync.interval"),
+			Timeout:  v.GetDuration("sync.timeout"),
+		},
+		Lock: lockConfig{
+			Driver:    v.GetString("lock.driver"),
+			Chip:      v.GetString("lock.chip"),
+			Line:      uint32(v.GetInt("lock.line")),
+			ActiveLow: v.GetBool("lock.active-low"),
+			StateFile: v.GetString("lock.state-file"),
+		},
+		StrikeTime: v.GetDuration("lock.strike-time"),
+		Cooldown:   v.GetDuration("cooldown"),
+		MaxBackoff: v.GetDuration("max-backoff"),
+	}
+
+	if config.Realm.Name == "" {
+		return nil, fmt.Errorf("realm.name is required")
+	}
+
+	if config.ACLFile == "" || config.AuditFile == "" {
+		return nil, fmt.Errorf("acl.file and audit.file are required")
+	}
+
+	if config.Sync.URL != "" && (config.Sync.Interval <= 0 || config.Sync.Timeout <= 0) {
+		return nil, fmt.Errorf("sync.interval and sync.timeout must be positive")
+	}
+
+	if config.StrikeTime <= 0 || config.MaxBackoff <= 0 {
+		return nil, fmt.Errorf("lock.strike-time and max-backoff must be positive")
+	}
+
+	return config, nil
+}
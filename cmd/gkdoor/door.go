@@ -0,0 +1,194 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"github.com/ComputerScienceHouse/gatekeeper/acl"
+	"github.com/ComputerScienceHouse/gatekeeper/audit"
+	"github.com/ComputerScienceHouse/gatekeeper/device"
+	"github.com/ComputerScienceHouse/gatekeeper/lock"
+	"github.com/google/uuid"
+	"github.com/labstack/gommon/log"
+	"time"
+)
+
+// Reasons for denying access, besides those given by the access list.
+// Doors have no access schedule, so access is never denied for the time of
+// day; that reason will be added along with schedules.
+const (
+	reasonAuthFailed   = "authentication failed"
+	reasonBadSignature = "signature verification failed"
+	reasonUnlockFailed = "unable to unlock"
+)
+
+// Shortest wait before reopening the reader after an error
+const minBackoff = time.Second
+
+// Drives a door: reads each card presented to the reader, authenticates it
+// against the door's realm, and unlocks the door for allowed cards
+type door struct {
+	config     *doorConfig
+	openReader func(log log.Logger) (device.Reader, error)
+	lock       lock.Lock
+	acl        *acl.Cache
+	health     doorHealth
+	audit      *audit.Log
+	log        log.Logger
+}
+
+// Runs until ctx is done, surviving reader errors and bad cards
+func (d *door) run(ctx context.Context) {
+	backoff := minBackoff
+
+	for ctx.Err() == nil {
+		reader, err := d.openReader(d.log)
+		if err != nil {
+			d.health.readerFailed(err)
+			d.log.Errorf("Unable to open NFC device: %s", err)
+			backoff = d.wait(ctx, backoff)
+			continue
+		}
+
+		d.health.readerOpened()
+		d.log.Infof("Door ready for realm '%s'", d.config.Realm.Name)
+		backoff = minBackoff
+
+		err = d.serve(ctx, reader)
+		if closeErr := reader.Close(d.log); closeErr != nil {
+			d.log.Warnf("Unable to close NFC device: %s", closeErr)
+		}
+
+		if err != nil && ctx.Err() == nil {
+			d.health.readerFailed(err)
+			d.log.Errorf("NFC device failed, reopening: %s", err)
+			backoff = d.wait(ctx, backoff)
+		}
+	}
+}
+
+// wait sleeps for backoff, returning the backoff to use next time
+func (d *door) wait(ctx context.Context, backoff time.Duration) time.Duration {
+	select {
+	case <-ctx.Done():
+	case <-time.After(backoff):
+	}
+
+	backoff *= 2
+	if backoff > d.config.MaxBackoff {
+		backoff = d.config.MaxBackoff
+	}
+
+	return backoff
+}
+
+// serve handles cards until ctx is done or the reader fails
+func (d *door) serve(ctx context.Context, reader device.Reader) error {
+	for {
+		target, err := reader.Connect(ctx, d.log)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return err
+		}
+
+		d.handle(ctx, reader, target)
+
+		if err := reader.Disconnect(target, d.log); err != nil {
+			// The tag was most likely removed mid-read
+			d.log.Debugf("Unable to disconnect from target: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(d.config.Cooldown):
+		}
+	}
+}
+
+// handle decides whether the presented card may open the door
+func (d *door) handle(ctx context.Context, reader device.Reader, target device.DESFireTarget) {
+	// Cards with random UIDs present a different one each time, until
+	// authenticated
+	uid := target.UID()
+
+	associationID, err := reader.Authenticate(ctx, target, d.config.Realm, d.log)
+	if err == device.ErrSignatureInvalid {
+		d.decide(uid, nil, audit.Deny, reasonBadSignature, nil)
+		return
+	} else if err != nil {
+		d.decide(uid, nil, audit.Deny, reasonAuthFailed, err)
+		return
+	}
+
+	if realUID, err := target.CardUID(); err != nil {
+		d.log.Warnf("Unable to read the real UID of %s: %s", uid, err)
+	} else {
+		uid = realUID
+	}
+
+	if allowed, reason := d.acl.Check(*associationID); !allowed {
+		d.decide(uid, associationID, audit.Deny, reason, nil)
+		return
+	}
+
+	if err := d.lock.Unlock(d.config.StrikeTime); err != nil {
+		d.decide(uid, associationID, audit.Deny, reasonUnlockFailed, err)
+		return
+	}
+
+	d.decide(uid, associationID, audit.Grant, acl.ReasonAllowed, nil)
+}
+
+// decide logs an access decision, and records it in the audit log
+func (d *door) decide(uid string, associationID *uuid.UUID, decision, reason string, err error) {
+	record := audit.Record{
+		Door:          d.config.Name,
+		Realm:         d.config.Realm.Name,
+		UID:           uid,
+		AssociationID: associationID,
+		Decision:      decision,
+		Reason:        reason,
+	}
+
+	if err != nil {
+		record.Detail = err.Error()
+		reason += ": " + record.Detail
+	}
+
+	id := "unknown"
+	if associationID != nil {
+		id = associationID.String()
+	}
+
+	if decision == audit.Grant {
+		d.log.Infof("Access granted to %s (UID %s): %s", id, uid, reason)
+	} else {
+		d.log.Warnf("Access denied to %s (UID %s): %s", id, uid, reason)
+	}
+
+	appended, err := d.audit.Append(record)
+	if err != nil {
+		d.log.Errorf("Unable to write audit record: %s", err)
+	} else if broken := d.audit.Broken(); broken != nil {
+		d.log.Errorf("Audit record %d was appended to a log which fails verification, it may have been tampered with: %s", appended.Seq, broken)
+	}
+}
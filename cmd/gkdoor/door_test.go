@@ -0,0 +1,186 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"github.com/ComputerScienceHouse/gatekeeper/acl"
+	"github.com/ComputerScienceHouse/gatekeeper/audit"
+	"github.com/ComputerScienceHouse/gatekeeper/device"
+	"github.com/ComputerScienceHouse/gatekeeper/sig"
+	"github.com/google/uuid"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testUID = "04112233445566"
+
+// issuedTag issues an emulated tag for the door's realm, and sets the door
+// up to authenticate it
+func issuedTag(t *testing.T, ts *testSync, reader *device.EmulatedReader) *device.EmulatedTag {
+	systemSecret := make([]byte, 32)
+	readKey := make([]byte, 16)
+	for _, key := range [][]byte{systemSecret, readKey} {
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	privateKey, _, err := sig.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	realm := device.Realm{
+		Name:          testRealm,
+		Slot:          1,
+		AssociationID: uuid.New(),
+		AuthKey:       systemSecret,
+		ReadKey:       readKey,
+		UpdateKey:     systemSecret,
+		PublicKey:     &privateKey.PublicKey,
+		PrivateKey:    privateKey,
+	}
+
+	tag := device.NewEmulatedTag([]byte{0x04, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66})
+	if err := tag.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := reader.Issue(context.Background(), tag, systemSecret, []device.Realm{realm}, nil, false, ts.door.log); err != nil {
+		t.Fatal(err)
+	}
+
+	ts.door.config.Realm = realm
+	ts.door.config.StrikeTime = 10 * time.Millisecond
+	return tag
+}
+
+// present presents the tag to the door, returning the audit record made
+func present(t *testing.T, ts *testSync, reader *device.EmulatedReader, tag *device.EmulatedTag) (*audit.Record, string) {
+	t.Helper()
+
+	// Issued tags present a new random UID each time
+	if err := tag.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	uid := tag.UID()
+	if uid == testUID {
+		t.Fatalf("tag presented its real UID")
+	}
+
+	ts.door.handle(context.Background(), reader, tag)
+	return ts.door.audit.Last(), uid
+}
+
+func TestDoorRecordsRealUID(t *testing.T) {
+	ts, cleanup := newTestSync(t)
+	defer cleanup()
+
+	reader := device.NewEmulatedReader()
+	tag := issuedTag(t, ts, reader)
+	member := ts.door.config.Realm.AssociationID
+
+	ts.publish(member)
+	if _, err := ts.sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	record, _ := present(t, ts, reader, tag)
+	if record.Decision != audit.Grant || record.UID != testUID {
+		t.Errorf("allowed tag recorded as %s for UID %s, want %s for %s", record.Decision, record.UID, audit.Grant, testUID)
+	}
+
+	ts.publish(memberA)
+	if _, err := ts.sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	record, _ = present(t, ts, reader, tag)
+	if record.Decision != audit.Deny || record.Reason != acl.ReasonNotAllowed || record.UID != testUID {
+		t.Errorf("removed tag recorded as %s (%s) for UID %s, want %s (%s) for %s",
+			record.Decision, record.Reason, record.UID, audit.Deny, acl.ReasonNotAllowed, testUID)
+	}
+
+	// Without authenticating, only the random UID is known
+	ts.door.config.Realm.ReadKey = make([]byte, 16)
+	record, uid := present(t, ts, reader, tag)
+	if record.Decision != audit.Deny || record.Reason != reasonAuthFailed || record.UID != uid {
+		t.Errorf("unauthenticated tag recorded as %s (%s) for UID %s, want %s (%s) for %s",
+			record.Decision, record.Reason, record.UID, audit.Deny, reasonAuthFailed, uid)
+	}
+}
+
+// waitForReport waits until the door's health report satisfies ok
+func waitForReport(t *testing.T, ts *testSync, ok func(report *acl.Report) bool) *acl.Report {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		report := ts.door.report()
+		if ok(report) || time.Now().After(deadline) {
+			return report
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDoorReportsStuckLock(t *testing.T) {
+	ts, cleanup := newTestSync(t)
+	defer cleanup()
+
+	ts.publish(memberA)
+	if _, err := ts.sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ts.door.lock.Unlock(100 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake lock cannot write its state over a directory, so it fails to relock
+	path := filepath.Join(filepath.Dir(ts.door.config.ACLFile), "lock")
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	report := waitForReport(t, ts, func(report *acl.Report) bool { return !report.Healthy })
+	if report.Healthy || report.Lock != "unlocked" || !strings.Contains(report.Error, "unable to engage lock") {
+		t.Errorf("door with a stuck lock reported %+v", report)
+	}
+
+	// Retries relock the door once the lock works again
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	report = waitForReport(t, ts, func(report *acl.Report) bool { return report.Healthy })
+	if !report.Healthy || report.Lock != "locked" || report.Error != "" {
+		t.Errorf("door with a working lock reported %+v", report)
+	}
+}
@@ -0,0 +1,86 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"github.com/ComputerScienceHouse/gatekeeper/acl"
+	"sync"
+	"time"
+)
+
+// Reader states, as reported to the server
+const (
+	readerOpen        = "open"
+	readerUnavailable = "unavailable"
+)
+
+// Tracks the state of the door's reader, for reporting to the server
+type doorHealth struct {
+	mu        sync.Mutex
+	reader    string
+	lastError string
+}
+
+func (h *doorHealth) readerOpened() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.reader = readerOpen
+	h.lastError = ""
+}
+
+func (h *doorHealth) readerFailed(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.reader = readerUnavailable
+	h.lastError = err.Error()
+}
+
+// report describes the door's current state. The door is healthy when its
+// reader is open, its lock engages and it has an unexpired access list.
+func (d *door) report() *acl.Report {
+	d.health.mu.Lock()
+	defer d.health.mu.Unlock()
+
+	report := &acl.Report{
+		Door:    d.config.Name,
+		Version: d.acl.Version(),
+		Healthy: d.health.reader == readerOpen,
+		Reader:  d.health.reader,
+		Lock:    string(d.lock.State()),
+		Error:   d.health.lastError,
+	}
+
+	switch snapshot := d.acl.Snapshot(); {
+	case snapshot == nil:
+		report.Healthy = false
+		report.Error = acl.ReasonNoSnapshot
+	case snapshot.Expired(time.Now()):
+		report.Healthy = false
+		report.Error = acl.ReasonExpired
+	}
+
+	// A lock stuck released matters more than anything else
+	if err := d.lock.Err(); err != nil {
+		report.Healthy = false
+		report.Error = "unable to engage lock: " + err.Error()
+	}
+
+	return report
+}
@@ -13,51 +13,125 @@
 
 	You should have received a copy of the GNU Lesser General Public License
 	along with this program.  If not, see <https://www.gnu.org/licenses/>.
- */
+*/
 
 package main
 
 import (
+	"context"
+	"fmt"
+	"github.com/ComputerScienceHouse/gatekeeper/acl"
+	"github.com/ComputerScienceHouse/gatekeeper/audit"
 	"github.com/ComputerScienceHouse/gatekeeper/device"
-	"github.com/fuzxxl/freefare/0.3/freefare"
 	"github.com/labstack/gommon/log"
+	"github.com/spf13/cobra"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
-// baseAppId represents the first AID within a MiFare Classic mapped AID
-// (0xF....?) in the middle (0x7F) of an unassigned function cluster (0xF7)
-const baseAppId uint32 = 0xff77f0
+func run(config *doorConfig) {
+	logger := log.New("gkdoor")
+	logger.SetHeader("[${time_rfc3339}] [${level}]")
+	logger.SetLevel(log.INFO)
 
-// The default master/application key; for uninitialized cards and newly created applications, this is all zeros
-var (
-	defaultDESKey        = [8]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}
-	defaultDESFireDESKey = freefare.NewDESFireDESKey(defaultDESKey)
-)
+	doorLock, err := config.Lock.open(logger)
+	if err != nil {
+		logger.Fatalf("Unable to open lock: %s", err)
+	}
 
-func main() {
-	logger := log.New("")
-	logger.SetHeader("[${level}]")
+	defer func() {
+		if err := doorLock.Close(); err != nil {
+			logger.Errorf("Unable to close lock: %s", err)
+		}
+	}()
 
-	nfcDevice, err := device.OpenNFCDevice(*logger)
+	accessList, err := acl.OpenCache(config.ACLFile, config.Realm.Name, config.ACLPublicKey)
 	if err != nil {
-		logger.Fatalf("unable to connect to NFC device")
+		logger.Errorf("Unable to load access list, denying everyone until one is installed: %s", err)
+	} else if snapshot := accessList.Snapshot(); snapshot == nil {
+		logger.Warnf("No access list at %s, denying everyone until one is installed", config.ACLFile)
+	} else {
+		logger.Infof("Loaded access list version %d with %d entries", snapshot.Version, len(snapshot.Allowed))
 	}
 
-	target, err := nfcDevice.Connect(*logger)
+	auditLog, err := audit.Open(config.AuditFile)
 	if err != nil {
-		logger.Fatalf("unable to connect to target")
+		logger.Fatalf("Unable to open audit log: %s", err)
+	}
+	defer auditLog.Close()
+
+	if err := auditLog.Broken(); err != nil {
+		logger.Errorf("Audit log failed verification, it may have been tampered with: %s", err)
+	} else if last := auditLog.Last(); last != nil {
+		logger.Infof("Verified %d audit records", last.Seq)
 	}
 
-	// Authenticate to the target
-	logger.Infof("Authenticating to tag...")
-	if err = target.Authenticate(0, *defaultDESFireDESKey); err != nil {
-		logger.Fatalf("unable to authenticate to target")
+	d := &door{
+		config: config,
+		openReader: func(log log.Logger) (device.Reader, error) {
+			return device.OpenNFCDevice(config.NFCDevice, log)
+		},
+		lock:  doorLock,
+		acl:   accessList,
+		audit: auditLog,
+		log:   *logger,
 	}
 
-	// Format tag
-	logger.Infof("Formatting tag...")
-	if err = target.FormatPICC(); err != nil {
-		logger.Fatalf("unable to format tag")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				reloadACL(accessList, *logger)
+				continue
+			}
+
+			logger.Infof("Received %s, shutting down", sig)
+			cancel()
+			return
+		}
+	}()
+
+	if config.Sync.URL != "" {
+		go newSyncer(config, d, *logger).run(ctx)
+	} else {
+		logger.Warnf("No sync.url configured, the access list will only change when installed by hand")
 	}
 
-	logger.Infof("Success")
+	d.run(ctx)
+}
+
+func main() {
+	var configFile string
+
+	var rootCmd = &cobra.Command{
+		Use:   "gkdoor",
+		Short: "Gatekeeper Door",
+		Long:  `The Gatekeeper door controller`,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := loadDoorConfig(cmd, configFile)
+			if err != nil {
+				return err
+			}
+
+			run(config)
+			return nil
+		},
+	}
+
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "YAML or TOML config file")
+	addDoorFlags(rootCmd.PersistentFlags())
+
+	rootCmd.AddCommand(newACLCmd(&configFile))
+	rootCmd.AddCommand(newAuditCmd(&configFile))
+
+	if err := rootCmd.Execute(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,134 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ComputerScienceHouse/gatekeeper/acl"
+	"github.com/labstack/gommon/log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Deltas kept on disk before asking the server for a full snapshot instead
+const maxDeltas = 100
+
+// Keeps the door's access list current by polling the server, reporting the
+// door's state with each poll, and uploads the audit log whenever the
+// server can be reached
+type syncer struct {
+	config *doorConfig
+	door   *door
+	client *http.Client
+	log    log.Logger
+
+	// ETag of the last response, sent back so the server can answer 304
+	etag string
+	// Set when the server's deltas could not be applied, to ask for a
+	// full snapshot
+	resync bool
+}
+
+func newSyncer(config *doorConfig, d *door, log log.Logger) *syncer {
+	return &syncer{
+		config: config,
+		door:   d,
+		client: &http.Client{Timeout: config.Sync.Timeout},
+		log:    log,
+	}
+}
+
+// Polls the server until ctx is done
+func (s *syncer) run(ctx context.Context) {
+	ticker := time.NewTicker(s.config.Sync.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.sync(ctx); err != nil {
+			if ctx.Err() == nil {
+				s.log.Warnf("Unable to sync access list: %s", err)
+			}
+		} else if err := s.uploadAudit(ctx); err != nil && ctx.Err() == nil {
+			s.log.Warnf("Unable to upload audit log: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sync performs one poll, applying any update the server sends
+func (s *syncer) sync(ctx context.Context) error {
+	report := s.door.report()
+	if s.resync || s.door.acl.Deltas() >= maxDeltas {
+		report.Version = 0
+	}
+
+	endpoint := fmt.Sprintf("%s/acl/%s?%s", s.config.Sync.URL, url.PathEscape(s.config.Realm.Name), report.Query().Encode())
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	if s.etag != "" && report.Version != 0 {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil
+	case http.StatusOK:
+	default:
+		return fmt.Errorf("server responded %s", resp.Status)
+	}
+
+	var update acl.Update
+	if err := json.NewDecoder(resp.Body).Decode(&update); err != nil {
+		return fmt.Errorf("invalid response: %s", err)
+	}
+
+	previous := s.door.acl.Version()
+	snapshot, err := s.door.acl.ApplyUpdate(&update)
+	if err != nil {
+		// Start over from a full snapshot next time
+		s.etag = ""
+		s.resync = true
+		return fmt.Errorf("unable to apply update: %s", err)
+	}
+
+	s.etag = resp.Header.Get("ETag")
+	s.resync = false
+
+	if snapshot != nil && snapshot.Version != previous {
+		s.log.Infof("Updated access list from version %d to %d (%d entries)", previous, snapshot.Version, len(snapshot.Allowed))
+	}
+
+	return nil
+}
@@ -0,0 +1,452 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"github.com/ComputerScienceHouse/gatekeeper/acl"
+	"github.com/ComputerScienceHouse/gatekeeper/audit"
+	"github.com/ComputerScienceHouse/gatekeeper/cmd/gkstub/stub"
+	"github.com/ComputerScienceHouse/gatekeeper/device"
+	"github.com/ComputerScienceHouse/gatekeeper/lock"
+	"github.com/ComputerScienceHouse/gatekeeper/sig"
+	"github.com/google/uuid"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testRealm = "test"
+
+var (
+	memberA = uuid.MustParse("3c5a3a1e-4c5e-4b46-9a4e-6b1f5d0a0001")
+	memberB = uuid.MustParse("3c5a3a1e-4c5e-4b46-9a4e-6b1f5d0a0002")
+)
+
+// Represents a request the stub server answered
+type exchange struct {
+	since       string
+	ifNoneMatch string
+	status      int
+}
+
+// Runs gkdoor's syncer against the stub server
+type testSync struct {
+	t          *testing.T
+	privateKey *ecdsa.PrivateKey
+	server     *stub.Server
+	door       *door
+	syncer     *syncer
+
+	mu        sync.Mutex
+	exchanges []exchange
+	// Sent instead of the stub server's answer, when set
+	forged *acl.Update
+	// Sent instead of the stub server's audit acknowledgement, when set
+	auditStatus int
+}
+
+func newTestSync(t *testing.T) (*testSync, func()) {
+	dir, err := ioutil.TempDir("", "gkdoor-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privateKey, _, err := sig.GenerateKeyPair()
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	logger := log.New("test")
+	logger.SetOutput(ioutil.Discard)
+
+	ts := &testSync{
+		t:          t,
+		privateKey: privateKey,
+		server:     stub.New(testRealm, privateKey, time.Hour),
+	}
+
+	e := echo.New()
+	e.Logger.SetOutput(ioutil.Discard)
+	e.GET("/acl/:realm", ts.getACL)
+	e.POST("/audit/:realm", ts.postAudit)
+	e.GET("/audit", ts.server.GetAudit)
+	server := httptest.NewServer(e)
+
+	config := &doorConfig{
+		Name:      "front",
+		Realm:     device.Realm{Name: testRealm},
+		ACLFile:   filepath.Join(dir, "acl.json"),
+		AuditFile: filepath.Join(dir, "audit.log"),
+		Sync: syncConfig{
+			URL:      server.URL,
+			Interval: time.Hour,
+			Timeout:  5 * time.Second,
+		},
+	}
+
+	cleanup := func() {
+		server.Close()
+		_ = os.RemoveAll(dir)
+	}
+
+	ts.door = &door{config: config, log: *logger}
+	if ts.door.lock, err = lock.NewFakeLock(filepath.Join(dir, "lock"), logger); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	if ts.door.acl, err = acl.OpenCache(config.ACLFile, testRealm, &privateKey.PublicKey); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	if ts.door.audit, err = audit.Open(config.AuditFile); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	ts.door.health.readerOpened()
+	ts.syncer = newSyncer(config, ts.door, *logger)
+
+	return ts, func() {
+		_ = ts.door.audit.Close()
+		_ = ts.door.lock.Close()
+		cleanup()
+	}
+}
+
+func (ts *testSync) getACL(c echo.Context) error {
+	ts.mu.Lock()
+	forged := ts.forged
+	ts.mu.Unlock()
+
+	var err error
+	if forged != nil {
+		err = c.JSON(http.StatusOK, forged)
+	} else {
+		err = ts.server.GetACL(c)
+	}
+
+	status := c.Response().Status
+	if httpErr, ok := err.(*echo.HTTPError); ok {
+		status = httpErr.Code
+	}
+
+	ts.mu.Lock()
+	ts.exchanges = append(ts.exchanges, exchange{
+		since:       c.QueryParam("since"),
+		ifNoneMatch: c.Request().Header.Get("If-None-Match"),
+		status:      status,
+	})
+	ts.mu.Unlock()
+
+	return err
+}
+
+func (ts *testSync) postAudit(c echo.Context) error {
+	ts.mu.Lock()
+	status := ts.auditStatus
+	ts.mu.Unlock()
+
+	if status != 0 {
+		return c.NoContent(status)
+	}
+
+	return ts.server.PostAudit(c)
+}
+
+// publish mints a new version of the access list
+func (ts *testSync) publish(allowed ...uuid.UUID) *acl.Snapshot {
+	ts.t.Helper()
+
+	snapshot, err := ts.server.Publish(allowed, true)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+
+	return snapshot
+}
+
+// sync polls the server once, returning what it answered
+func (ts *testSync) sync() (exchange, error) {
+	ts.t.Helper()
+
+	err := ts.syncer.sync(context.Background())
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if len(ts.exchanges) == 0 {
+		ts.t.Fatal("server received no sync request")
+	}
+
+	return ts.exchanges[len(ts.exchanges)-1], err
+}
+
+// expect checks the door's access list version and the deltas applied to it
+func (ts *testSync) expect(version uint64, deltas int) {
+	ts.t.Helper()
+
+	if got := ts.door.acl.Version(); got != version {
+		ts.t.Errorf("door at version %d, want %d", got, version)
+	}
+
+	if got := ts.door.acl.Deltas(); got != deltas {
+		ts.t.Errorf("door applied %d deltas, want %d", got, deltas)
+	}
+}
+
+func TestSyncNothingPublished(t *testing.T) {
+	ts, cleanup := newTestSync(t)
+	defer cleanup()
+
+	ex, err := ts.sync()
+	if err == nil || ex.status != http.StatusServiceUnavailable {
+		t.Errorf("got %d (%v), want %d", ex.status, err, http.StatusServiceUnavailable)
+	}
+
+	ts.expect(0, 0)
+}
+
+func TestSyncDeltas(t *testing.T) {
+	ts, cleanup := newTestSync(t)
+	defer cleanup()
+
+	v1 := ts.publish(memberA)
+
+	// A new door gets a full snapshot
+	ex, err := ts.sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ex.since != "0" || ex.status != http.StatusOK {
+		t.Errorf("first sync: sent since=%s, got %d", ex.since, ex.status)
+	}
+
+	ts.expect(v1.Version, 0)
+
+	// Then nothing until the access list changes
+	ex, err = ts.sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ex.status != http.StatusNotModified || ex.ifNoneMatch != acl.ETag(v1.Version) {
+		t.Errorf("sync while up to date: sent If-None-Match %s, got %d", ex.ifNoneMatch, ex.status)
+	}
+
+	// Changes arrive as a chain of deltas
+	ts.publish(memberA, memberB)
+	v3 := ts.publish(memberB)
+
+	if ex, err = ts.sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if ex.status != http.StatusOK {
+		t.Errorf("sync after changes: got %d", ex.status)
+	}
+
+	ts.expect(v3.Version, 2)
+
+	if allowed, _ := ts.door.acl.Check(memberA); allowed {
+		t.Error("removed member still allowed")
+	}
+
+	if allowed, _ := ts.door.acl.Check(memberB); !allowed {
+		t.Error("added member not allowed")
+	}
+}
+
+func TestSyncFallsBackToSnapshot(t *testing.T) {
+	ts, cleanup := newTestSync(t)
+	defer cleanup()
+
+	ts.publish(memberA)
+	if _, err := ts.sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fall further behind than the server keeps deltas for
+	var latest *acl.Snapshot
+	for i := 0; i <= maxDeltas; i++ {
+		latest = ts.publish(memberA, memberB)
+	}
+
+	ex, err := ts.sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ex.status != http.StatusOK {
+		t.Errorf("got %d, want %d", ex.status, http.StatusOK)
+	}
+
+	ts.expect(latest.Version, 0)
+}
+
+func TestSyncRejectsForgedDelta(t *testing.T) {
+	ts, cleanup := newTestSync(t)
+	defer cleanup()
+
+	v1 := ts.publish(memberA)
+	if _, err := ts.sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A delta letting someone else in, signed with the wrong key
+	forger, _, err := sig.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delta := &acl.Delta{
+		Realm:     testRealm,
+		From:      v1.Version,
+		Version:   v1.Version + 1,
+		IssuedAt:  time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+		Added:     []uuid.UUID{memberB},
+	}
+
+	signed, err := acl.SignDelta(delta, forger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts.mu.Lock()
+	ts.forged = &acl.Update{Deltas: []json.RawMessage{signed}}
+	ts.mu.Unlock()
+
+	if _, err := ts.sync(); err == nil || !strings.Contains(err.Error(), acl.ErrBadSignature.Error()) {
+		t.Errorf("forged delta: got %v, want %v", err, acl.ErrBadSignature)
+	}
+
+	ts.expect(v1.Version, 0)
+	if allowed, _ := ts.door.acl.Check(memberB); allowed {
+		t.Error("forged delta let a member in")
+	}
+
+	// The door starts over from a full snapshot
+	ts.mu.Lock()
+	ts.forged = nil
+	ts.mu.Unlock()
+
+	v2 := ts.publish(memberA, memberB)
+	ex, err := ts.sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ex.since != "0" || ex.ifNoneMatch != "" {
+		t.Errorf("after a rejected update: sent since=%s, If-None-Match %q", ex.since, ex.ifNoneMatch)
+	}
+
+	ts.expect(v2.Version, 0)
+}
+
+func TestSyncResyncsCurrentVersion(t *testing.T) {
+	ts, cleanup := newTestSync(t)
+	defer cleanup()
+
+	ts.publish(memberA)
+	if _, err := ts.sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	v2 := ts.publish(memberA, memberB)
+	if _, err := ts.sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	ts.expect(v2.Version, 1)
+
+	// After a rejected update, the door asks for the version it already has
+	// as a full snapshot, and rebases onto it
+	ts.mu.Lock()
+	ts.forged = &acl.Update{Snapshot: json.RawMessage(`{}`)}
+	ts.mu.Unlock()
+
+	if _, err := ts.sync(); err == nil {
+		t.Fatal("invalid update applied")
+	}
+
+	ts.mu.Lock()
+	ts.forged = nil
+	ts.mu.Unlock()
+
+	ex, err := ts.sync()
+	if err != nil {
+		t.Fatalf("resync at the current version: %s", err)
+	}
+
+	if ex.since != "0" || ex.status != http.StatusOK {
+		t.Errorf("resync: sent since=%s, got %d", ex.since, ex.status)
+	}
+
+	ts.expect(v2.Version, 0)
+
+	// Once the door holds as many deltas as it keeps, it asks for a full
+	// snapshot of the current version to replace them
+	latest := v2
+	for i := 0; i < maxDeltas; i++ {
+		if i%2 == 0 {
+			latest = ts.publish(memberA)
+		} else {
+			latest = ts.publish(memberA, memberB)
+		}
+
+		if _, err := ts.sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts.expect(latest.Version, maxDeltas)
+
+	if ex, err = ts.sync(); err != nil {
+		t.Fatalf("sync after %d deltas: %s", maxDeltas, err)
+	}
+
+	if ex.since != "0" || ex.status != http.StatusOK {
+		t.Errorf("sync after %d deltas: sent since=%s, got %d", maxDeltas, ex.since, ex.status)
+	}
+
+	ts.expect(latest.Version, 0)
+
+	// And is then up to date, rather than asking again
+	if ex, err = ts.sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if ex.status != http.StatusNotModified {
+		t.Errorf("sync after rebasing: sent since=%s, got %d", ex.since, ex.status)
+	}
+}
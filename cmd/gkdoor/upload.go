@@ -0,0 +1,142 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ComputerScienceHouse/gatekeeper/audit"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Audit records uploaded per request
+const auditBatchSize = 500
+
+// uploadedFile records the last audit record acknowledged by the server, so
+// uploads resume where they left off after a restart
+func (s *syncer) uploadedFile() string {
+	return s.config.AuditFile + ".uploaded"
+}
+
+func (s *syncer) uploaded() (uint64, error) {
+	data, err := ioutil.ReadFile(s.uploadedFile())
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func (s *syncer) setUploaded(seq uint64) error {
+	tmp := s.uploadedFile() + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatUint(seq, 10)+"\n"), 0640); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.uploadedFile())
+}
+
+// uploadAudit sends the server every audit record it has not acknowledged
+func (s *syncer) uploadAudit(ctx context.Context) error {
+	uploaded, err := s.uploaded()
+	if err != nil {
+		return err
+	}
+
+	for {
+		records, err := s.door.audit.Query(audit.Filter{AfterSeq: uploaded, Limit: auditBatchSize})
+		if err != nil {
+			return err
+		}
+
+		if len(records) == 0 {
+			return nil
+		}
+
+		ack, err := s.postAudit(ctx, records)
+		if err != nil {
+			return err
+		}
+
+		last := records[len(records)-1].Seq
+		switch {
+		case ack > last:
+			return fmt.Errorf("server holds audit records up to %d, but the log ends at %d", ack, last)
+		case ack == uploaded:
+			return fmt.Errorf("server rejected audit records after %d", ack)
+		}
+
+		if err := s.setUploaded(ack); err != nil {
+			return err
+		}
+
+		s.log.Debugf("Uploaded audit records %d-%d", uploaded+1, ack)
+		uploaded = ack
+
+		if len(records) < auditBatchSize && ack == last {
+			return nil
+		}
+	}
+}
+
+// postAudit uploads records, returning the last one the server holds
+func (s *syncer) postAudit(ctx context.Context, records []audit.Record) (uint64, error) {
+	body, err := json.Marshal(&audit.Upload{Records: records})
+	if err != nil {
+		return 0, err
+	}
+
+	query := url.Values{}
+	query.Set("door", s.config.Name)
+
+	endpoint := fmt.Sprintf("%s/audit/%s?%s", s.config.Sync.URL, url.PathEscape(s.config.Realm.Name), query.Encode())
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusConflict:
+		// A conflict tells us where the server's copy of the log ends
+	default:
+		return 0, fmt.Errorf("server responded %s", resp.Status)
+	}
+
+	var ack audit.Ack
+	if err := json.NewDecoder(resp.Body).Decode(&ack); err != nil {
+		return 0, fmt.Errorf("invalid response: %s", err)
+	}
+
+	return ack.Acknowledged, nil
+}
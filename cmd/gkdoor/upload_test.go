@@ -0,0 +1,176 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/ComputerScienceHouse/gatekeeper/audit"
+	"net/http"
+	"os"
+	"testing"
+)
+
+// appendDecisions appends count decisions to the door's audit log
+func (ts *testSync) appendDecisions(count int) {
+	ts.t.Helper()
+
+	for i := 0; i < count; i++ {
+		ts.door.decide(testUID, &memberA, audit.Grant, "allowed", nil)
+	}
+}
+
+// upload uploads the audit log once, returning the last record acknowledged
+func (ts *testSync) upload() (uint64, error) {
+	ts.t.Helper()
+
+	err := ts.syncer.uploadAudit(context.Background())
+
+	uploaded, uploadedErr := ts.syncer.uploaded()
+	if uploadedErr != nil {
+		ts.t.Fatal(uploadedErr)
+	}
+
+	return uploaded, err
+}
+
+// held returns the sequence numbers of the audit records the server holds
+func (ts *testSync) held() []uint64 {
+	ts.t.Helper()
+
+	resp, err := http.Get(ts.door.config.Sync.URL + "/audit?door=" + ts.door.config.Name)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var records []audit.Record
+	if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		ts.t.Fatal(err)
+	}
+
+	seqs := make([]uint64, len(records))
+	for i, record := range records {
+		seqs[i] = record.Seq
+	}
+
+	return seqs
+}
+
+// expectHeld checks the server holds exactly records 1 to last
+func (ts *testSync) expectHeld(last uint64) {
+	ts.t.Helper()
+
+	held := ts.held()
+	for i, seq := range held {
+		if seq != uint64(i+1) {
+			ts.t.Errorf("server holds records %v, want 1-%d", held, last)
+			return
+		}
+	}
+
+	if uint64(len(held)) != last {
+		ts.t.Errorf("server holds records %v, want 1-%d", held, last)
+	}
+}
+
+func TestUploadResumes(t *testing.T) {
+	ts, cleanup := newTestSync(t)
+	defer cleanup()
+
+	ts.appendDecisions(3)
+	if uploaded, err := ts.upload(); err != nil || uploaded != 3 {
+		t.Fatalf("uploaded up to %d (%v), want 3", uploaded, err)
+	}
+
+	ts.expectHeld(3)
+
+	// After a restart, only new records are sent
+	ts.appendDecisions(2)
+	ts.syncer = newSyncer(ts.door.config, ts.door, ts.syncer.log)
+	if uploaded, err := ts.upload(); err != nil || uploaded != 5 {
+		t.Fatalf("uploaded up to %d (%v) after restarting, want 5", uploaded, err)
+	}
+
+	ts.expectHeld(5)
+
+	// Records sent again after a lost acknowledgement are not duplicated
+	if err := ts.syncer.setUploaded(2); err != nil {
+		t.Fatal(err)
+	}
+
+	ts.appendDecisions(1)
+	if uploaded, err := ts.upload(); err != nil || uploaded != 6 {
+		t.Fatalf("uploaded up to %d (%v) after a lost acknowledgement, want 6", uploaded, err)
+	}
+
+	ts.expectHeld(6)
+
+	// Nothing is marked uploaded while the server is failing
+	ts.mu.Lock()
+	ts.auditStatus = http.StatusInternalServerError
+	ts.mu.Unlock()
+
+	ts.appendDecisions(1)
+	if uploaded, err := ts.upload(); err == nil || uploaded != 6 {
+		t.Errorf("uploaded up to %d (%v) while the server was failing, want 6 and an error", uploaded, err)
+	}
+
+	ts.mu.Lock()
+	ts.auditStatus = 0
+	ts.mu.Unlock()
+
+	if uploaded, err := ts.upload(); err != nil || uploaded != 7 {
+		t.Errorf("uploaded up to %d (%v) once the server recovered, want 7", uploaded, err)
+	}
+
+	ts.expectHeld(7)
+}
+
+func TestUploadConflict(t *testing.T) {
+	ts, cleanup := newTestSync(t)
+	defer cleanup()
+
+	ts.appendDecisions(3)
+	if _, err := ts.upload(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the door's log with one the server has not seen
+	if err := ts.door.audit.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{ts.door.config.AuditFile, ts.syncer.uploadedFile()} {
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var err error
+	if ts.door.audit, err = audit.Open(ts.door.config.AuditFile); err != nil {
+		t.Fatal(err)
+	}
+
+	ts.appendDecisions(2)
+	if uploaded, err := ts.upload(); err == nil || uploaded != 0 {
+		t.Errorf("uploaded up to %d (%v) with a different log, want 0 and an error", uploaded, err)
+	}
+
+	ts.expectHeld(3)
+}
@@ -0,0 +1,152 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/ComputerScienceHouse/gatekeeper/cmd/gkstub/stub"
+	"github.com/ComputerScienceHouse/gatekeeper/sig"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/middleware"
+	"github.com/labstack/gommon/log"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+type stubConfig struct {
+	Listen         string
+	Realm          string
+	PrivateKeyFile string
+	AllowedFile    string
+	TTL            time.Duration
+	Poll           time.Duration
+}
+
+func serve(config *stubConfig) {
+	e := echo.New()
+	e.HideBanner = true
+	e.Logger.SetLevel(log.INFO)
+	e.Logger.SetHeader("[${time_rfc3339}] [${level}]")
+
+	privateKeyPEM, err := ioutil.ReadFile(config.PrivateKeyFile)
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+
+	privateKey, err := sig.DecodePrivateKey(string(privateKeyPEM))
+	if err != nil {
+		e.Logger.Fatalf("Invalid realm private key: %s", err)
+	}
+
+	s := stub.New(config.Realm, privateKey, config.TTL)
+
+	// Publish the initial access list, then watch for changes
+	var served uint64
+	reload := func(force bool) bool {
+		allowed, err := stub.ReadAllowed(config.AllowedFile)
+		if err != nil {
+			e.Logger.Errorf("Unable to read access list: %s", err)
+			return false
+		}
+
+		snapshot, err := s.Publish(allowed, force)
+		if err != nil {
+			e.Logger.Errorf("Unable to publish access list: %s", err)
+			return false
+		}
+
+		if snapshot.Version != served {
+			served = snapshot.Version
+			e.Logger.Infof("Serving access list version %d with %d entries", snapshot.Version, len(snapshot.Allowed))
+		}
+
+		return true
+	}
+
+	if !reload(true) {
+		os.Exit(1)
+	}
+
+	go func() {
+		for range time.Tick(config.Poll) {
+			reload(false)
+
+			if snapshot, err := s.Refresh(); err != nil {
+				e.Logger.Errorf("Unable to refresh access list: %s", err)
+			} else if snapshot != nil {
+				served = snapshot.Version
+				e.Logger.Infof("Refreshed access list as version %d", snapshot.Version)
+			}
+		}
+	}()
+
+	e.Use(middleware.Logger())
+
+	e.GET("/healthz", func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+
+	e.GET("/acl/:realm", s.GetACL)
+	e.GET("/doors", s.GetDoors)
+	e.POST("/audit/:realm", s.PostAudit)
+	e.GET("/audit", s.GetAudit)
+
+	e.Logger.Fatal(e.Start(config.Listen))
+}
+
+func main() {
+	config := new(stubConfig)
+
+	var rootCmd = &cobra.Command{
+		Use:   "gkstub",
+		Short: "Gatekeeper sync stub server",
+		Long: `A stand-in for gatekeeper-server which serves one realm's access list to
+gkdoor, so the sync protocol can be tested end to end. Association IDs are
+read from a file, one per line, which is re-read when it changes. Audit
+records uploaded by doors are checked and kept in memory.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if config.Realm == "" || config.PrivateKeyFile == "" || config.AllowedFile == "" {
+				return fmt.Errorf("--realm, --private-key and --allowed are required")
+			}
+
+			if config.TTL <= 0 || config.Poll <= 0 {
+				return fmt.Errorf("--ttl and --poll must be positive")
+			}
+
+			serve(config)
+			return nil
+		},
+	}
+
+	flags := rootCmd.Flags()
+	flags.StringVar(&config.Listen, "listen", ":8081", "address to listen on")
+	flags.StringVar(&config.Realm, "realm", "", "name of the realm to serve")
+	flags.StringVar(&config.PrivateKeyFile, "private-key", "", "file containing the PEM encoded realm signing private key")
+	flags.StringVar(&config.AllowedFile, "allowed", "", "file listing allowed association IDs, one per line")
+	flags.DurationVar(&config.TTL, "ttl", 24*time.Hour, "how long each access list version is valid")
+	flags.DurationVar(&config.Poll, "poll", 5*time.Second, "how often to check the allowed file for changes")
+
+	if err := rootCmd.Execute(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,351 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package stub
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"fmt"
+	"github.com/ComputerScienceHouse/gatekeeper/acl"
+	"github.com/ComputerScienceHouse/gatekeeper/audit"
+	"github.com/google/uuid"
+	"github.com/labstack/echo"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deltas kept for doors which are behind; older doors get a full snapshot
+const maxDeltas = 100
+
+// Represents a version of the access list, as signed for distribution
+type version struct {
+	snapshot *acl.Snapshot
+	signed   []byte
+	// Signed delta from the previous version, if there is one
+	delta []byte
+}
+
+// Represents the last report received from a door
+type doorStatus struct {
+	acl.Report
+	Address  string    `json:"address"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// Serves one realm's access list to doors, minting a new signed version
+// whenever the list changes or the current version nears expiry
+type Server struct {
+	realm      string
+	privateKey *ecdsa.PrivateKey
+	ttl        time.Duration
+
+	mu       sync.RWMutex
+	versions []*version
+	doors    map[string]*doorStatus
+	// Audit records uploaded by each door, in order
+	audits map[string][]audit.Record
+}
+
+// Creates a server for a realm's access list, signed with the realm's private
+// key. Doors are refused until the first version is published.
+func New(realm string, privateKey *ecdsa.PrivateKey, ttl time.Duration) *Server {
+	return &Server{
+		realm:      realm,
+		privateKey: privateKey,
+		ttl:        ttl,
+		doors:      make(map[string]*doorStatus),
+		audits:     make(map[string][]audit.Record),
+	}
+}
+
+// Reads association IDs from a file, one per line. Blank lines and lines
+// starting with # are ignored.
+func ReadAllowed(path string) ([]uuid.UUID, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var allowed []uuid.UUID
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		id, err := uuid.Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid association ID '%s'", path, line, text)
+		}
+
+		allowed = append(allowed, id)
+	}
+
+	return allowed, scanner.Err()
+}
+
+// Mints a new version with the given association IDs. Unless force is set,
+// nothing happens when they are unchanged.
+func (s *Server) Publish(allowed []uuid.UUID, force bool) (*acl.Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	snapshot := &acl.Snapshot{
+		Realm:     s.realm,
+		Version:   uint64(now.Unix()),
+		IssuedAt:  now,
+		ExpiresAt: now.Add(s.ttl),
+		Allowed:   append([]uuid.UUID(nil), allowed...),
+	}
+
+	sort.Slice(snapshot.Allowed, func(i, j int) bool {
+		return snapshot.Allowed[i].String() < snapshot.Allowed[j].String()
+	})
+
+	next := &version{snapshot: snapshot}
+
+	if len(s.versions) > 0 {
+		current := s.versions[len(s.versions)-1].snapshot
+
+		delta := acl.Diff(current, snapshot)
+		if !force && len(delta.Added) == 0 && len(delta.Removed) == 0 {
+			return current, nil
+		}
+
+		// Versions only ever move forward, even across restarts, as they
+		// start from the current time
+		if snapshot.Version <= current.Version {
+			snapshot.Version = current.Version + 1
+			delta.Version = snapshot.Version
+		}
+
+		delta.IssuedAt = snapshot.IssuedAt
+		delta.ExpiresAt = snapshot.ExpiresAt
+
+		signed, err := acl.SignDelta(delta, s.privateKey)
+		if err != nil {
+			return nil, err
+		}
+
+		next.delta = signed
+	}
+
+	signed, err := acl.Sign(snapshot, s.privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	next.signed = signed
+	s.versions = append(s.versions, next)
+	if len(s.versions) > maxDeltas+1 {
+		s.versions = s.versions[len(s.versions)-maxDeltas-1:]
+	}
+
+	return snapshot, nil
+}
+
+// Re-publishes the current access list if it expires within half its
+// lifetime, so doors which are up to date never see it expire
+func (s *Server) Refresh() (*acl.Snapshot, error) {
+	s.mu.RLock()
+	if len(s.versions) == 0 {
+		s.mu.RUnlock()
+		return nil, nil
+	}
+
+	current := s.versions[len(s.versions)-1].snapshot
+	s.mu.RUnlock()
+
+	if time.Until(current.ExpiresAt) > s.ttl/2 {
+		return nil, nil
+	}
+
+	return s.Publish(current.Allowed, true)
+}
+
+// update returns what a door at the given version needs to catch up, and
+// the latest version. It returns false if nothing has been published yet.
+func (s *Server) update(since uint64) (*acl.Update, uint64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.versions) == 0 {
+		return nil, 0, false
+	}
+
+	latest := s.versions[len(s.versions)-1]
+	update := new(acl.Update)
+
+	if since == latest.snapshot.Version {
+		return update, since, true
+	}
+
+	// Send deltas if the door's version is one we still have
+	for i, v := range s.versions {
+		if v.snapshot.Version != since {
+			continue
+		}
+
+		for _, next := range s.versions[i+1:] {
+			update.Deltas = append(update.Deltas, next.delta)
+		}
+
+		return update, latest.snapshot.Version, true
+	}
+
+	update.Snapshot = latest.signed
+	return update, latest.snapshot.Version, true
+}
+
+// Handles a sync request from a door
+func (s *Server) GetACL(c echo.Context) error {
+	if c.Param("realm") != s.realm {
+		return echo.NewHTTPError(http.StatusNotFound, "unknown realm")
+	}
+
+	report, err := acl.ParseReport(c.QueryParams())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	s.mu.Lock()
+	s.doors[report.Door] = &doorStatus{
+		Report:   *report,
+		Address:  c.RealIP(),
+		LastSeen: time.Now(),
+	}
+	s.mu.Unlock()
+
+	if !report.Healthy {
+		c.Logger().Warnf("Door '%s' is unhealthy: %s", report.Door, report.Error)
+	}
+
+	update, latest, ok := s.update(report.Version)
+	if !ok {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "no access list has been published yet")
+	}
+
+	etag := acl.ETag(latest)
+	c.Response().Header().Set("ETag", etag)
+
+	if report.Version == latest && c.Request().Header.Get("If-None-Match") == etag {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	return c.JSON(http.StatusOK, update)
+}
+
+// Lists the last report received from each door
+func (s *Server) GetDoors(c echo.Context) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	doors := make([]*doorStatus, 0, len(s.doors))
+	for _, status := range s.doors {
+		doors = append(doors, status)
+	}
+
+	sort.Slice(doors, func(i, j int) bool {
+		return doors[i].Door < doors[j].Door
+	})
+
+	return c.JSON(http.StatusOK, doors)
+}
+
+// Handles an audit log upload from a door
+func (s *Server) PostAudit(c echo.Context) error {
+	if c.Param("realm") != s.realm {
+		return echo.NewHTTPError(http.StatusNotFound, "unknown realm")
+	}
+
+	door := c.QueryParam("door")
+	if door == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "door is required")
+	}
+
+	var upload audit.Upload
+	if err := c.Bind(&upload); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	held := s.audits[door]
+	records := upload.Records
+
+	var last *audit.Record
+	if len(held) > 0 {
+		last = &held[len(held)-1]
+
+		// Skip records already held, sent again after a lost acknowledgement
+		for len(records) > 0 && records[0].Seq <= last.Seq {
+			if records[0].Seq >= held[0].Seq && held[records[0].Seq-held[0].Seq].Hash != records[0].Hash {
+				c.Logger().Errorf("Door '%s' sent a different record %d than before, its audit log may have been tampered with", door, records[0].Seq)
+				return c.JSON(http.StatusConflict, &audit.Ack{Acknowledged: last.Seq})
+			}
+
+			records = records[1:]
+		}
+	}
+
+	if err := audit.VerifyChain(last, records); err != nil {
+		c.Logger().Warnf("Rejected audit records from door '%s': %s", door, err)
+
+		ack := new(audit.Ack)
+		if last != nil {
+			ack.Acknowledged = last.Seq
+		}
+
+		return c.JSON(http.StatusConflict, ack)
+	}
+
+	held = append(held, records...)
+	s.audits[door] = held
+
+	for _, record := range records {
+		c.Logger().Infof("Door '%s' audit %d: %s %s: %s", door, record.Seq, record.Decision, record.UID, record.Reason)
+	}
+
+	ack := new(audit.Ack)
+	if len(held) > 0 {
+		ack.Acknowledged = held[len(held)-1].Seq
+	}
+
+	return c.JSON(http.StatusOK, ack)
+}
+
+// Lists the audit records uploaded by a door
+func (s *Server) GetAudit(c echo.Context) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	records := s.audits[c.QueryParam("door")]
+	if records == nil {
+		records = []audit.Record{}
+	}
+
+	return c.JSON(http.StatusOK, records)
+}
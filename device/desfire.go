@@ -0,0 +1,867 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package device
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ComputerScienceHouse/gatekeeper/keys"
+	"github.com/ComputerScienceHouse/gatekeeper/sig"
+	"github.com/fuzxxl/freefare/0.3/freefare"
+	"github.com/google/uuid"
+	"github.com/labstack/gommon/log"
+	"math/big"
+	"strings"
+)
+
+// baseAppId represents the first AID within a MiFare Classic mapped AID
+// (0xF....?) in the middle (0x7F) of an unassigned function cluster (0xF7)
+const baseAppId uint32 = 0xff77f0
+
+// ErrSignatureInvalid is returned by Authenticate when a target's UUID is not
+// signed by the realm, e.g. a forged or cloned card
+var ErrSignatureInvalid = errors.New("target UUID failed signature verification")
+
+// maxSlot represents the highest realm slot, relative to baseAppId
+const maxSlot uint32 = 15
+
+// masterAppId represents the master AID, used for PICC master key derivation
+const masterAppId uint32 = 0
+
+// The default master/application keys; for uninitialized cards and newly created applications, this is all zeros
+var (
+	defaultDESKey        = [8]byte{0x0}
+	defaultAESKey        = [16]byte{0x0}
+	defaultDESFireDESKey = keys.NewDESFireDESKey(defaultDESKey)
+	defaultDESFireAESKey = keys.NewDESFireAESKey(defaultAESKey, 0)
+)
+
+// MiFare application settings
+const (
+	initialApplicationSettings byte = 0x9
+	finalApplicationSettings   byte = 0xE0
+	defaultPICCSettings        byte = 0x0F
+	initialPICCSettings        byte = 0x09
+	finalPICCSettings          byte = 0x08
+)
+
+// File ACLs
+var (
+	// Read: Key 0, Write: Key 0, Read & Write: Key 0, Change Access Rights: Key 0
+	initialFileSettings = freefare.MakeDESFireAccessRights(0x0, 0x0, 0x0, 0x0)
+
+	// Read: Key 1, Write: Never, Read & Write: Never, Change Access Rights: Never
+	finalUUIDFileSettings = freefare.MakeDESFireAccessRights(0x1, 0xF, 0xF, 0xF)
+
+	// Read: Key 2, Write: Never, Read & Write: Never, Change Access Rights: Key 3
+	finalAuthenticityFileSettings = freefare.MakeDESFireAccessRights(0x2, 0xF, 0x3, 0x3)
+)
+
+// UUID file parameters
+const (
+	mangledUUIDLength = 32
+)
+
+// Authenticity file parameters
+const (
+	authenticityRLength  = 48
+	authenticitySLength  = 48
+	authenticityFileSize = authenticityRLength + authenticitySLength
+)
+
+// Represents the outcome of issuing realms to a target
+type IssueResult struct {
+	// The real UID of the target, from which its keys are derived
+	UID string
+
+	// The slots written to the target, and those skipped as they already existed
+	Written []uint32
+	Skipped []uint32
+}
+
+// Random UID parameters; a random UID is 4 bytes long and starts with 0x08
+const (
+	randomUIDLength = 8
+	randomUIDPrefix = "08"
+)
+
+// isRandomUID reports whether an anti-collision UID is a random UID, rather than the real card UID
+func isRandomUID(uid string) bool {
+	return len(uid) == randomUIDLength && strings.HasPrefix(uid, randomUIDPrefix)
+}
+
+// resolveUID returns the real UID of the target. Targets with random UIDs
+// enabled only reveal it after authenticating, which is attempted with the
+// default PICC master key and then with each realm's read key.
+func resolveUID(target DESFireTarget, realms []Realm, log log.Logger) (string, error) {
+	uid := target.UID()
+	if !isRandomUID(uid) {
+		return uid, nil
+	}
+
+	log.Infof("Target has a random UID, retrieving real UID...")
+
+	mAppId := freefare.NewDESFireAid(masterAppId)
+	if err := target.SelectApplication(mAppId); err != nil {
+		return "", err
+	}
+
+	if err := target.Authenticate(0, *defaultDESFireDESKey); err == nil {
+		return target.CardUID()
+	}
+
+	for _, realm := range realms {
+		appId := freefare.NewDESFireAid(baseAppId + realm.Slot)
+		if err := target.SelectApplication(appId); err != nil {
+			continue
+		}
+
+		if err := target.Authenticate(1, *keys.GenDESFireKey(realm.ReadKey)); err != nil {
+			continue
+		}
+
+		return target.CardUID()
+	}
+
+	return "", errors.New("unable to authenticate to target to retrieve its real UID")
+}
+
+// describeUID returns the real UID of the target for logging when it can be
+// retrieved without any keys, or the random UID otherwise
+func describeUID(target DESFireTarget) string {
+	uid := target.UID()
+	if !isRandomUID(uid) {
+		return uid
+	}
+
+	mAppId := freefare.NewDESFireAid(masterAppId)
+	if err := target.SelectApplication(mAppId); err != nil {
+		return uid + " (random)"
+	}
+
+	if err := target.Authenticate(0, *defaultDESFireDESKey); err != nil {
+		return uid + " (random)"
+	}
+
+	realUID, err := target.CardUID()
+	if err != nil {
+		return uid + " (random)"
+	}
+
+	return realUID
+}
+
+// fixedBytes returns the big-endian value left-padded to length bytes; R and S
+// values are occasionally shorter than the curve size, and are read back with
+// SetBytes, which ignores the leading zeros
+func fixedBytes(value *big.Int, length int) ([]byte, bool) {
+	valueBytes := value.Bytes()
+	if len(valueBytes) > length {
+		return nil, false
+	}
+
+	padded := make([]byte, length)
+	copy(padded[length-len(valueBytes):], valueBytes)
+	return padded, true
+}
+
+// issue provisions each realm as an application on the target. Tags which
+// have already been issued keep their other applications; realms whose slot
+// already exists are skipped, unless overwrite is set. Issued tags have random
+// UIDs enabled, so adding realms to them requires existingRealms, the realms
+// already on the tag, whose read keys are used to retrieve the real UID.
+func issue(ctx context.Context, target DESFireTarget, systemSecret []byte, realms, existingRealms []Realm, overwrite bool, log log.Logger) (*IssueResult, error) {
+	// Get the target's real UID, through the realms already on it or those being overwritten
+	lookupRealms := append(append([]Realm(nil), existingRealms...), realms...)
+	uid, err := resolveUID(target, lookupRealms, log)
+	if err != nil {
+		return nil, err
+	}
+
+	// Derive PICC master key
+	log.Infof("Deriving PICC master key...")
+	mAppId := freefare.NewDESFireAid(masterAppId)
+	piccMasterKey, err := keys.DeriveDESFireKey(systemSecret, mAppId, 0, []byte(uid))
+	if err != nil {
+		return nil, err
+	}
+
+	// Authenticate to the target, with the derived PICC master key if it has already been issued
+	log.Infof("Authenticating to tag...")
+	if err = target.SelectApplication(mAppId); err != nil {
+		return nil, err
+	}
+
+	piccKey := defaultDESFireDESKey
+	if err = target.Authenticate(0, *piccKey); err != nil {
+		log.Infof("Tag has already been issued, authenticating with derived PICC master key...")
+		piccKey = piccMasterKey
+		if err = target.Authenticate(0, *piccKey); err != nil {
+			return nil, err
+		}
+	}
+
+	// List the applications already present on the target
+	aids, err := target.ApplicationIds()
+	if err != nil {
+		return nil, err
+	}
+
+	existingApps := make(map[uint32]bool)
+	for _, aid := range aids {
+		existingApps[aid.Aid()] = true
+	}
+
+	result := &IssueResult{
+		UID: uid,
+	}
+
+	// Write each realm as an application
+	for _, realm := range realms {
+		// Only stop between realms, rather than part way through writing an application
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		appId := freefare.NewDESFireAid(baseAppId + realm.Slot)
+
+		if existingApps[appId.Aid()] && !overwrite {
+			log.Warnf("Slot %d already exists on tag, skipping '%s' realm", realm.Slot, realm.Name)
+			result.Skipped = append(result.Skipped, realm.Slot)
+			continue
+		}
+
+		uuidArr := []byte(realm.AssociationID.String())
+		mangledUUID := strings.Replace(realm.AssociationID.String(), "-", "", -1)
+
+		if len(mangledUUID) != mangledUUIDLength {
+			return nil, errors.New("unexpected size of mangled UUID")
+		}
+
+		log.Infof("Deriving application keys for '%s' realm...", realm.Name)
+
+		// Derive app master key
+		appMasterKey, err := keys.DeriveDESFireKey(systemSecret, appId, 0, []byte(uid))
+		if err != nil {
+			return nil, err
+		}
+
+		// Derive app transport keys
+		appReadKey := keys.GenDESFireKey(realm.ReadKey)
+		appAuthKey, err := keys.DeriveDESFireKey(systemSecret, appId, 2, uuidArr)
+		if err != nil {
+			return nil, err
+		}
+
+		appUpdateKey, err := keys.DeriveDESFireKey(systemSecret, appId, 3, uuidArr)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Infof("Creating authenticity data...")
+
+		// Sign the UUID and create the authenticity data
+		rData, sData, err := sig.Sign(realm.PrivateKey, uuidArr)
+		if err != nil {
+			return nil, err
+		}
+
+		rDataBytes, ok := fixedBytes(rData, authenticityRLength)
+		if !ok {
+			return nil, errors.New("unexpected size of authenticity data (R value)")
+		}
+
+		sDataBytes, ok := fixedBytes(sData, authenticitySLength)
+		if !ok {
+			return nil, errors.New("unexpected size of authenticity data (S value)")
+		}
+
+		// Ensure we're on the master application
+		log.Infof("Switching to the master application...")
+		if err = target.SelectApplication(mAppId); err != nil {
+			return nil, err
+		}
+
+		// Authenticate to the target
+		log.Infof("Authenticating to tag...")
+		if err = target.Authenticate(0, *piccKey); err != nil {
+			return nil, err
+		}
+
+		// Remove the existing application in this slot
+		if existingApps[appId.Aid()] {
+			log.Infof("Deleting existing application in slot %d...", realm.Slot)
+			if err = target.DeleteApplication(appId); err != nil {
+				return nil, err
+			}
+
+			// Deleting the selected application resets authentication
+			if err = target.Authenticate(0, *piccKey); err != nil {
+				return nil, err
+			}
+		}
+
+		// Create the application
+		log.Infof("Creating application in slot %d...", realm.Slot)
+		if err = target.CreateApplication(appId, initialApplicationSettings, 4|freefare.CryptoAES); err != nil {
+			return nil, err
+		}
+
+		// Select the newly created application
+		log.Infof("Selecting application...")
+		if err = target.SelectApplication(appId); err != nil {
+			return nil, err
+		}
+
+		// Authenticate to the application
+		log.Infof("Authenticating to application...")
+		if err = target.Authenticate(0, *defaultDESFireAESKey); err != nil {
+			return nil, err
+		}
+
+		// Change the application transport keys
+		log.Infof("Changing application transport keys...")
+		if err = target.ChangeKey(1, *appReadKey, *defaultDESFireAESKey); err != nil {
+			return nil, err
+		}
+
+		if err = target.ChangeKey(2, *appAuthKey, *defaultDESFireAESKey); err != nil {
+			return nil, err
+		}
+
+		if err = target.ChangeKey(3, *appUpdateKey, *defaultDESFireAESKey); err != nil {
+			return nil, err
+		}
+
+		// Create the UUID data file
+		log.Infof("Writing UUID data file...")
+		if err = target.CreateDataFile(1, freefare.Enciphered, initialFileSettings, mangledUUIDLength, false); err != nil {
+			return nil, err
+		}
+
+		dataLen, err := target.WriteData(1, 0, []byte(mangledUUID))
+		if err != nil {
+			return nil, err
+		}
+
+		if dataLen != mangledUUIDLength {
+			return nil, errors.New("failed to write UUID to target")
+		}
+
+		// Create the authenticity file
+		log.Infof("Writing authenticity file...")
+		if err = target.CreateDataFile(2, freefare.Enciphered, initialFileSettings, authenticityFileSize, false); err != nil {
+			return nil, err
+		}
+
+		// Write the R value to the authenticity file
+		dataLen, err = target.WriteData(2, 0, rDataBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		if dataLen != authenticityRLength {
+			return nil, errors.New("failed to write authenticity file (R value) to target")
+		}
+
+		// Append the S value to the authenticity file
+		dataLen, err = target.WriteData(2, authenticityRLength, sDataBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		if dataLen != authenticitySLength {
+			return nil, errors.New("failed to write authenticity file (S value) to target")
+		}
+
+		log.Infof("Applying file ACLs...")
+		if err = target.ChangeFileSettings(1, freefare.Enciphered, finalUUIDFileSettings); err != nil {
+			return nil, err
+		}
+
+		if err = target.ChangeFileSettings(2, freefare.Enciphered, finalAuthenticityFileSettings); err != nil {
+			return nil, err
+		}
+
+		// Change the application master key
+		log.Infof("Changing application master key...")
+		if err = target.ChangeKey(0, *appMasterKey, *defaultDESFireAESKey); err != nil {
+			return nil, err
+		}
+
+		// Re-authenticate to the application
+		if err = target.Authenticate(0, *appMasterKey); err != nil {
+			return nil, err
+		}
+
+		// Change the application key settings
+		log.Infof("Finalizing application settings...")
+		if err = target.ChangeKeySettings(finalApplicationSettings); err != nil {
+			return nil, err
+		}
+
+		result.Written = append(result.Written, realm.Slot)
+	}
+
+	if piccKey == piccMasterKey {
+		// The PICC master key and settings were finalized when the tag was first issued
+		return result, nil
+	}
+
+	// Switch back to the master application
+	log.Infof("Switching to the master application...")
+	if err = target.SelectApplication(mAppId); err != nil {
+		return nil, err
+	}
+
+	// Authenticate to the target
+	log.Infof("Authenticating to tag...")
+	if err = target.Authenticate(0, *defaultDESFireDESKey); err != nil {
+		return nil, err
+	}
+
+	// Change the key settings to allow us to change the PICC master key
+	if err = target.ChangeKeySettings(initialPICCSettings); err != nil {
+		return nil, err
+	}
+
+	// Change the PICC master key
+	log.Infof("Changing PICC master key...")
+	if err = target.ChangeKey(0, *piccMasterKey, *defaultDESFireDESKey); err != nil {
+		return nil, err
+	}
+
+	// Re-authenticate to the target
+	if err = target.Authenticate(0, *piccMasterKey); err != nil {
+		return nil, err
+	}
+
+	// Set the final key settings
+	log.Infof("Finalizing PICC settings...")
+	if err = target.ChangeKeySettings(finalPICCSettings); err != nil {
+		return nil, err
+	}
+
+	// Enable random UID
+	log.Infof("Enabling random PICC UID...")
+	if err = target.SetConfiguration(false, true); err != nil {
+		return nil, err
+	}
+
+	// Successfully issued card
+	return result, nil
+}
+
+// revoke removes a single realm's application from the target, leaving any other realms intact
+func revoke(ctx context.Context, target DESFireTarget, systemSecret []byte, realm Realm, log log.Logger) (string, error) {
+	// Get the target's real UID
+	uid, err := resolveUID(target, []Realm{realm}, log)
+	if err != nil {
+		return "", err
+	}
+
+	appId := freefare.NewDESFireAid(baseAppId + realm.Slot)
+
+	// Derive app master key
+	log.Infof("Deriving application master key for '%s' realm...", realm.Name)
+	appMasterKey, err := keys.DeriveDESFireKey(systemSecret, appId, 0, []byte(uid))
+	if err != nil {
+		return "", err
+	}
+
+	// Select the realm's application
+	log.Infof("Selecting application in slot %d...", realm.Slot)
+	if err = target.SelectApplication(appId); err != nil {
+		return "", err
+	}
+
+	// Authenticate to the application
+	log.Infof("Authenticating to application...")
+	if err = target.Authenticate(0, *appMasterKey); err != nil {
+		return "", err
+	}
+
+	if err = ctx.Err(); err != nil {
+		return "", err
+	}
+
+	// Delete the application
+	log.Infof("Deleting application...")
+	if err = target.DeleteApplication(appId); err != nil {
+		return "", err
+	}
+
+	return uid, nil
+}
+
+// format removes every application from the target and resets its PICC
+// master key and settings to the factory defaults
+func format(ctx context.Context, target DESFireTarget, systemSecret []byte, realms []Realm, log log.Logger) (string, error) {
+	// Get the target's real UID
+	uid, err := resolveUID(target, realms, log)
+	if err != nil {
+		return "", err
+	}
+
+	// Derive PICC master key
+	log.Infof("Deriving PICC master key...")
+	mAppId := freefare.NewDESFireAid(masterAppId)
+	piccMasterKey, err := keys.DeriveDESFireKey(systemSecret, mAppId, 0, []byte(uid))
+	if err != nil {
+		return "", err
+	}
+
+	// Ensure we're on the master application
+	log.Infof("Switching to the master application...")
+	if err = target.SelectApplication(mAppId); err != nil {
+		return "", err
+	}
+
+	// Authenticate to the target, falling back to the default key for tags which were never issued
+	log.Infof("Authenticating to tag...")
+	piccKey := piccMasterKey
+	if err = target.Authenticate(0, *piccKey); err != nil {
+		log.Infof("Tag is not using the derived PICC master key, authenticating with default key...")
+		piccKey = defaultDESFireDESKey
+		if err = target.Authenticate(0, *piccKey); err != nil {
+			return "", err
+		}
+	}
+
+	if err = ctx.Err(); err != nil {
+		return "", err
+	}
+
+	// Format tag
+	log.Infof("Formatting tag...")
+	if err = target.FormatPICC(); err != nil {
+		return "", err
+	}
+
+	if piccKey == defaultDESFireDESKey {
+		// Nothing else to reset
+		return uid, nil
+	}
+
+	// Change the key settings to allow us to change the PICC master key
+	if err = target.ChangeKeySettings(initialPICCSettings); err != nil {
+		return "", err
+	}
+
+	// Reset the PICC master key
+	log.Infof("Resetting PICC master key...")
+	if err = target.ChangeKey(0, *defaultDESFireDESKey, *piccMasterKey); err != nil {
+		return "", err
+	}
+
+	// Re-authenticate to the target
+	if err = target.Authenticate(0, *defaultDESFireDESKey); err != nil {
+		return "", err
+	}
+
+	// Restore the factory key settings
+	log.Infof("Resetting PICC settings...")
+	if err = target.ChangeKeySettings(defaultPICCSettings); err != nil {
+		return "", err
+	}
+
+	return uid, nil
+}
+
+// Represents the contents of a target, as reported by inspect
+type CardInfo struct {
+	UID          string            `json:"uid"`
+	RandomUID    bool              `json:"randomUid"`
+	Version      *CardVersion      `json:"version,omitempty"`
+	FreeMemory   uint32            `json:"freeMemory"`
+	Applications []ApplicationInfo `json:"applications"`
+	Realms       []RealmInfo       `json:"realms"`
+	Errors       []string          `json:"errors,omitempty"`
+}
+
+type CardVersion struct {
+	HardwareVersion string `json:"hardwareVersion"`
+	SoftwareVersion string `json:"softwareVersion"`
+	StorageSize     uint32 `json:"storageSize"`
+}
+
+type ApplicationInfo struct {
+	AID         string     `json:"aid"`
+	Slot        uint32     `json:"slot"`
+	KeySettings *byte      `json:"keySettings,omitempty"`
+	MaxKeys     *byte      `json:"maxKeys,omitempty"`
+	Files       []FileInfo `json:"files"`
+	Error       string     `json:"error,omitempty"`
+}
+
+type FileInfo struct {
+	FileNo                byte   `json:"fileNo"`
+	FileType              byte   `json:"fileType"`
+	CommunicationSettings byte   `json:"communicationSettings"`
+	AccessRights          uint16 `json:"accessRights"`
+	FileSize              uint32 `json:"fileSize"`
+}
+
+type RealmInfo struct {
+	Name          string `json:"name"`
+	Slot          uint32 `json:"slot"`
+	Authenticated bool   `json:"authenticated"`
+	AssociationID string `json:"associationId,omitempty"`
+	Matches       bool   `json:"matches"`
+	Error         string `json:"error,omitempty"`
+}
+
+// inspect reports the contents of the target without modifying it. The
+// system secret is optional, and used to authenticate to the PICC and each
+// application to list their contents; each realm is authenticated in turn.
+func inspect(ctx context.Context, target DESFireTarget, systemSecret []byte, realms []Realm, log log.Logger) (*CardInfo, error) {
+	info := &CardInfo{
+		UID:          target.UID(),
+		RandomUID:    isRandomUID(target.UID()),
+		Applications: make([]ApplicationInfo, 0),
+		Realms:       make([]RealmInfo, 0),
+	}
+
+	// Get the target's real UID
+	uid, err := resolveUID(target, realms, log)
+	if err != nil {
+		info.Errors = append(info.Errors, fmt.Sprintf("unable to retrieve real UID: %s", err))
+	} else {
+		info.UID = uid
+	}
+
+	// Ensure we're on the master application
+	mAppId := freefare.NewDESFireAid(masterAppId)
+	if err = target.SelectApplication(mAppId); err != nil {
+		return nil, err
+	}
+
+	log.Infof("Reading tag version...")
+	version, err := target.Version()
+	if err != nil {
+		info.Errors = append(info.Errors, fmt.Sprintf("unable to read version: %s", err))
+	} else {
+		info.Version = &CardVersion{
+			HardwareVersion: fmt.Sprintf("%d.%d", version.Hardware.VersionMajor, version.Hardware.VersionMinor),
+			SoftwareVersion: fmt.Sprintf("%d.%d", version.Software.VersionMajor, version.Software.VersionMinor),
+			StorageSize:     1 << (version.Hardware.StorageSize >> 1),
+		}
+	}
+
+	freeMem, err := target.FreeMem()
+	if err != nil {
+		info.Errors = append(info.Errors, fmt.Sprintf("unable to read free memory: %s", err))
+	} else {
+		info.FreeMemory = freeMem
+	}
+
+	// Authenticate to the target if possible, as listing applications may require the PICC master key
+	log.Infof("Authenticating to tag...")
+	if err = target.Authenticate(0, *defaultDESFireDESKey); err != nil && systemSecret != nil && uid != "" {
+		piccMasterKey, err := keys.DeriveDESFireKey(systemSecret, mAppId, 0, []byte(uid))
+		if err != nil {
+			return nil, err
+		}
+
+		if err = target.Authenticate(0, *piccMasterKey); err != nil {
+			info.Errors = append(info.Errors, fmt.Sprintf("unable to authenticate to tag: %s", err))
+		}
+	}
+
+	log.Infof("Listing applications...")
+	aids, err := target.ApplicationIds()
+	if err != nil {
+		info.Errors = append(info.Errors, fmt.Sprintf("unable to list applications: %s", err))
+	}
+
+	for _, aid := range aids {
+		if aid.Aid() < baseAppId || aid.Aid() > baseAppId+maxSlot {
+			// Not a gatekeeper application
+			continue
+		}
+
+		appInfo := ApplicationInfo{
+			AID:   fmt.Sprintf("%06x", aid.Aid()),
+			Slot:  aid.Aid() - baseAppId,
+			Files: make([]FileInfo, 0),
+		}
+
+		if err := inspectApplication(target, systemSecret, uid, aid, &appInfo); err != nil {
+			appInfo.Error = err.Error()
+		}
+
+		log.Infof("Found application %s in slot %d", appInfo.AID, appInfo.Slot)
+		info.Applications = append(info.Applications, appInfo)
+	}
+
+	// Authenticate each realm, without stopping at the first failure
+	for _, realm := range realms {
+		log.Infof("Authenticating '%s' realm...", realm.Name)
+
+		realmInfo := RealmInfo{
+			Name: realm.Name,
+			Slot: realm.Slot,
+		}
+
+		targetUUID, err := authenticate(ctx, target, realm, log)
+		if err != nil {
+			realmInfo.Error = err.Error()
+		} else {
+			realmInfo.Authenticated = true
+			realmInfo.AssociationID = targetUUID.String()
+			realmInfo.Matches = *targetUUID == realm.AssociationID
+		}
+
+		info.Realms = append(info.Realms, realmInfo)
+	}
+
+	return info, nil
+}
+
+// inspectApplication reads the key and file settings of an application
+func inspectApplication(target DESFireTarget, systemSecret []byte, uid string, aid freefare.DESFireAid, appInfo *ApplicationInfo) error {
+	if err := target.SelectApplication(aid); err != nil {
+		return err
+	}
+
+	// Authenticate with the application master key if possible, as it may be required for listing
+	if systemSecret != nil && uid != "" {
+		appMasterKey, err := keys.DeriveDESFireKey(systemSecret, aid, 0, []byte(uid))
+		if err != nil {
+			return err
+		}
+
+		if err = target.Authenticate(0, *appMasterKey); err != nil {
+			return err
+		}
+	}
+
+	settings, maxKeys, err := target.KeySettings()
+	if err != nil {
+		return err
+	}
+
+	appInfo.KeySettings = &settings
+	appInfo.MaxKeys = &maxKeys
+
+	fileIds, err := target.FileIds()
+	if err != nil {
+		return err
+	}
+
+	for _, fileNo := range fileIds {
+		fileSettings, err := target.FileSettings(fileNo)
+		if err != nil {
+			return err
+		}
+
+		appInfo.Files = append(appInfo.Files, FileInfo{
+			FileNo:                fileNo,
+			FileType:              fileSettings.FileType,
+			CommunicationSettings: fileSettings.CommunicationSettings,
+			AccessRights:          fileSettings.AccessRights,
+			FileSize:              fileSettings.FileSize,
+		})
+	}
+
+	return nil
+}
+
+// authenticate reads and verifies the realm association UUID stored on the target
+func authenticate(ctx context.Context, target DESFireTarget, realm Realm, log log.Logger) (*uuid.UUID, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	appId := freefare.NewDESFireAid(baseAppId + realm.Slot)
+	appReadKey := keys.GenDESFireKey(realm.ReadKey)
+
+	// Select the realm's application
+	if err := target.SelectApplication(appId); err != nil {
+		return nil, err
+	}
+
+	// Authenticate to the application
+	if err := target.Authenticate(1, *appReadKey); err != nil {
+		return nil, err
+	}
+
+	// Read the UUID from the application
+	mangledUUID := make([]byte, mangledUUIDLength)
+	dataLen, err := target.ReadData(1, 0, mangledUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	if dataLen != mangledUUIDLength {
+		return nil, errors.New("failed to read UUID from target")
+	}
+
+	// Parse the data read into a valid UUID
+	targetUUID, err := uuid.ParseBytes(mangledUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Derive the authentication key
+	appAuthKey, err := keys.DeriveDESFireKey(realm.AuthKey, appId, 2, []byte(targetUUID.String()))
+	if err != nil {
+		return nil, err
+	}
+
+	// Authenticate with the derived key
+	if err := target.Authenticate(2, *appAuthKey); err != nil {
+		return nil, err
+	}
+
+	// Read the authenticity data (R value) from the target
+	rDataBytes := make([]byte, authenticityRLength)
+	dataLen, err = target.ReadData(2, 0, rDataBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if dataLen != authenticityRLength {
+		return nil, errors.New("failed to read authenticity data (R value) from target")
+	}
+
+	// Read the authenticity data (S value) from the target
+	sDataBytes := make([]byte, authenticitySLength)
+	dataLen, err = target.ReadData(2, authenticityRLength, sDataBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if dataLen < authenticitySLength {
+		return nil, errors.New("failed to read authenticity data (S value) from target")
+	}
+
+	// Verify UUID signature
+	targetUUIDBytes := []byte(targetUUID.String())
+	rData, sData := new(big.Int), new(big.Int)
+	rData.SetBytes(rDataBytes)
+	sData.SetBytes(sDataBytes)
+
+	if !sig.Verify(realm.PublicKey, targetUUIDBytes, rData, sData) {
+		return nil, ErrSignatureInvalid
+	}
+
+	// Authenticated, return the UUID
+	return &targetUUID, nil
+}
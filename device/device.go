@@ -0,0 +1,93 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package device
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"github.com/ComputerScienceHouse/gatekeeper/keys"
+	"github.com/fuzxxl/freefare/0.3/freefare"
+	"github.com/google/uuid"
+	"github.com/labstack/gommon/log"
+)
+
+// Represents a reader backend capable of provisioning and authenticating DESFire targets
+type Reader interface {
+	Connect(ctx context.Context, log log.Logger) (DESFireTarget, error)
+	Issue(ctx context.Context, target DESFireTarget, systemSecret []byte, realms, existingRealms []Realm, overwrite bool, log log.Logger) (*IssueResult, error)
+	Authenticate(ctx context.Context, target DESFireTarget, realm Realm, log log.Logger) (*uuid.UUID, error)
+	Revoke(ctx context.Context, target DESFireTarget, systemSecret []byte, realm Realm, log log.Logger) (string, error)
+	Format(ctx context.Context, target DESFireTarget, systemSecret []byte, realms []Realm, log log.Logger) (string, error)
+	Inspect(ctx context.Context, target DESFireTarget, systemSecret []byte, realms []Realm, log log.Logger) (*CardInfo, error)
+	Disconnect(target DESFireTarget, log log.Logger) error
+	Info() ReaderInfo
+	Close(log log.Logger) error
+}
+
+// Describes an open reader
+type ReaderInfo struct {
+	Name           string `json:"name"`
+	Connstring     string `json:"connstring"`
+	LibraryVersion string `json:"libraryVersion,omitempty"`
+}
+
+// Represents the subset of DESFire EV1 commands used to provision and authenticate a target
+type DESFireTarget interface {
+	UID() string
+	String() string
+	Connect() error
+	Disconnect() error
+	SelectApplication(aid freefare.DESFireAid) error
+	Authenticate(keyNo byte, key keys.DESFireKey) error
+	ChangeKey(keyNo byte, newKey, oldKey keys.DESFireKey) error
+	ChangeKeySettings(settings byte) error
+	CreateApplication(aid freefare.DESFireAid, settings, keyNo byte) error
+	DeleteApplication(aid freefare.DESFireAid) error
+	ApplicationIds() ([]freefare.DESFireAid, error)
+	CreateDataFile(fileNo byte, communicationSettings byte, accessRights uint16, fileSize uint32, backup bool) error
+	ChangeFileSettings(file, communicationSettings byte, accessRights uint16) error
+	ReadData(file byte, offset int64, buf []byte) (int, error)
+	WriteData(file byte, offset int64, data []byte) (int, error)
+	SetConfiguration(disableFormat, enableRandomUID bool) error
+	CardUID() (string, error)
+	FormatPICC() error
+	Version() (freefare.DESFireVersionInfo, error)
+	FreeMem() (uint32, error)
+	KeySettings() (settings, maxKeys byte, err error)
+	FileIds() ([]byte, error)
+	FileSettings(file byte) (freefare.DESFireFileSettings, error)
+}
+
+// Ensure each backend conforms to the device interfaces
+var (
+	_ DESFireTarget = (*nfcTarget)(nil)
+	_ DESFireTarget = (*EmulatedTag)(nil)
+	_ Reader        = (*nfcDevice)(nil)
+	_ Reader        = (*EmulatedReader)(nil)
+)
+
+type Realm struct {
+	Name          string
+	Slot          uint32
+	AssociationID uuid.UUID
+	AuthKey       []byte
+	ReadKey       []byte
+	UpdateKey     []byte
+	PublicKey     *ecdsa.PublicKey
+	PrivateKey    *ecdsa.PrivateKey
+}
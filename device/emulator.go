@@ -0,0 +1,869 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package device
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/ComputerScienceHouse/gatekeeper/keys"
+	"github.com/fuzxxl/freefare/0.3/freefare"
+	"github.com/google/uuid"
+	"github.com/labstack/gommon/log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Emulated card parameters, modelled after a 4K DESFire EV1
+const (
+	emulatedStorageSize   uint32 = 4096
+	emulatedAppOverhead   uint32 = 64
+	emulatedFileBlockSize uint32 = 32
+	emulatedMaxApps              = 28
+	emulatedMaxFiles             = 32
+	emulatedMaxKeys              = 14
+)
+
+// Emulated version information; the storage size is encoded as log2(4096) << 1
+const (
+	emulatedVersionMajor    = 1
+	emulatedVersionMinor    = 0
+	emulatedStorageSizeCode = 0x18
+)
+
+// DESFire key settings bits
+const (
+	keySettingAllowChangeMK         byte = 0x01
+	keySettingFreeListing           byte = 0x02
+	keySettingFreeCreateDelete      byte = 0x04
+	keySettingConfigurationWritable byte = 0x08
+)
+
+// DESFire file type of standard data files
+const standardDataFile byte = 0x00
+
+// Special access right key numbers
+const (
+	accessFree  byte = 0xE
+	accessNever byte = 0xF
+)
+
+// Status errors returned by the emulated target, mirroring the DESFire status codes
+var (
+	errEmulatorNotConnected = errors.New("emulator: target not connected")
+	errNoSuchKey            = errors.New("desfire: no such key")
+	errParameter            = errors.New("desfire: parameter error")
+	errPermissionDenied     = errors.New("desfire: permission denied")
+	errApplicationNotFound  = errors.New("desfire: application not found")
+	errAuthentication       = errors.New("desfire: authentication error")
+	errBoundary             = errors.New("desfire: boundary error")
+	errCount                = errors.New("desfire: count error")
+	errDuplicate            = errors.New("desfire: duplicate error")
+	errOutOfEEPROM          = errors.New("desfire: out of EEPROM")
+	errFileNotFound         = errors.New("desfire: file not found")
+	errIntegrity            = errors.New("desfire: integrity error")
+)
+
+type emulatedFile struct {
+	CommunicationSettings byte
+	AccessRights          uint16
+	Data                  []byte
+}
+
+type emulatedApp struct {
+	Settings byte
+	Crypto   byte
+	Keys     []keys.DESFireKey
+	Files    map[byte]*emulatedFile
+}
+
+// EmulatedTag is an in-memory DESFire EV1 target which enforces the same
+// key, key setting and file access right checks as a real card
+type EmulatedTag struct {
+	mu              sync.Mutex
+	uid             []byte
+	randomUID       []byte
+	piccKey         keys.DESFireKey
+	piccSettings    byte
+	apps            map[uint32]*emulatedApp
+	freeMem         uint32
+	formatDisabled  bool
+	randomUIDActive bool
+	connected       bool
+	selected        uint32
+	authKey         int
+}
+
+// Creates a factory fresh emulated target with the given UID
+func NewEmulatedTag(uid []byte) *EmulatedTag {
+	return &EmulatedTag{
+		uid:          uid,
+		piccKey:      *defaultDESFireDESKey,
+		piccSettings: 0x0F,
+		apps:         make(map[uint32]*emulatedApp),
+		freeMem:      emulatedStorageSize,
+		authKey:      -1,
+	}
+}
+
+// Creates a factory fresh emulated target with a random NXP UID
+func NewRandomEmulatedTag() (*EmulatedTag, error) {
+	uid := make([]byte, 7)
+	if _, err := rand.Read(uid); err != nil {
+		return nil, err
+	}
+
+	// NXP manufacturer code
+	uid[0] = 0x04
+
+	return NewEmulatedTag(uid), nil
+}
+
+func fileBlocks(size uint32) uint32 {
+	return (size + emulatedFileBlockSize - 1) / emulatedFileBlockSize * emulatedFileBlockSize
+}
+
+func (t *EmulatedTag) UID() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.randomUIDActive && t.randomUID != nil {
+		return hex.EncodeToString(t.randomUID)
+	}
+
+	return hex.EncodeToString(t.uid)
+}
+
+func (t *EmulatedTag) String() string {
+	return "Mifare DESFire (emulated)"
+}
+
+func (t *EmulatedTag) Connect() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.randomUIDActive {
+		// Random UIDs are 4 bytes, starting with 0x08
+		t.randomUID = make([]byte, 4)
+		if _, err := rand.Read(t.randomUID); err != nil {
+			return err
+		}
+		t.randomUID[0] = 0x08
+	}
+
+	t.connected = true
+	t.selected = masterAppId
+	t.authKey = -1
+	return nil
+}
+
+func (t *EmulatedTag) Disconnect() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.connected {
+		return errEmulatorNotConnected
+	}
+
+	t.connected = false
+	t.authKey = -1
+	return nil
+}
+
+// keySet returns the key set and key settings of the selected application
+func (t *EmulatedTag) keySet() ([]keys.DESFireKey, byte) {
+	if t.selected == masterAppId {
+		return []keys.DESFireKey{t.piccKey}, t.piccSettings
+	}
+
+	app := t.apps[t.selected]
+	return app.Keys, app.Settings
+}
+
+func (t *EmulatedTag) app() (*emulatedApp, error) {
+	if t.selected == masterAppId {
+		return nil, errPermissionDenied
+	}
+
+	return t.apps[t.selected], nil
+}
+
+func (t *EmulatedTag) SelectApplication(aid freefare.DESFireAid) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.connected {
+		return errEmulatorNotConnected
+	}
+
+	appId := aid.Aid()
+	if _, ok := t.apps[appId]; appId != masterAppId && !ok {
+		return errApplicationNotFound
+	}
+
+	t.selected = appId
+	t.authKey = -1
+	return nil
+}
+
+func (t *EmulatedTag) Authenticate(keyNo byte, key keys.DESFireKey) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.connected {
+		return errEmulatorNotConnected
+	}
+
+	t.authKey = -1
+
+	appKeys, _ := t.keySet()
+	if int(keyNo) >= len(appKeys) {
+		return errNoSuchKey
+	}
+
+	if appKeys[keyNo] != key {
+		return errAuthentication
+	}
+
+	t.authKey = int(keyNo)
+	return nil
+}
+
+func (t *EmulatedTag) ChangeKey(keyNo byte, newKey, oldKey keys.DESFireKey) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.connected {
+		return errEmulatorNotConnected
+	}
+
+	if t.authKey < 0 {
+		return errAuthentication
+	}
+
+	appKeys, settings := t.keySet()
+	if int(keyNo) >= len(appKeys) {
+		return errNoSuchKey
+	}
+
+	if keyNo == 0 {
+		// The master key may only be changed by itself, and only while allowed by the key settings
+		if t.authKey != 0 || settings&keySettingAllowChangeMK == 0 {
+			return errPermissionDenied
+		}
+	} else {
+		changeKey := settings >> 4
+		switch {
+		case changeKey == accessNever:
+			return errPermissionDenied
+		case changeKey == accessFree && t.authKey != int(keyNo):
+			// 0xE requires authentication with the key being changed
+			return errPermissionDenied
+		case changeKey != accessFree && t.authKey != int(changeKey):
+			return errPermissionDenied
+		}
+	}
+
+	// Changing a key other than the authenticated one requires the current key
+	if t.authKey != int(keyNo) && appKeys[keyNo] != oldKey {
+		return errIntegrity
+	}
+
+	appKeys[keyNo] = newKey
+	if t.selected == masterAppId {
+		t.piccKey = newKey
+	}
+
+	// Changing the authenticated key ends the session
+	if t.authKey == int(keyNo) {
+		t.authKey = -1
+	}
+
+	return nil
+}
+
+func (t *EmulatedTag) ChangeKeySettings(settings byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.connected {
+		return errEmulatorNotConnected
+	}
+
+	_, current := t.keySet()
+	if t.authKey != 0 {
+		return errAuthentication
+	}
+
+	if current&keySettingConfigurationWritable == 0 {
+		return errPermissionDenied
+	}
+
+	if t.selected == masterAppId {
+		t.piccSettings = settings
+	} else {
+		t.apps[t.selected].Settings = settings
+	}
+
+	return nil
+}
+
+func (t *EmulatedTag) CreateApplication(aid freefare.DESFireAid, settings, keyNo byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.connected {
+		return errEmulatorNotConnected
+	}
+
+	if t.selected != masterAppId {
+		return errPermissionDenied
+	}
+
+	if t.authKey != 0 && t.piccSettings&keySettingFreeCreateDelete == 0 {
+		return errPermissionDenied
+	}
+
+	appId := aid.Aid()
+	if appId == masterAppId {
+		return errParameter
+	}
+
+	if _, ok := t.apps[appId]; ok {
+		return errDuplicate
+	}
+
+	if len(t.apps) >= emulatedMaxApps {
+		return errCount
+	}
+
+	numKeys := int(keyNo & 0x0F)
+	if numKeys < 1 || numKeys > emulatedMaxKeys {
+		return errParameter
+	}
+
+	if t.freeMem < emulatedAppOverhead {
+		return errOutOfEEPROM
+	}
+
+	defaultKey := *defaultDESFireDESKey
+	if keyNo&freefare.CryptoAES != 0 {
+		defaultKey = *defaultDESFireAESKey
+	}
+
+	appKeys := make([]keys.DESFireKey, numKeys)
+	for i := range appKeys {
+		appKeys[i] = defaultKey
+	}
+
+	t.apps[appId] = &emulatedApp{
+		Settings: settings,
+		Crypto:   keyNo &^ 0x0F,
+		Keys:     appKeys,
+		Files:    make(map[byte]*emulatedFile),
+	}
+	t.freeMem -= emulatedAppOverhead
+
+	return nil
+}
+
+func (t *EmulatedTag) DeleteApplication(aid freefare.DESFireAid) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.connected {
+		return errEmulatorNotConnected
+	}
+
+	appId := aid.Aid()
+	if _, ok := t.apps[appId]; !ok {
+		return errApplicationNotFound
+	}
+
+	// Requires the PICC master key, or the master key of the application itself
+	switch {
+	case t.selected == masterAppId && (t.authKey == 0 || t.piccSettings&keySettingFreeCreateDelete != 0):
+	case t.selected == appId && t.authKey == 0:
+	default:
+		return errPermissionDenied
+	}
+
+	// Memory is only reclaimed when the PICC is formatted
+	delete(t.apps, appId)
+	t.selected = masterAppId
+	t.authKey = -1
+	return nil
+}
+
+func (t *EmulatedTag) ApplicationIds() ([]freefare.DESFireAid, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.connected {
+		return nil, errEmulatorNotConnected
+	}
+
+	if t.selected != masterAppId {
+		return nil, errPermissionDenied
+	}
+
+	if t.authKey != 0 && t.piccSettings&keySettingFreeListing == 0 {
+		return nil, errAuthentication
+	}
+
+	appIds := make([]uint32, 0, len(t.apps))
+	for appId := range t.apps {
+		appIds = append(appIds, appId)
+	}
+	sort.Slice(appIds, func(i, j int) bool { return appIds[i] < appIds[j] })
+
+	aids := make([]freefare.DESFireAid, len(appIds))
+	for i, appId := range appIds {
+		aids[i] = freefare.NewDESFireAid(appId)
+	}
+
+	return aids, nil
+}
+
+func (t *EmulatedTag) CreateDataFile(fileNo byte, communicationSettings byte, accessRights uint16, fileSize uint32, backup bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.connected {
+		return errEmulatorNotConnected
+	}
+
+	app, err := t.app()
+	if err != nil {
+		return err
+	}
+
+	if t.authKey != 0 && app.Settings&keySettingFreeCreateDelete == 0 {
+		return errPermissionDenied
+	}
+
+	if fileNo >= emulatedMaxFiles {
+		return errParameter
+	}
+
+	if _, ok := app.Files[fileNo]; ok {
+		return errDuplicate
+	}
+
+	if t.freeMem < fileBlocks(fileSize) {
+		return errOutOfEEPROM
+	}
+
+	app.Files[fileNo] = &emulatedFile{
+		CommunicationSettings: communicationSettings,
+		AccessRights:          accessRights,
+		Data:                  make([]byte, fileSize),
+	}
+	t.freeMem -= fileBlocks(fileSize)
+
+	return nil
+}
+
+// fileAccess checks the authenticated key against a file access right
+func (t *EmulatedTag) fileAccess(rights ...byte) error {
+	for _, right := range rights {
+		if right == accessFree || (t.authKey >= 0 && int(right) == t.authKey) {
+			return nil
+		}
+	}
+
+	return errAuthentication
+}
+
+func (t *EmulatedTag) file(fileNo byte) (*emulatedFile, error) {
+	app, err := t.app()
+	if err != nil {
+		return nil, err
+	}
+
+	file, ok := app.Files[fileNo]
+	if !ok {
+		return nil, errFileNotFound
+	}
+
+	return file, nil
+}
+
+func (t *EmulatedTag) ChangeFileSettings(fileNo, communicationSettings byte, accessRights uint16) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.connected {
+		return errEmulatorNotConnected
+	}
+
+	file, err := t.file(fileNo)
+	if err != nil {
+		return err
+	}
+
+	changeAccess := byte(file.AccessRights & 0xF)
+	if changeAccess == accessNever {
+		return errPermissionDenied
+	}
+
+	if err := t.fileAccess(changeAccess); err != nil {
+		return err
+	}
+
+	file.CommunicationSettings = communicationSettings
+	file.AccessRights = accessRights
+	return nil
+}
+
+func (t *EmulatedTag) ReadData(fileNo byte, offset int64, buf []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.connected {
+		return 0, errEmulatorNotConnected
+	}
+
+	file, err := t.file(fileNo)
+	if err != nil {
+		return 0, err
+	}
+
+	read := byte(file.AccessRights>>12) & 0xF
+	readWrite := byte(file.AccessRights>>4) & 0xF
+	if err := t.fileAccess(read, readWrite); err != nil {
+		return 0, err
+	}
+
+	if offset < 0 || offset+int64(len(buf)) > int64(len(file.Data)) {
+		return 0, errBoundary
+	}
+
+	return copy(buf, file.Data[offset:]), nil
+}
+
+func (t *EmulatedTag) WriteData(fileNo byte, offset int64, data []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.connected {
+		return 0, errEmulatorNotConnected
+	}
+
+	file, err := t.file(fileNo)
+	if err != nil {
+		return 0, err
+	}
+
+	write := byte(file.AccessRights>>8) & 0xF
+	readWrite := byte(file.AccessRights>>4) & 0xF
+	if err := t.fileAccess(write, readWrite); err != nil {
+		return 0, err
+	}
+
+	if offset < 0 || offset+int64(len(data)) > int64(len(file.Data)) {
+		return 0, errBoundary
+	}
+
+	return copy(file.Data[offset:], data), nil
+}
+
+func (t *EmulatedTag) SetConfiguration(disableFormat, enableRandomUID bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.connected {
+		return errEmulatorNotConnected
+	}
+
+	if t.selected != masterAppId || t.authKey != 0 {
+		return errAuthentication
+	}
+
+	if t.piccSettings&keySettingConfigurationWritable == 0 {
+		return errPermissionDenied
+	}
+
+	// Neither option can be reverted once enabled
+	t.formatDisabled = t.formatDisabled || disableFormat
+	t.randomUIDActive = t.randomUIDActive || enableRandomUID
+	return nil
+}
+
+func (t *EmulatedTag) CardUID() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.connected {
+		return "", errEmulatorNotConnected
+	}
+
+	// The real UID is revealed after authenticating with any key
+	if t.authKey < 0 {
+		return "", errAuthentication
+	}
+
+	return hex.EncodeToString(t.uid), nil
+}
+
+func (t *EmulatedTag) FormatPICC() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.connected {
+		return errEmulatorNotConnected
+	}
+
+	if t.selected != masterAppId || t.authKey != 0 {
+		return errAuthentication
+	}
+
+	if t.formatDisabled {
+		return errPermissionDenied
+	}
+
+	// Formatting removes every application, but keeps the PICC master key and settings
+	t.apps = make(map[uint32]*emulatedApp)
+	t.freeMem = emulatedStorageSize
+	return nil
+}
+
+func (t *EmulatedTag) Version() (freefare.DESFireVersionInfo, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var version freefare.DESFireVersionInfo
+	if !t.connected {
+		return version, errEmulatorNotConnected
+	}
+
+	version.Hardware.VersionMajor = emulatedVersionMajor
+	version.Hardware.VersionMinor = emulatedVersionMinor
+	version.Hardware.StorageSize = emulatedStorageSizeCode
+	version.Software.VersionMajor = emulatedVersionMajor
+	version.Software.VersionMinor = emulatedVersionMinor
+	version.Software.StorageSize = emulatedStorageSizeCode
+	return version, nil
+}
+
+func (t *EmulatedTag) FreeMem() (uint32, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.connected {
+		return 0, errEmulatorNotConnected
+	}
+
+	return t.freeMem, nil
+}
+
+func (t *EmulatedTag) KeySettings() (settings, maxKeys byte, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.connected {
+		return 0, 0, errEmulatorNotConnected
+	}
+
+	appKeys, settings := t.keySet()
+	if t.authKey != 0 && settings&keySettingFreeListing == 0 {
+		return 0, 0, errAuthentication
+	}
+
+	maxKeys = byte(len(appKeys))
+	if t.selected != masterAppId {
+		maxKeys |= t.apps[t.selected].Crypto
+	}
+
+	return settings, maxKeys, nil
+}
+
+func (t *EmulatedTag) FileIds() ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.connected {
+		return nil, errEmulatorNotConnected
+	}
+
+	app, err := t.app()
+	if err != nil {
+		return nil, err
+	}
+
+	if t.authKey != 0 && app.Settings&keySettingFreeListing == 0 {
+		return nil, errAuthentication
+	}
+
+	fileIds := make([]byte, 0, len(app.Files))
+	for fileNo := range app.Files {
+		fileIds = append(fileIds, fileNo)
+	}
+	sort.Slice(fileIds, func(i, j int) bool { return fileIds[i] < fileIds[j] })
+
+	return fileIds, nil
+}
+
+func (t *EmulatedTag) FileSettings(fileNo byte) (freefare.DESFireFileSettings, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var settings freefare.DESFireFileSettings
+	if !t.connected {
+		return settings, errEmulatorNotConnected
+	}
+
+	app, err := t.app()
+	if err != nil {
+		return settings, err
+	}
+
+	if t.authKey != 0 && app.Settings&keySettingFreeListing == 0 {
+		return settings, errAuthentication
+	}
+
+	file, err := t.file(fileNo)
+	if err != nil {
+		return settings, err
+	}
+
+	settings.FileType = standardDataFile
+	settings.CommunicationSettings = file.CommunicationSettings
+	settings.AccessRights = file.AccessRights
+	settings.FileSize = uint32(len(file.Data))
+	return settings, nil
+}
+
+// EmulatedReader is an in-memory reader backend which presents emulated targets
+type EmulatedReader struct {
+	mu     sync.Mutex
+	tag    *EmulatedTag
+	closed bool
+}
+
+func NewEmulatedReader() *EmulatedReader {
+	return &EmulatedReader{}
+}
+
+// Places a target on the emulated reader
+func (r *EmulatedReader) Present(tag *EmulatedTag) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.tag = tag
+}
+
+// Removes the target from the emulated reader
+func (r *EmulatedReader) Remove() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.tag = nil
+}
+
+func (r *EmulatedReader) presented() (*EmulatedTag, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil, errors.New("emulated reader is closed")
+	}
+
+	return r.tag, nil
+}
+
+func (r *EmulatedReader) Info() ReaderInfo {
+	return ReaderInfo{
+		Name:       "DESFire EV1 emulator",
+		Connstring: "emulator",
+	}
+}
+
+func (r *EmulatedReader) Close(log log.Logger) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+
+	log.Infof("Emulated NFC device successfully closed")
+	return nil
+}
+
+func (r *EmulatedReader) Connect(ctx context.Context, log log.Logger) (DESFireTarget, error) {
+	log.Infof("Waiting for card...")
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Warnf("Stopped waiting for card: %s", ctx.Err())
+			return nil, ctx.Err()
+		case <-time.After(targetLoopTimer):
+		}
+
+		target, err := r.presented()
+		if err != nil {
+			log.Errorf("Failed to get tags from device: %s", err)
+			return nil, err
+		}
+
+		if target == nil {
+			// Keep polling until a tag is presented
+			continue
+		}
+
+		if err = target.Connect(); err != nil {
+			log.Warnf("Unable to connect to target, ignoring: %s", err)
+			continue
+		}
+
+		log.Infof("Connected to a %s target with UID %s", target.String(), describeUID(target))
+		return target, nil
+	}
+}
+
+func (r *EmulatedReader) Issue(ctx context.Context, target DESFireTarget, systemSecret []byte, realms, existingRealms []Realm, overwrite bool, log log.Logger) (*IssueResult, error) {
+	return issue(ctx, target, systemSecret, realms, existingRealms, overwrite, log)
+}
+
+func (r *EmulatedReader) Authenticate(ctx context.Context, target DESFireTarget, realm Realm, log log.Logger) (*uuid.UUID, error) {
+	return authenticate(ctx, target, realm, log)
+}
+
+func (r *EmulatedReader) Revoke(ctx context.Context, target DESFireTarget, systemSecret []byte, realm Realm, log log.Logger) (string, error) {
+	return revoke(ctx, target, systemSecret, realm, log)
+}
+
+func (r *EmulatedReader) Format(ctx context.Context, target DESFireTarget, systemSecret []byte, realms []Realm, log log.Logger) (string, error) {
+	return format(ctx, target, systemSecret, realms, log)
+}
+
+func (r *EmulatedReader) Inspect(ctx context.Context, target DESFireTarget, systemSecret []byte, realms []Realm, log log.Logger) (*CardInfo, error) {
+	return inspect(ctx, target, systemSecret, realms, log)
+}
+
+func (r *EmulatedReader) Disconnect(target DESFireTarget, log log.Logger) error {
+	if err := target.Disconnect(); err != nil {
+		log.Warnf("Unable to disconnect from target (already disconnected?): %s", err)
+		return err
+	}
+
+	log.Infof("Disconnected from target %s", target.UID())
+	return nil
+}
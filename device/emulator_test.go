@@ -0,0 +1,458 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package device
+
+import (
+	"context"
+	"crypto/rand"
+	"github.com/ComputerScienceHouse/gatekeeper/keys"
+	"github.com/ComputerScienceHouse/gatekeeper/sig"
+	"github.com/fuzxxl/freefare/0.3/freefare"
+	"github.com/google/uuid"
+	"github.com/labstack/gommon/log"
+	"io/ioutil"
+	"testing"
+)
+
+var testUID = []byte{0x04, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+
+func testLogger() log.Logger {
+	logger := log.New("test")
+	logger.SetOutput(ioutil.Discard)
+	return *logger
+}
+
+func testSecret(t *testing.T) []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		t.Fatal(err)
+	}
+
+	return secret
+}
+
+// testRealm creates a realm as a door sees it, where the auth and update keys
+// are the system secret the application keys are derived from
+func testRealm(t *testing.T, name string, slot uint32, systemSecret []byte) Realm {
+	privateKey, _, err := sig.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Realm{
+		Name:          name,
+		Slot:          slot,
+		AssociationID: uuid.New(),
+		AuthKey:       systemSecret,
+		ReadKey:       testSecret(t)[:16],
+		UpdateKey:     systemSecret,
+		PublicKey:     &privateKey.PublicKey,
+		PrivateKey:    privateKey,
+	}
+}
+
+// connectedTag returns a factory fresh tag, as presented to a reader
+func connectedTag(t *testing.T) *EmulatedTag {
+	tag := NewEmulatedTag(testUID)
+	if err := tag.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	return tag
+}
+
+func TestIssueAuthenticate(t *testing.T) {
+	ctx := context.Background()
+	systemSecret := testSecret(t)
+	realm := testRealm(t, "test", 1, systemSecret)
+	tag := connectedTag(t)
+
+	result, err := issue(ctx, tag, systemSecret, []Realm{realm}, nil, false, testLogger())
+	if err != nil {
+		t.Fatalf("issue: %s", err)
+	}
+
+	if result.UID != "04112233445566" {
+		t.Errorf("issue reported UID %s, want 04112233445566", result.UID)
+	}
+
+	if len(result.Written) != 1 || result.Written[0] != realm.Slot {
+		t.Errorf("issue wrote slots %v, want [%d]", result.Written, realm.Slot)
+	}
+
+	// Issued tags present a random UID from then on
+	if err := tag.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !tag.randomUIDActive {
+		t.Error("issue did not enable random UID")
+	}
+
+	firstUID := tag.UID()
+	if !isRandomUID(firstUID) {
+		t.Errorf("tag presented UID %s, want a random UID", firstUID)
+	}
+
+	if err := tag.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	if tag.UID() == firstUID {
+		t.Errorf("tag presented the same random UID %s twice", firstUID)
+	}
+
+	// The PICC master key has been changed from the default
+	if err := tag.SelectApplication(freefare.NewDESFireAid(masterAppId)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tag.Authenticate(0, *defaultDESFireDESKey); err != errAuthentication {
+		t.Errorf("authenticating with the default PICC key returned %v, want %v", err, errAuthentication)
+	}
+
+	targetUUID, err := authenticate(ctx, tag, realm, testLogger())
+	if err != nil {
+		t.Fatalf("authenticate: %s", err)
+	}
+
+	if *targetUUID != realm.AssociationID {
+		t.Errorf("authenticate returned %s, want %s", targetUUID, realm.AssociationID)
+	}
+
+	// The UUID must not verify against another realm's public key
+	forged := realm
+	forged.PublicKey = testRealm(t, "other", 1, systemSecret).PublicKey
+	if _, err := authenticate(ctx, tag, forged, testLogger()); err != ErrSignatureInvalid {
+		t.Errorf("authenticate with the wrong public key returned %v, want %v", err, ErrSignatureInvalid)
+	}
+
+	// Nor with the wrong auth key
+	wrongSecret := realm
+	wrongSecret.AuthKey = testSecret(t)
+	if _, err := authenticate(ctx, tag, wrongSecret, testLogger()); err != errAuthentication {
+		t.Errorf("authenticate with the wrong auth key returned %v, want %v", err, errAuthentication)
+	}
+}
+
+func TestIssueAddRealm(t *testing.T) {
+	ctx := context.Background()
+	systemSecret := testSecret(t)
+	realmA := testRealm(t, "a", 4, systemSecret)
+	realmB := testRealm(t, "b", 5, systemSecret)
+	tag := connectedTag(t)
+
+	if _, err := issue(ctx, tag, systemSecret, []Realm{realmA}, nil, false, testLogger()); err != nil {
+		t.Fatalf("issue realm A: %s", err)
+	}
+
+	if err := tag.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The real UID is hidden behind the random UID, and realm B's read key is not on the tag yet
+	if _, err := issue(ctx, tag, systemSecret, []Realm{realmB}, nil, false, testLogger()); err == nil {
+		t.Fatal("issue without existing realms succeeded on a tag with a random UID")
+	}
+
+	// Only the slot and read key of an existing realm are needed to retrieve it
+	existing := Realm{
+		Name:    realmA.Name,
+		Slot:    realmA.Slot,
+		ReadKey: realmA.ReadKey,
+	}
+
+	result, err := issue(ctx, tag, systemSecret, []Realm{realmB}, []Realm{existing}, false, testLogger())
+	if err != nil {
+		t.Fatalf("issue realm B: %s", err)
+	}
+
+	if result.UID != "04112233445566" {
+		t.Errorf("issue reported UID %s, want 04112233445566", result.UID)
+	}
+
+	if len(result.Written) != 1 || result.Written[0] != realmB.Slot {
+		t.Errorf("issue wrote slots %v, want [%d]", result.Written, realmB.Slot)
+	}
+
+	for _, realm := range []Realm{realmA, realmB} {
+		targetUUID, err := authenticate(ctx, tag, realm, testLogger())
+		if err != nil {
+			t.Errorf("authenticate realm %s: %s", realm.Name, err)
+			continue
+		}
+
+		if *targetUUID != realm.AssociationID {
+			t.Errorf("authenticate realm %s returned %s, want %s", realm.Name, targetUUID, realm.AssociationID)
+		}
+	}
+
+	// Issuing realm A again skips it, rather than overwriting it
+	result, err = issue(ctx, tag, systemSecret, []Realm{realmA}, []Realm{existing}, false, testLogger())
+	if err != nil {
+		t.Fatalf("re-issue realm A: %s", err)
+	}
+
+	if len(result.Written) != 0 || len(result.Skipped) != 1 || result.Skipped[0] != realmA.Slot {
+		t.Errorf("re-issue wrote %v and skipped %v, want to skip [%d]", result.Written, result.Skipped, realmA.Slot)
+	}
+}
+
+func TestIssuedFileACLs(t *testing.T) {
+	ctx := context.Background()
+	systemSecret := testSecret(t)
+	realm := testRealm(t, "test", 2, systemSecret)
+	tag := connectedTag(t)
+
+	if _, err := issue(ctx, tag, systemSecret, []Realm{realm}, nil, false, testLogger()); err != nil {
+		t.Fatalf("issue: %s", err)
+	}
+
+	appId := freefare.NewDESFireAid(baseAppId + realm.Slot)
+	appAuthKey, err := keys.DeriveDESFireKey(systemSecret, appId, 2, []byte(realm.AssociationID.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selectApp := func(keyNo byte, key keys.DESFireKey) {
+		t.Helper()
+		if err := tag.SelectApplication(appId); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := tag.Authenticate(keyNo, key); err != nil {
+			t.Fatalf("authenticate with key %d: %s", keyNo, err)
+		}
+	}
+
+	// The UUID file is readable with the read key, but can never be written or have its ACL changed
+	readKey := *keys.GenDESFireKey(realm.ReadKey)
+	selectApp(1, readKey)
+
+	buf := make([]byte, mangledUUIDLength)
+	if _, err := tag.ReadData(1, 0, buf); err != nil {
+		t.Errorf("reading the UUID file with the read key: %s", err)
+	}
+
+	if _, err := tag.WriteData(1, 0, buf); err != errAuthentication {
+		t.Errorf("writing the UUID file returned %v, want %v", err, errAuthentication)
+	}
+
+	if err := tag.ChangeFileSettings(1, freefare.Enciphered, initialFileSettings); err != errPermissionDenied {
+		t.Errorf("changing the UUID file settings returned %v, want %v", err, errPermissionDenied)
+	}
+
+	// The authenticity file is not readable with the read key
+	if _, err := tag.ReadData(2, 0, make([]byte, authenticityRLength)); err != errAuthentication {
+		t.Errorf("reading the authenticity file with the read key returned %v, want %v", err, errAuthentication)
+	}
+
+	// The auth key may only read the authenticity file
+	selectApp(2, *appAuthKey)
+
+	if _, err := tag.ReadData(1, 0, buf); err != errAuthentication {
+		t.Errorf("reading the UUID file with the auth key returned %v, want %v", err, errAuthentication)
+	}
+
+	if _, err := tag.ReadData(2, 0, make([]byte, authenticityRLength)); err != nil {
+		t.Errorf("reading the authenticity file with the auth key: %s", err)
+	}
+
+	if _, err := tag.WriteData(2, 0, make([]byte, authenticityRLength)); err != errAuthentication {
+		t.Errorf("writing the authenticity file with the auth key returned %v, want %v", err, errAuthentication)
+	}
+
+	// The default application master key no longer works
+	if err := tag.SelectApplication(appId); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tag.Authenticate(0, *defaultDESFireAESKey); err != errAuthentication {
+		t.Errorf("authenticating with the default master key returned %v, want %v", err, errAuthentication)
+	}
+}
+
+func TestFormatPICC(t *testing.T) {
+	ctx := context.Background()
+	systemSecret := testSecret(t)
+	realm := testRealm(t, "test", 3, systemSecret)
+	tag := connectedTag(t)
+
+	// Formatting requires authenticating to the master application
+	if err := tag.FormatPICC(); err != errAuthentication {
+		t.Errorf("unauthenticated format returned %v, want %v", err, errAuthentication)
+	}
+
+	if _, err := issue(ctx, tag, systemSecret, []Realm{realm}, nil, false, testLogger()); err != nil {
+		t.Fatalf("issue: %s", err)
+	}
+
+	if err := tag.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	uid, err := format(ctx, tag, systemSecret, []Realm{realm}, testLogger())
+	if err != nil {
+		t.Fatalf("format: %s", err)
+	}
+
+	if uid != "04112233445566" {
+		t.Errorf("format reported UID %s, want 04112233445566", uid)
+	}
+
+	// The tag is back to factory defaults, with no applications
+	if err := tag.Authenticate(0, *defaultDESFireDESKey); err != nil {
+		t.Fatalf("authenticating with the default PICC key: %s", err)
+	}
+
+	aids, err := tag.ApplicationIds()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(aids) != 0 {
+		t.Errorf("formatted tag has %d applications, want none", len(aids))
+	}
+
+	if freeMem, _ := tag.FreeMem(); freeMem != emulatedStorageSize {
+		t.Errorf("formatted tag has %d bytes free, want %d", freeMem, emulatedStorageSize)
+	}
+
+	// Once disabled, formatting is refused even with the PICC master key
+	if err := tag.SetConfiguration(true, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tag.FormatPICC(); err != errPermissionDenied {
+		t.Errorf("format with formatting disabled returned %v, want %v", err, errPermissionDenied)
+	}
+}
+
+func TestRevokeFormatWithReadKeys(t *testing.T) {
+	ctx := context.Background()
+	systemSecret := testSecret(t)
+	realmA := testRealm(t, "a", 6, systemSecret)
+	realmB := testRealm(t, "b", 7, systemSecret)
+	tag := connectedTag(t)
+
+	if _, err := issue(ctx, tag, systemSecret, []Realm{realmA, realmB}, nil, false, testLogger()); err != nil {
+		t.Fatalf("issue: %s", err)
+	}
+
+	if err := tag.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Revoking and formatting only need the slot and read key of a realm on the tag
+	lookupA := Realm{Name: realmA.Name, Slot: realmA.Slot, ReadKey: realmA.ReadKey}
+	lookupB := Realm{Name: realmB.Name, Slot: realmB.Slot, ReadKey: realmB.ReadKey}
+
+	if _, err := revoke(ctx, tag, systemSecret, lookupB, testLogger()); err != nil {
+		t.Fatalf("revoke: %s", err)
+	}
+
+	if _, err := authenticate(ctx, tag, realmB, testLogger()); err != errApplicationNotFound {
+		t.Errorf("authenticate revoked realm returned %v, want %v", err, errApplicationNotFound)
+	}
+
+	if _, err := authenticate(ctx, tag, realmA, testLogger()); err != nil {
+		t.Errorf("authenticate remaining realm: %s", err)
+	}
+
+	if err := tag.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := format(ctx, tag, systemSecret, []Realm{lookupB, lookupA}, testLogger()); err != nil {
+		t.Fatalf("format: %s", err)
+	}
+
+	if _, err := authenticate(ctx, tag, realmA, testLogger()); err != errApplicationNotFound {
+		t.Errorf("authenticate after format returned %v, want %v", err, errApplicationNotFound)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	ctx := context.Background()
+	systemSecret := testSecret(t)
+	realmA := testRealm(t, "a", 8, systemSecret)
+	realmB := testRealm(t, "b", 9, systemSecret)
+	tag := connectedTag(t)
+
+	if _, err := issue(ctx, tag, systemSecret, []Realm{realmA, realmB}, nil, false, testLogger()); err != nil {
+		t.Fatalf("issue: %s", err)
+	}
+
+	if err := tag.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := revoke(ctx, tag, systemSecret, realmB, testLogger()); err != nil {
+		t.Fatalf("revoke: %s", err)
+	}
+
+	if err := tag.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A realm whose signatures were made with another key
+	forged := realmA
+	forged.Name = "forged"
+	forged.PublicKey = testRealm(t, "other", 8, systemSecret).PublicKey
+
+	// The revoked realm comes first, so the others are only reported if
+	// inspect carries on past it
+	info, err := inspect(ctx, tag, systemSecret, []Realm{realmB, realmA, forged}, testLogger())
+	if err != nil {
+		t.Fatalf("inspect: %s", err)
+	}
+
+	if info.UID != "04112233445566" || !info.RandomUID {
+		t.Errorf("inspect reported UID %s (random %t), want 04112233445566 (random)", info.UID, info.RandomUID)
+	}
+
+	if len(info.Errors) != 0 {
+		t.Errorf("inspect reported errors: %v", info.Errors)
+	}
+
+	if len(info.Applications) != 1 {
+		t.Fatalf("inspect found %d applications, want only realm a's", len(info.Applications))
+	}
+
+	if app := info.Applications[0]; app.Slot != realmA.Slot || app.Error != "" || len(app.Files) != 2 {
+		t.Errorf("inspect reported slot %d with %d files (%s), want slot %d with 2 files", app.Slot, len(app.Files), app.Error, realmA.Slot)
+	}
+
+	if len(info.Realms) != 3 {
+		t.Fatalf("inspect reported %d realms, want 3", len(info.Realms))
+	}
+
+	revoked, issued, bad := info.Realms[0], info.Realms[1], info.Realms[2]
+
+	if revoked.Slot != realmB.Slot || revoked.Authenticated || revoked.Error != errApplicationNotFound.Error() {
+		t.Errorf("revoked realm reported as %+v, want error %q", revoked, errApplicationNotFound)
+	}
+
+	if issued.Slot != realmA.Slot || !issued.Authenticated || !issued.Matches || issued.AssociationID != realmA.AssociationID.String() {
+		t.Errorf("issued realm reported as %+v, want it authenticated as %s", issued, realmA.AssociationID)
+	}
+
+	if bad.Authenticated || bad.Error != ErrSignatureInvalid.Error() {
+		t.Errorf("forged realm reported as %+v, want error %q", bad, ErrSignatureInvalid)
+	}
+}
@@ -0,0 +1,53 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package device
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// Outcomes of waiting for a card
+const (
+	cardWaitPresented = "presented"
+	cardWaitAbandoned = "abandoned"
+	cardWaitError     = "error"
+)
+
+var (
+	readerOpenFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gatekeeper",
+		Name:      "reader_open_failures_total",
+		Help:      "Number of times the NFC reader could not be opened.",
+	})
+
+	cardWaitSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gatekeeper",
+		Name:      "card_wait_seconds",
+		Help:      "Time spent waiting for a card to be presented to the reader.",
+		Buckets:   prometheus.ExponentialBuckets(0.25, 2, 10),
+	}, []string{"outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(readerOpenFailures, cardWaitSeconds)
+}
+
+func observeCardWait(start time.Time, outcome string) {
+	cardWaitSeconds.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+}
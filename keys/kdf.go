@@ -25,7 +25,7 @@ import (
 
 const kdfHMACAlgorithm = crypto.SHA512
 
-func DeriveDESFireKey(secret []byte, appId freefare.DESFireAid, keyNum uint8, data []byte) (*freefare.DESFireKey, error) {
+func DeriveDESFireKey(secret []byte, appId freefare.DESFireAid, keyNum uint8, data []byte) (*DESFireKey, error) {
 	mac := hmac.New(kdfHMACAlgorithm.New, secret)
 
 	if _, err := mac.Write([]byte{appId[0], appId[1], appId[2]}); err != nil {
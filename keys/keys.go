@@ -23,13 +23,52 @@ import (
 	"github.com/fuzxxl/freefare/0.3/freefare"
 )
 
-func GenDESFireKey(key []byte) *freefare.DESFireKey {
+// DESFire key types
+const (
+	DESFireKeyDES byte = iota
+	DESFireKeyAES
+)
+
+// Represents DESFire key material; libfreefare keys are opaque, so keys are
+// kept in this form and only converted when talking to a real target
+type DESFireKey struct {
+	Type    byte
+	Value   [16]byte
+	Version byte
+}
+
+func NewDESFireDESKey(value [8]byte) *DESFireKey {
+	key := &DESFireKey{Type: DESFireKeyDES}
+	copy(key.Value[:], value[:])
+	return key
+}
+
+func NewDESFireAESKey(value [16]byte, version byte) *DESFireKey {
+	return &DESFireKey{
+		Type:    DESFireKeyAES,
+		Value:   value,
+		Version: version,
+	}
+}
+
+// Converts the key to its libfreefare representation
+func (k DESFireKey) Freefare() *freefare.DESFireKey {
+	if k.Type == DESFireKeyDES {
+		var value [8]byte
+		copy(value[:], k.Value[:])
+		return freefare.NewDESFireDESKey(value)
+	}
+
+	return freefare.NewDESFireAESKey(k.Value, k.Version)
+}
+
+func GenDESFireKey(key []byte) *DESFireKey {
 	var keyArr [16]byte
 	copy(keyArr[:], key[:])
-	return freefare.NewDESFireAESKey(keyArr, 0)
+	return NewDESFireAESKey(keyArr, 0)
 }
 
-func GenRandomDESFireKey() (*freefare.DESFireKey, error) {
+func GenRandomDESFireKey() (*DESFireKey, error) {
 	key := make([]byte, 16)
 	if _, err := rand.Read(key); err != nil {
 		return nil, err
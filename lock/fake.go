@@ -0,0 +1,65 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package lock
+
+import (
+	"github.com/labstack/gommon/log"
+	"io/ioutil"
+	"time"
+)
+
+// Stands in for lock hardware on machines without any, logging each change
+// and optionally writing the current state to a file
+type FakeLock struct {
+	*timedLock
+	path string
+}
+
+// Returns a fake lock; if path is not empty, the lock's state is written to it
+func NewFakeLock(path string, log *log.Logger) (*FakeLock, error) {
+	l := &FakeLock{path: path}
+	l.timedLock = newTimedLock(func(unlocked bool) error {
+		state := Locked
+		if unlocked {
+			state = Unlocked
+		}
+
+		log.Infof("Fake lock %s", state)
+
+		if l.path == "" {
+			return nil
+		}
+
+		return ioutil.WriteFile(l.path, []byte(string(state)+"\n"), 0644)
+	}, log)
+
+	// Start from a known state
+	if err := l.Lock(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *FakeLock) Unlock(duration time.Duration) error {
+	return l.timedLock.Unlock(duration)
+}
+
+func (l *FakeLock) Close() error {
+	return l.Lock()
+}
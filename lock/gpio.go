@@ -0,0 +1,73 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package lock
+
+import (
+	"errors"
+	"fmt"
+	"github.com/labstack/gommon/log"
+	"time"
+)
+
+// Configures a lock driven by a single GPIO line
+type GPIOConfig struct {
+	// GPIO character device, e.g. /dev/gpiochip0
+	Chip string
+	// Offset of the line on the chip
+	Line uint32
+	// Whether the strike is released by driving the line low
+	ActiveLow bool
+}
+
+// Drives a strike through a Linux GPIO character device
+type GPIOLock struct {
+	*timedLock
+	line *gpioLine
+}
+
+// Requests the configured line as an output, initially locked. Failures to
+// relock are logged to log.
+func OpenGPIO(config GPIOConfig, log *log.Logger) (*GPIOLock, error) {
+	if config.Chip == "" {
+		return nil, errors.New("no GPIO chip configured")
+	}
+
+	line, err := requestGPIOLine(config.Chip, config.Line, config.ActiveLow, "gkdoor")
+	if err != nil {
+		return nil, fmt.Errorf("unable to request GPIO line %d on %s: %s", config.Line, config.Chip, err)
+	}
+
+	return &GPIOLock{
+		timedLock: newTimedLock(line.set, log),
+		line:      line,
+	}, nil
+}
+
+func (l *GPIOLock) Unlock(duration time.Duration) error {
+	return l.timedLock.Unlock(duration)
+}
+
+func (l *GPIOLock) Close() error {
+	lockErr := l.Lock()
+
+	if err := l.line.close(); err != nil {
+		return err
+	}
+
+	return lockErr
+}
@@ -0,0 +1,116 @@
+//go:build linux
+// +build linux
+
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package lock
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Constants from the GPIO character device ABI in <linux/gpio.h>
+const (
+	gpioHandlesMax = 64
+
+	gpioHandleRequestOutput    = 1 << 1
+	gpioHandleRequestActiveLow = 1 << 2
+)
+
+type gpioHandleRequest struct {
+	LineOffsets   [gpioHandlesMax]uint32
+	Flags         uint32
+	DefaultValues [gpioHandlesMax]uint8
+	ConsumerLabel [32]byte
+	Lines         uint32
+	Fd            int32
+}
+
+type gpioHandleData struct {
+	Values [gpioHandlesMax]uint8
+}
+
+// ioctlReadWrite encodes an _IOWR ioctl request number
+func ioctlReadWrite(nr, size uintptr) uintptr {
+	const (
+		gpioIoctlType = 0xB4
+		dirReadWrite  = 3
+	)
+
+	return dirReadWrite<<30 | size<<16 | gpioIoctlType<<8 | nr
+}
+
+var (
+	gpioGetLineHandleIoctl       = ioctlReadWrite(0x03, unsafe.Sizeof(gpioHandleRequest{}))
+	gpioHandleSetLineValuesIoctl = ioctlReadWrite(0x09, unsafe.Sizeof(gpioHandleData{}))
+)
+
+// Represents an output line requested from a GPIO chip
+type gpioLine struct {
+	fd uintptr
+}
+
+func ioctl(fd, request uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg)); errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func requestGPIOLine(chip string, offset uint32, activeLow bool, consumer string) (*gpioLine, error) {
+	chipFile, err := os.OpenFile(chip, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	// The line handle stays valid once the chip is closed
+	defer chipFile.Close()
+
+	request := gpioHandleRequest{
+		Flags: gpioHandleRequestOutput,
+		Lines: 1,
+	}
+	request.LineOffsets[0] = offset
+	copy(request.ConsumerLabel[:len(request.ConsumerLabel)-1], consumer)
+
+	if activeLow {
+		// The kernel inverts values, so 1 always means released
+		request.Flags |= gpioHandleRequestActiveLow
+	}
+
+	if err := ioctl(chipFile.Fd(), gpioGetLineHandleIoctl, unsafe.Pointer(&request)); err != nil {
+		return nil, err
+	}
+
+	return &gpioLine{fd: uintptr(request.Fd)}, nil
+}
+
+func (l *gpioLine) set(active bool) error {
+	var data gpioHandleData
+	if active {
+		data.Values[0] = 1
+	}
+
+	return ioctl(l.fd, gpioHandleSetLineValuesIoctl, unsafe.Pointer(&data))
+}
+
+func (l *gpioLine) close() error {
+	return syscall.Close(int(l.fd))
+}
@@ -0,0 +1,39 @@
+//go:build !linux
+// +build !linux
+
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package lock
+
+import "errors"
+
+var errGPIOUnsupported = errors.New("GPIO locks are only supported on Linux")
+
+type gpioLine struct{}
+
+func requestGPIOLine(chip string, offset uint32, activeLow bool, consumer string) (*gpioLine, error) {
+	return nil, errGPIOUnsupported
+}
+
+func (l *gpioLine) set(active bool) error {
+	return errGPIOUnsupported
+}
+
+func (l *gpioLine) close() error {
+	return errGPIOUnsupported
+}
@@ -0,0 +1,171 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package lock
+
+import (
+	"github.com/labstack/gommon/log"
+	"sync"
+	"time"
+)
+
+// Represents whether a lock's strike is released
+type State string
+
+const (
+	Locked   State = "locked"
+	Unlocked State = "unlocked"
+)
+
+// Represents a lock actuator, such as a door strike
+type Lock interface {
+	// Releases the lock, relocking it once duration has passed. Unlocking
+	// an unlocked lock extends the time until it relocks.
+	Unlock(duration time.Duration) error
+	// Engages the lock immediately
+	Lock() error
+	State() State
+	// Reports why the lock last failed to engage, or nil once it has engaged
+	Err() error
+	// Engages the lock and releases the underlying hardware
+	Close() error
+}
+
+// Ensure each lock conforms to the Lock interface
+var (
+	_ Lock = (*GPIOLock)(nil)
+	_ Lock = (*FakeLock)(nil)
+)
+
+// Delays between attempts to relock a lock which failed to engage, doubling
+// from the first up to the last
+var (
+	relockBackoff    = 100 * time.Millisecond
+	relockBackoffMax = 10 * time.Second
+)
+
+// Handles timed relocking for a lock driven by a function which releases or
+// engages the hardware
+type timedLock struct {
+	mu    sync.Mutex
+	set   func(unlocked bool) error
+	log   *log.Logger
+	state State
+	err   error
+	timer *time.Timer
+	// Incremented on every change, so stale relock timers do nothing
+	generation uint64
+}
+
+func newTimedLock(set func(unlocked bool) error, log *log.Logger) *timedLock {
+	return &timedLock{
+		set:   set,
+		log:   log,
+		state: Locked,
+	}
+}
+
+func (l *timedLock) Unlock(duration time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.set(true); err != nil {
+		return err
+	}
+
+	l.state = Unlocked
+	l.generation++
+	generation := l.generation
+
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+
+	l.timer = time.AfterFunc(duration, func() {
+		l.relock(generation, relockBackoff)
+	})
+
+	return nil
+}
+
+// relock engages the lock once an unlock expires. A strike left released is
+// worse than any error, so failures are retried with backoff until the lock
+// engages or is changed again.
+func (l *timedLock) relock(generation uint64, backoff time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.generation != generation {
+		return
+	}
+
+	err := l.engage()
+	if err == nil {
+		return
+	}
+
+	l.log.Errorf("Unable to relock, retrying in %s: %s", backoff, err)
+
+	next := backoff * 2
+	if next > relockBackoffMax {
+		next = relockBackoffMax
+	}
+
+	generation = l.generation
+	l.timer = time.AfterFunc(backoff, func() {
+		l.relock(generation, next)
+	})
+}
+
+func (l *timedLock) Lock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.engage()
+}
+
+// engage locks the hardware; callers must hold l.mu
+func (l *timedLock) engage() error {
+	l.generation++
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+
+	if err := l.set(false); err != nil {
+		l.err = err
+		return err
+	}
+
+	l.state = Locked
+	l.err = nil
+	return nil
+}
+
+func (l *timedLock) State() State {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.state
+}
+
+func (l *timedLock) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.err
+}
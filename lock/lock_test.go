@@ -0,0 +1,205 @@
+/*
+	Copyright (C) 2019 Steven Mirabito (smirabito@csh.rit.edu)
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Lesser General Public License as published
+	by the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Lesser General Public License for more details.
+
+	You should have received a copy of the GNU Lesser General Public License
+	along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package lock
+
+import (
+	"errors"
+	"github.com/labstack/gommon/log"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Relock durations are long enough that scheduling delays do not matter
+const (
+	testUnlockTime = 200 * time.Millisecond
+	testMargin     = 100 * time.Millisecond
+)
+
+func testFakeLock(t *testing.T) (*FakeLock, func() State, func()) {
+	dir, err := ioutil.TempDir("", "gkdoor-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := log.New("test")
+	logger.SetOutput(ioutil.Discard)
+
+	path := filepath.Join(dir, "state")
+	l, err := NewFakeLock(path, logger)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	// Reports the state written to the state file, checking it matches State
+	state := func() State {
+		t.Helper()
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		written := State(strings.TrimSpace(string(data)))
+		if current := l.State(); current != written {
+			t.Errorf("lock reports %s, but wrote %s", current, written)
+		}
+
+		return written
+	}
+
+	cleanup := func() {
+		_ = l.Close()
+		_ = os.RemoveAll(dir)
+	}
+
+	return l, state, cleanup
+}
+
+func TestFakeLockRelocks(t *testing.T) {
+	l, state, cleanup := testFakeLock(t)
+	defer cleanup()
+
+	if s := state(); s != Locked {
+		t.Fatalf("new lock is %s, want %s", s, Locked)
+	}
+
+	if err := l.Unlock(testUnlockTime); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := state(); s != Unlocked {
+		t.Errorf("lock is %s after unlocking, want %s", s, Unlocked)
+	}
+
+	time.Sleep(testUnlockTime + testMargin)
+
+	if s := state(); s != Locked {
+		t.Errorf("lock is %s after the unlock time, want %s", s, Locked)
+	}
+}
+
+func TestFakeLockUnlockExtends(t *testing.T) {
+	l, state, cleanup := testFakeLock(t)
+	defer cleanup()
+
+	if err := l.Unlock(testUnlockTime); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unlock again part way through; the first timer must not relock early
+	time.Sleep(testUnlockTime / 2)
+	if err := l.Unlock(testUnlockTime); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(testUnlockTime * 3 / 4)
+	if s := state(); s != Unlocked {
+		t.Errorf("lock is %s after the first unlock time, want %s until the second expires", s, Unlocked)
+	}
+
+	time.Sleep(testUnlockTime/4 + testMargin)
+	if s := state(); s != Locked {
+		t.Errorf("lock is %s after the second unlock time, want %s", s, Locked)
+	}
+}
+
+func TestFakeLockStaleTimer(t *testing.T) {
+	l, state, cleanup := testFakeLock(t)
+	defer cleanup()
+
+	if err := l.Unlock(testUnlockTime / 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// Locking cancels the relock; a later unlock is not cut short by it
+	if err := l.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := state(); s != Locked {
+		t.Errorf("lock is %s after locking, want %s", s, Locked)
+	}
+
+	if err := l.Unlock(testUnlockTime * 2); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(testUnlockTime/2 + testMargin)
+	if s := state(); s != Unlocked {
+		t.Errorf("lock is %s, want %s; a stale timer relocked it", s, Unlocked)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := state(); s != Locked {
+		t.Errorf("lock is %s after closing, want %s", s, Locked)
+	}
+}
+
+func TestRelockRetries(t *testing.T) {
+	defer func(previous time.Duration) { relockBackoff = previous }(relockBackoff)
+	relockBackoff = testUnlockTime
+
+	logger := log.New("test")
+	logger.SetOutput(ioutil.Discard)
+
+	// The hardware refuses to engage the first time
+	var mu sync.Mutex
+	engaged, failures := false, 1
+	l := newTimedLock(func(unlocked bool) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if !unlocked && failures > 0 {
+			failures--
+			return errors.New("line busy")
+		}
+
+		engaged = !unlocked
+		return nil
+	}, logger)
+
+	if err := l.Unlock(testUnlockTime); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(testUnlockTime + testMargin)
+	if s, err := l.State(), l.Err(); s != Unlocked || err == nil {
+		t.Errorf("lock is %s (error %v) after failing to relock, want %s with an error", s, err, Unlocked)
+	}
+
+	time.Sleep(relockBackoff)
+	if s, err := l.State(), l.Err(); s != Locked || err != nil {
+		t.Errorf("lock is %s (error %v) after retrying, want %s without an error", s, err, Locked)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if !engaged {
+		t.Error("hardware was never engaged")
+	}
+}